@@ -0,0 +1,496 @@
+package zapp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	stdhash "hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/Kurt212/zapp/wal"
+)
+
+// Backup archive layout:
+//
+//	magic numbers (7 bytes) | archive version (1 byte) | segments number (4 bytes)
+//	for each segment:
+//	  segment's index (4 bytes) | last applied LSN (8 bytes) | data size (8 bytes) | segment's data file
+//	CRC32-C of all previous bytes (4 bytes)
+//
+// Incremental backup archive layout:
+//
+//	magic numbers (7 bytes) | archive version (1 byte) | segments number (4 bytes)
+//	for each segment:
+//	  segment's index (4 bytes) | from LSN (8 bytes) | to LSN (8 bytes) | actions size (8 bytes) | WAL's actions
+//	CRC32-C of all previous bytes (4 bytes)
+const (
+	backupArchiveVersion1 = 1
+
+	backupMagicNumbersSize   = 7 // bytes
+	backupVersionSize        = 1 // byte
+	backupSegmentsNumSize    = 4 // bytes
+	backupSegmentIdxSize     = 4 // bytes
+	backupSegmentLSNSize     = 8 // bytes
+	backupSegmentDataLenSize = 8 // bytes
+	backupChecksumSize       = 4 // bytes
+
+	backupHeaderSize                   = backupMagicNumbersSize + backupVersionSize + backupSegmentsNumSize
+	backupSegmentHeaderSize            = backupSegmentIdxSize + backupSegmentLSNSize + backupSegmentDataLenSize
+	incrementalBackupSegmentHeaderSize = backupSegmentIdxSize + 2*backupSegmentLSNSize + backupSegmentDataLenSize
+)
+
+var (
+	backupMagicNumbers            = []byte("zappbak")
+	incrementalBackupMagicNumbers = []byte("zappinc")
+
+	backupChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Backup writes a consistent copy of all segments to w as a single self-describing archive.
+// All segments are read locked for the whole backup, so the archive reflects a single point in time,
+// writes wait until the backup is finished, but reads are not blocked.
+// Returns the last applied LSN of each segment, which the archive corresponds to.
+// Without WAL all LSNs are zero.
+// Use Restore to create a data directory from the archive
+func (db *DB) Backup(w io.Writer) (map[int]uint64, error) {
+	// segments are locked in the order of their indexes, the same as batches do
+	for _, segment := range db.segments {
+		segment.rLockApplied()
+		defer segment.mtx.RUnlock()
+
+		if segment.closed {
+			return nil, ErrClosed
+		}
+	}
+
+	checksum := crc32.New(backupChecksumTable)
+	archiveWriter := io.MultiWriter(w, checksum)
+
+	header := make([]byte, 0, backupHeaderSize)
+	header = append(header, backupMagicNumbers...)
+	header = append(header, backupArchiveVersion1)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(db.segments)))
+
+	_, err := archiveWriter.Write(header)
+	if err != nil {
+		return nil, fmt.Errorf("can not write backup's header: %w", err)
+	}
+
+	lsns := make(map[int]uint64, len(db.segments))
+
+	for segmentIdx, segment := range db.segments {
+		segmentHeader := make([]byte, 0, backupSegmentHeaderSize)
+		segmentHeader = binary.BigEndian.AppendUint32(segmentHeader, uint32(segmentIdx))
+		segmentHeader = binary.BigEndian.AppendUint64(segmentHeader, segment.lastKnownLSN)
+		segmentHeader = binary.BigEndian.AppendUint64(segmentHeader, uint64(segment.fileSizeBytes))
+
+		_, err := archiveWriter.Write(segmentHeader)
+		if err != nil {
+			return nil, fmt.Errorf("can not write backup's segment %d header: %w", segmentIdx, err)
+		}
+
+		err = segment.rawWriteBackup(archiveWriter)
+		if err != nil {
+			return nil, fmt.Errorf("can not write backup's segment %d: %w", segmentIdx, err)
+		}
+
+		lsns[segmentIdx] = segment.lastKnownLSN
+	}
+
+	_, err = w.Write(checksum.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("can not write backup's checksum: %w", err)
+	}
+
+	return lsns, nil
+}
+
+// BackupSince writes all changes made after the backup with lsns to w as an incremental backup archive.
+// lsns are the LSNs returned by Backup or by the previous BackupSince. Missing segments are treated as zero LSNs.
+// The changes are read from WAL, so the DB must be opened with IncrementalBackup param,
+// otherwise WAL's history is truncated on checkpoints and ErrWALHistoryReleased is returned.
+// Like Backup, all segments are read locked for the whole backup.
+// Returns the LSNs, which the archive corresponds to. Use them for the next incremental backup
+func (db *DB) BackupSince(lsns map[int]uint64, w io.Writer) (map[int]uint64, error) {
+	// segments are locked in the order of their indexes, the same as batches do
+	for _, segment := range db.segments {
+		segment.rLockApplied()
+		defer segment.mtx.RUnlock()
+
+		if segment.closed {
+			return nil, ErrClosed
+		}
+	}
+
+	checksum := crc32.New(backupChecksumTable)
+	archiveWriter := io.MultiWriter(w, checksum)
+
+	header := make([]byte, 0, backupHeaderSize)
+	header = append(header, incrementalBackupMagicNumbers...)
+	header = append(header, backupArchiveVersion1)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(db.segments)))
+
+	_, err := archiveWriter.Write(header)
+	if err != nil {
+		return nil, fmt.Errorf("can not write backup's header: %w", err)
+	}
+
+	newLSNs := make(map[int]uint64, len(db.segments))
+
+	for segmentIdx, segment := range db.segments {
+		actions, err := segment.rawWALActionsSince(lsns[segmentIdx])
+		if err != nil {
+			return nil, fmt.Errorf("can not read segment's %d changes: %w", segmentIdx, err)
+		}
+
+		actionsBuffer := bytes.NewBuffer(nil)
+		for _, action := range actions {
+			err := wal.AppendAction(actionsBuffer, action)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		segmentHeader := make([]byte, 0, incrementalBackupSegmentHeaderSize)
+		segmentHeader = binary.BigEndian.AppendUint32(segmentHeader, uint32(segmentIdx))
+		segmentHeader = binary.BigEndian.AppendUint64(segmentHeader, lsns[segmentIdx])
+		segmentHeader = binary.BigEndian.AppendUint64(segmentHeader, segment.lastKnownLSN)
+		segmentHeader = binary.BigEndian.AppendUint64(segmentHeader, uint64(actionsBuffer.Len()))
+
+		_, err = archiveWriter.Write(segmentHeader)
+		if err != nil {
+			return nil, fmt.Errorf("can not write backup's segment %d header: %w", segmentIdx, err)
+		}
+
+		_, err = archiveWriter.Write(actionsBuffer.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("can not write backup's segment %d: %w", segmentIdx, err)
+		}
+
+		newLSNs[segmentIdx] = segment.lastKnownLSN
+	}
+
+	_, err = w.Write(checksum.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("can not write backup's checksum: %w", err)
+	}
+
+	return newLSNs, nil
+}
+
+// ReleaseWALHistory removes WAL's history up to lsns, which is kept for incremental backups.
+// Usually called with the LSNs of the latest full backup, because older changes are not needed anymore.
+// Changes, which are not persisted to segments' files yet, are kept anyway
+func (db *DB) ReleaseWALHistory(lsns map[int]uint64) error {
+	for segmentIdx, lsn := range lsns {
+		if segmentIdx < 0 || segmentIdx >= len(db.segments) {
+			return fmt.Errorf("%w: segment %d", ErrInvalidSegmentsNum, segmentIdx)
+		}
+
+		err := db.segments[segmentIdx].ReleaseWALHistory(lsn)
+		if err != nil {
+			return fmt.Errorf("can not release segment's %d WAL history: %w", segmentIdx, err)
+		}
+	}
+
+	return nil
+}
+
+// Restore creates a new data directory at path from the archive made by Backup
+// and then applies incremental archives made by BackupSince in the given order.
+// Each incremental archive must continue the previous one, otherwise ErrBackupChainBroken is returned.
+// The directory must not exist or must be empty. The number of segments of the DB opened at path
+// must be the same as the number of segments in the archive.
+// If an archive is corrupted, then ErrCorruptedBackup is returned and the directory is left empty
+func Restore(r io.Reader, path string, incrementals ...io.Reader) (err error) {
+	err = createEmptyDir(path)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			removeDirContent(path)
+		}
+	}()
+
+	lsns, err := restoreBackup(r, path)
+	if err != nil {
+		return err
+	}
+
+	if len(incrementals) == 0 {
+		return nil
+	}
+
+	for _, incremental := range incrementals {
+		err = restoreIncrementalBackup(incremental, path, lsns)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Changes are written to WAL files. Opening the DB applies them to data files
+	db, err := New(NewParamsBuilder(path).
+		SegmentsNum(len(lsns)).
+		UseWAL(true).
+		SyncPeriod(0).
+		RemoveExpiredPeriod(0).
+		Params())
+	if err != nil {
+		return fmt.Errorf("can not apply incremental backups: %w", err)
+	}
+
+	db.Close()
+
+	return nil
+}
+
+// restoreBackup restores data files from the archive made by Backup. Returns the LSNs of the archive
+func restoreBackup(r io.Reader, path string) (map[int]uint64, error) {
+	checksum := crc32.New(backupChecksumTable)
+	archiveReader := io.TeeReader(r, checksum)
+
+	segmentsNum, err := readBackupHeader(archiveReader, backupMagicNumbers)
+	if err != nil {
+		return nil, err
+	}
+
+	lsns := make(map[int]uint64, segmentsNum)
+
+	for i := uint32(0); i < segmentsNum; i++ {
+		segmentHeader := make([]byte, backupSegmentHeaderSize)
+
+		_, err = io.ReadFull(archiveReader, segmentHeader)
+		if err != nil {
+			return nil, fmt.Errorf("%w: can not read segment's header: %v", ErrCorruptedBackup, err)
+		}
+
+		segmentIdx := binary.BigEndian.Uint32(segmentHeader[:backupSegmentIdxSize])
+		lsn := binary.BigEndian.Uint64(segmentHeader[backupSegmentIdxSize : backupSegmentIdxSize+backupSegmentLSNSize])
+		dataLen := binary.BigEndian.Uint64(segmentHeader[backupSegmentIdxSize+backupSegmentLSNSize:])
+
+		if segmentIdx != i {
+			return nil, fmt.Errorf("%w: expected segment %d, but got %d", ErrCorruptedBackup, i, segmentIdx)
+		}
+
+		err = restoreSegmentFile(archiveReader, dataFilePath(path, int(segmentIdx)), int64(dataLen))
+		if err != nil {
+			return nil, err
+		}
+
+		lsns[int(segmentIdx)] = lsn
+	}
+
+	err = checkBackupChecksum(r, checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	return lsns, nil
+}
+
+// restoreIncrementalBackup appends changes from the archive made by BackupSince to segments' WAL files.
+// Only the changes after lsns are appended, then lsns are updated
+func restoreIncrementalBackup(r io.Reader, path string, lsns map[int]uint64) error {
+	checksum := crc32.New(backupChecksumTable)
+	archiveReader := io.TeeReader(r, checksum)
+
+	segmentsNum, err := readBackupHeader(archiveReader, incrementalBackupMagicNumbers)
+	if err != nil {
+		return err
+	}
+
+	if int(segmentsNum) != len(lsns) {
+		return fmt.Errorf("%w: expected %d segments, but got %d", ErrBackupChainBroken, len(lsns), segmentsNum)
+	}
+
+	segmentsActions := make([][]wal.Action, segmentsNum)
+	newLSNs := make(map[int]uint64, segmentsNum)
+
+	for i := uint32(0); i < segmentsNum; i++ {
+		segmentHeader := make([]byte, incrementalBackupSegmentHeaderSize)
+
+		_, err = io.ReadFull(archiveReader, segmentHeader)
+		if err != nil {
+			return fmt.Errorf("%w: can not read segment's header: %v", ErrCorruptedBackup, err)
+		}
+
+		offset := 0
+
+		segmentIdx := binary.BigEndian.Uint32(segmentHeader[offset : offset+backupSegmentIdxSize])
+		offset += backupSegmentIdxSize
+
+		fromLSN := binary.BigEndian.Uint64(segmentHeader[offset : offset+backupSegmentLSNSize])
+		offset += backupSegmentLSNSize
+
+		toLSN := binary.BigEndian.Uint64(segmentHeader[offset : offset+backupSegmentLSNSize])
+		offset += backupSegmentLSNSize
+
+		actionsLen := binary.BigEndian.Uint64(segmentHeader[offset : offset+backupSegmentDataLenSize])
+
+		if segmentIdx != i {
+			return fmt.Errorf("%w: expected segment %d, but got %d", ErrCorruptedBackup, i, segmentIdx)
+		}
+
+		// the archive may overlap with the previous one, but must not leave a gap
+		if fromLSN > lsns[int(segmentIdx)] {
+			return fmt.Errorf("%w: segment %d starts at lsn %d, but restored only up to lsn %d",
+				ErrBackupChainBroken, segmentIdx, fromLSN, lsns[int(segmentIdx)])
+		}
+
+		actionsBuffer := bytes.NewBuffer(nil)
+
+		_, err = io.CopyN(actionsBuffer, archiveReader, int64(actionsLen))
+		if err != nil {
+			return fmt.Errorf("%w: can not read segment's %d actions: %v", ErrCorruptedBackup, segmentIdx, err)
+		}
+
+		actions, err := wal.ReadActions(bytes.NewReader(actionsBuffer.Bytes()), lsns[int(segmentIdx)])
+		if err != nil {
+			return fmt.Errorf("%w: can not read segment's %d actions: %v", ErrCorruptedBackup, segmentIdx, err)
+		}
+
+		segmentsActions[segmentIdx] = actions
+
+		newLSNs[int(segmentIdx)] = lsns[int(segmentIdx)]
+		if toLSN > newLSNs[int(segmentIdx)] {
+			newLSNs[int(segmentIdx)] = toLSN
+		}
+	}
+
+	// nothing is written before the whole archive is checked
+	err = checkBackupChecksum(r, checksum)
+	if err != nil {
+		return err
+	}
+
+	for segmentIdx, actions := range segmentsActions {
+		err := appendToWALFile(walFilePath(path, segmentIdx), actions)
+		if err != nil {
+			return err
+		}
+
+		lsns[segmentIdx] = newLSNs[segmentIdx]
+	}
+
+	return nil
+}
+
+// readBackupHeader reads and checks the archive's header. Returns the number of segments in the archive
+func readBackupHeader(r io.Reader, magicNumbers []byte) (uint32, error) {
+	header := make([]byte, backupHeaderSize)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, fmt.Errorf("%w: can not read header: %v", ErrCorruptedBackup, err)
+	}
+
+	if !bytes.Equal(header[:backupMagicNumbersSize], magicNumbers) {
+		return 0, fmt.Errorf("%w: magic numbers do not match", ErrCorruptedBackup)
+	}
+
+	if header[backupMagicNumbersSize] != backupArchiveVersion1 {
+		return 0, fmt.Errorf("%w: unknown archive version %d", ErrCorruptedBackup, header[backupMagicNumbersSize])
+	}
+
+	return binary.BigEndian.Uint32(header[backupMagicNumbersSize+backupVersionSize:]), nil
+}
+
+// checkBackupChecksum reads the archive's trailing checksum and compares it with the checksum of read content
+func checkBackupChecksum(r io.Reader, checksum stdhash.Hash32) error {
+	expectedChecksum := checksum.Sum(nil)
+
+	actualChecksum := make([]byte, backupChecksumSize)
+
+	_, err := io.ReadFull(r, actualChecksum)
+	if err != nil {
+		return fmt.Errorf("%w: can not read checksum: %v", ErrCorruptedBackup, err)
+	}
+
+	if !bytes.Equal(expectedChecksum, actualChecksum) {
+		return fmt.Errorf("%w: checksum does not match", ErrCorruptedBackup)
+	}
+
+	return nil
+}
+
+func appendToWALFile(walPath string, actions []wal.Action) error {
+	file, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("can not open wal file %s: %w", walPath, err)
+	}
+
+	defer file.Close()
+
+	for _, action := range actions {
+		err := wal.AppendAction(file, action)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("can not sync file %s: %w", walPath, err)
+	}
+
+	return nil
+}
+
+func restoreSegmentFile(r io.Reader, segPath string, dataLen int64) error {
+	file, err := os.OpenFile(segPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("can not create file %s: %w", segPath, err)
+	}
+
+	defer file.Close()
+
+	n, err := io.CopyN(file, r, dataLen)
+	if err != nil {
+		return fmt.Errorf("%w: got only %d of %d bytes of %s: %v", ErrCorruptedBackup, n, dataLen, segPath, err)
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("can not sync file %s: %w", segPath, err)
+	}
+
+	return nil
+}
+
+// createEmptyDir creates the directory at path, if it doesn't exist. Existing directory must be empty
+func createEmptyDir(path string) error {
+	entries, err := os.ReadDir(path)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(path, 0755)
+		if err != nil {
+			return fmt.Errorf("can not create %s dir: %w", path, err)
+		}
+
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can not read %s dir: %w", path, err)
+	}
+
+	if len(entries) > 0 {
+		return fmt.Errorf("%w: %s", ErrDirNotEmpty, path)
+	}
+
+	return nil
+}
+
+// removeDirContent removes everything inside the directory at path, but keeps the directory itself
+func removeDirContent(path string) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		os.RemoveAll(fmt.Sprintf("%s/%s", path, entry.Name()))
+	}
+}
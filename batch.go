@@ -0,0 +1,186 @@
+package zapp
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Kurt212/zapp/wal"
+)
+
+// WriteBatch is a group of Put and Delete operations, which are committed atomically.
+// The operations may belong to different segments. Nobody sees the batch half-applied,
+// and if WAL is enabled, then after a crash the batch is recovered all-or-nothing.
+// WriteBatch is not safe for concurrent use
+type WriteBatch struct {
+	db        *DB
+	actions   []wal.Action
+	committed bool
+}
+
+func (db *DB) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{
+		db: db,
+	}
+}
+
+// Put adds set operation to the batch. The expire time is calculated from ttl right now, not when the batch is committed
+func (b *WriteBatch) Put(key string, data []byte, ttl time.Duration) {
+	expireTime := ttlToExpire(ttl)
+
+	b.actions = append(b.actions, wal.Action{
+		Type:   wal.ActionTypeSetMilli,
+		Key:    []byte(key),
+		Value:  data,
+		Expire: expireTime,
+	})
+}
+
+// Delete adds delete operation to the batch. Deleting a not existing key is not an error
+func (b *WriteBatch) Delete(key string) {
+	b.actions = append(b.actions, wal.Action{
+		Type: wal.ActionTypeDel,
+		Key:  []byte(key),
+	})
+}
+
+// Len returns the number of operations in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.actions)
+}
+
+// Commit applies all batch's operations atomically.
+// All segments affected by the batch are locked in the order of their indexes, so concurrent batches can not deadlock.
+// If WAL is enabled, then the whole batch is appended to WAL of each affected segment before applying it.
+// So if the program stops in the middle of committing, the batch is recovered from any WAL, which has it.
+// The batch can be committed only once
+func (b *WriteBatch) Commit() error {
+	if b.committed {
+		return ErrBatchCommitted
+	}
+
+	b.committed = true
+
+	if len(b.actions) == 0 {
+		return nil
+	}
+
+	db := b.db
+
+	// group actions by segments keeping their order
+	segmentActions := make(map[int][]wal.Action)
+	for _, action := range b.actions {
+		segmentIdx := getSegmentIndex(hash(action.Key), len(db.segments))
+
+		segmentActions[segmentIdx] = append(segmentActions[segmentIdx], action)
+	}
+
+	segmentIdxs := make([]int, 0, len(segmentActions))
+	for segmentIdx := range segmentActions {
+		segmentIdxs = append(segmentIdxs, segmentIdx)
+	}
+
+	sort.Ints(segmentIdxs)
+
+	return db.commitBatch(segmentIdxs, segmentActions)
+}
+
+// commitBatch appends the batch to WAL of each affected segment and applies it under segments' locks.
+// With WAL the batch is applied only after all its WAL's entries are synced. The locks are held during the sync,
+// so nobody sees the batch applied to a part of segments
+func (db *DB) commitBatch(segmentIdxs []int, segmentActions map[int][]wal.Action) error {
+	for _, segmentIdx := range segmentIdxs {
+		segment := db.segments[segmentIdx]
+
+		segment.mtx.Lock()
+		defer segment.mtx.Unlock()
+
+		if segment.closed {
+			return ErrClosed
+		}
+	}
+
+	// WAL is either enabled for all segments or disabled for all of them
+	if db.segments[segmentIdxs[0]].wal == nil {
+		for _, segmentIdx := range segmentIdxs {
+			err := db.segments[segmentIdx].rawApplyBatchActions(segmentActions[segmentIdx], 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// reserve LSN in each segment's WAL. It's safe because all appends to WAL happen under segment's lock
+	parts := make([]wal.BatchPart, 0, len(segmentIdxs))
+	for _, segmentIdx := range segmentIdxs {
+		parts = append(parts, wal.BatchPart{
+			Segment: uint32(segmentIdx),
+			LSN:     db.segments[segmentIdx].wal.LastLSN() + 1,
+			Actions: segmentActions[segmentIdx],
+		})
+	}
+
+	for i, segmentIdx := range segmentIdxs {
+		segment := db.segments[segmentIdx]
+
+		// segment's own part must go first
+		segmentParts := make([]wal.BatchPart, 0, len(parts))
+		segmentParts = append(segmentParts, parts[i])
+		segmentParts = append(segmentParts, parts[:i]...)
+		segmentParts = append(segmentParts, parts[i+1:]...)
+
+		lsn, err := segment.wal.AppendBatch(segmentParts)
+		if err != nil {
+			panic(fmt.Errorf("got error when append batch action to WAL: %w", err))
+		}
+
+		actions := segmentActions[segmentIdx]
+
+		hashes := make([]uint32, 0, len(actions))
+		for _, action := range actions {
+			hashes = append(hashes, hash(action.Key))
+		}
+
+		segment.rawAddPendingWrite(lsn, hashes, func() error {
+			return segment.rawApplyBatchActions(actions, lsn)
+		})
+	}
+
+	for _, segmentIdx := range segmentIdxs {
+		db.segments[segmentIdx].rawApplyPendingWrites()
+	}
+
+	return nil
+}
+
+// recoverBatches makes sure that each batch found in WAL files is applied to all its segments.
+// Only called on DB creation, when all segments are opened
+func (db *DB) recoverBatches() error {
+	for _, segment := range db.segments {
+		if len(segment.recoveredBatches) == 0 {
+			continue
+		}
+
+		for _, batch := range segment.recoveredBatches {
+			// the first part belongs to the segment itself and is already applied
+			for _, part := range batch[1:] {
+				if int(part.Segment) >= len(db.segments) {
+					return fmt.Errorf("batch with lsn %d refers to segment %d, but there are only %d segments",
+						batch[0].LSN, part.Segment, len(db.segments))
+				}
+
+				err := db.segments[part.Segment].RecoverBatchPart(part)
+				if err != nil {
+					return fmt.Errorf("got error when recovering batch's part with lsn %d in segment %d: %w",
+						part.LSN, part.Segment, err)
+				}
+			}
+		}
+
+		segment.FinishBatchesRecovery()
+	}
+
+	return nil
+}
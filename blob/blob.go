@@ -6,17 +6,113 @@ import (
 )
 
 const (
-	SizePowerSize = 1 // byte
-	StatusSize    = 1 // byte
-	KeyLenSize    = 2 // bytes
-	ValLenSize    = 4 // bytes
-	ExpireSize    = 4 // bytes
+	SizeClassSize  = 1 // byte. Power of two before layout version 4
+	StatusSize     = 1 // byte
+	KeyLenSize     = 2 // bytes
+	ValLenSize     = 4 // bytes
+	ExpireSizeV1   = 4 // bytes. Unix seconds in layout versions 1 and 2
+	ExpireSizeV3   = 8 // bytes. Unix milliseconds since layout version 3
+	VersionSize    = 8 // bytes. Since layout version 2
+	ChecksumSize   = 4 // bytes. Since layout version 5
+	commonHeadSize = SizeClassSize + StatusSize + KeyLenSize + ValLenSize
+
+	HeaderSizeV1 = commonHeadSize + ExpireSizeV1               // bytes
+	HeaderSizeV2 = HeaderSizeV1 + VersionSize                  // bytes
+	HeaderSizeV3 = commonHeadSize + ExpireSizeV3 + VersionSize // bytes
+	HeaderSizeV5 = HeaderSizeV3 + ChecksumSize                 // bytes
+
+	StatusOffset = SizeClassSize
+	ExpireOffset = commonHeadSize
+)
+
+// Layout is the version of blob's binary layout.
+// All blobs in a single segment's file have the same layout
+type Layout byte
 
-	HeaderSize = SizePowerSize + StatusSize + KeyLenSize + ValLenSize + ExpireSize // bytes
+const (
+	LayoutVersion1 Layout = 1 // the first layout version
+	LayoutVersion2 Layout = 2 // adds item's version to the header
+	LayoutVersion3 Layout = 3 // stores expire as int64 unix milliseconds instead of uint32 unix seconds
+	LayoutVersion4 Layout = 4 // stores blob's size class instead of power of two
+	LayoutVersion5 Layout = 5 // adds CRC32-C checksum of the blob to the header
 
-	StatusOffset = SizePowerSize
+	LatestLayout = LayoutVersion5
 )
 
+func (l Layout) IsKnown() bool {
+	return l >= LayoutVersion1 && l <= LatestLayout
+}
+
+func (l Layout) HeaderSize() int {
+	switch {
+	case l >= LayoutVersion5:
+		return HeaderSizeV5
+	case l >= LayoutVersion3:
+		return HeaderSizeV3
+	case l >= LayoutVersion2:
+		return HeaderSizeV2
+	default:
+		return HeaderSizeV1
+	}
+}
+
+// HasVersions tells if blobs of this layout store item's version
+func (l Layout) HasVersions() bool {
+	return l >= LayoutVersion2
+}
+
+// HasSizeClasses tells if blobs of this layout are padded to size classes instead of powers of two
+func (l Layout) HasSizeClasses() bool {
+	return l >= LayoutVersion4
+}
+
+// HasChecksums tells if blobs of this layout store the checksum of their content
+func (l Layout) HasChecksums() bool {
+	return l >= LayoutVersion5
+}
+
+// ExpireSize returns the size of the expire field in bytes
+func (l Layout) ExpireSize() int {
+	if l >= LayoutVersion3 {
+		return ExpireSizeV3
+	}
+
+	return ExpireSizeV1
+}
+
+// AppendExpire appends expire in the layout's binary format.
+// Expire is always unix milliseconds. Layouts before version 3 store seconds, so milliseconds are truncated
+func AppendExpire(buffer []byte, expire int64, layout Layout) []byte {
+	if layout >= LayoutVersion3 {
+		return binary.BigEndian.AppendUint64(buffer, uint64(expire))
+	}
+
+	seconds := expire / 1000
+	// zero means no expiration time, so it must not appear from truncation
+	if expire != 0 && seconds <= 0 {
+		seconds = 1
+	}
+
+	return binary.BigEndian.AppendUint32(buffer, uint32(seconds))
+}
+
+func readExpire(buffer []byte, layout Layout) int64 {
+	if layout >= LayoutVersion3 {
+		return int64(binary.BigEndian.Uint64(buffer))
+	}
+
+	return int64(binary.BigEndian.Uint32(buffer)) * 1000
+}
+
+// IsExpireReached tells if expire timestamp in unix milliseconds is reached. Zero expire is never reached
+func IsExpireReached(expire int64, now time.Time) bool {
+	if expire == 0 {
+		return false
+	}
+
+	return now.UnixMilli() >= expire
+}
+
 const (
 	StatusOK      = 212
 	StatusDeleted = 106
@@ -25,80 +121,98 @@ const (
 type Status byte
 
 type Header struct {
-	SizePower byte
+	SizeClass byte // see ClassSize
 	Status    Status
 	KeyLen    uint16
 	ValLen    uint32
-	Expire    uint32
+	Expire    int64  // unix milliseconds
+	Version   uint64 // always zero for layout version 1
+	Checksum  uint32 // always zero before layout version 5, see Checksum
 }
 
 func (h Header) Size() int {
-	return 1 << h.SizePower
+	return ClassSize(h.SizeClass)
 }
 
-func (h Header) IsExpired(now time.Time) bool {
-	if h.Expire == 0 {
-		return false
-	}
+// FitsSize tells if the key and the value fit the blob's size.
+// Corrupted headers may have garbage lengths, so they must be checked before the body is unmarshaled
+func (h Header) FitsSize(layout Layout) bool {
+	bodySize := h.Size() - layout.HeaderSize()
 
-	expireTime := time.Unix(int64(h.Expire), 0)
+	return bodySize >= 0 && int(h.KeyLen)+int(h.ValLen) <= bodySize
+}
 
-	return expireTime.Before(now)
+func (h Header) IsExpired(now time.Time) bool {
+	return IsExpireReached(h.Expire, now)
 }
 
 // KVE stands for Key Value Expire
 type KVE struct {
-	Key    []byte
-	Value  []byte
-	Expire uint32
+	Key     []byte
+	Value   []byte
+	Expire  int64  // unix milliseconds
+	Version uint64 // ignored for layout version 1
 }
 
-func (kve KVE) Marshal() (_ []byte, nextPowerOfTwo int) {
-	currenRawSize := len(kve.Key) + len(kve.Value) + HeaderSize
-	powerNumber, paddedSize := NextNumberOfPowerOfTwo(currenRawSize)
+func (kve KVE) Marshal(layout Layout) (_ []byte, nextPowerOfTwo int) {
+	currenRawSize := len(kve.Key) + len(kve.Value) + layout.HeaderSize()
+	sizeClass, paddedSize := SizeClassOf(currenRawSize, layout)
 
 	buffer := NewBuffer(paddedSize)
 
 	header := Header{
-		SizePower: powerNumber,
+		SizeClass: sizeClass,
 		Status:    StatusOK,
 		KeyLen:    uint16(len(kve.Key)),
 		ValLen:    uint32(len(kve.Value)),
 		Expire:    kve.Expire,
+		Version:   kve.Version,
+	}
+
+	if layout.HasChecksums() {
+		header.Checksum = Checksum(header, kve.Value, kve.Key, layout)
 	}
 
-	buffer.WriteHeader(header)
+	buffer.WriteHeader(header, layout)
 	buffer.WriteValue(kve.Value)
 	buffer.WriteKey(kve.Key)
 
 	return buffer.Bytes(), paddedSize
 }
 
-func (kve KVE) IsExpired(now time.Time) bool {
-	if kve.Expire == 0 {
-		return false
-	}
+// MarshalHeader returns only the blob's header in the layout's binary format
+func MarshalHeader(header Header, layout Layout) []byte {
+	buffer := NewBuffer(layout.HeaderSize())
 
-	expireTime := time.Unix(int64(kve.Expire), 0)
+	buffer.WriteHeader(header, layout)
 
-	return expireTime.Before(now)
+	return buffer.Bytes()
+}
+
+func (kve KVE) IsExpired(now time.Time) bool {
+	return IsExpireReached(kve.Expire, now)
 }
 
-func Unmarshal(buffer []byte) KVE {
-	header := UnmarshalHeader(buffer[:HeaderSize])
+func Unmarshal(buffer []byte, layout Layout) KVE {
+	headerSize := layout.HeaderSize()
 
-	return UnmarshalBody(buffer[HeaderSize:], header)
+	header := UnmarshalHeader(buffer[:headerSize], layout)
+
+	return UnmarshalBody(buffer[headerSize:], header)
 }
 
-func UnmarshalHeader(buffer []byte) Header {
+func UnmarshalHeader(buffer []byte, layout Layout) Header {
 	header := Header{}
 
 	// TODO checks for bad buffer lengths
 
 	var offset = 0
 
-	header.SizePower = buffer[offset]
-	offset += SizePowerSize
+	header.SizeClass = buffer[offset]
+	if !layout.HasSizeClasses() {
+		header.SizeClass <<= sizeClassStepBits
+	}
+	offset += SizeClassSize
 
 	header.Status = Status(buffer[offset])
 	offset += StatusSize
@@ -109,8 +223,18 @@ func UnmarshalHeader(buffer []byte) Header {
 	header.ValLen = binary.BigEndian.Uint32(buffer[offset : offset+ValLenSize])
 	offset += ValLenSize
 
-	header.Expire = binary.BigEndian.Uint32(buffer[offset : offset+ExpireSize])
-	offset += ExpireSize
+	header.Expire = readExpire(buffer[offset:offset+layout.ExpireSize()], layout)
+	offset += layout.ExpireSize()
+
+	if layout.HasVersions() {
+		header.Version = binary.BigEndian.Uint64(buffer[offset : offset+VersionSize])
+		offset += VersionSize
+	}
+
+	if layout.HasChecksums() {
+		header.Checksum = binary.BigEndian.Uint32(buffer[offset : offset+ChecksumSize])
+		offset += ChecksumSize
+	}
 
 	return header
 }
@@ -118,9 +242,10 @@ func UnmarshalHeader(buffer []byte) Header {
 func UnmarshalBody(buffer []byte, header Header) KVE {
 	// TODO checks for bad buffer lengths
 	kve := KVE{
-		Key:    buffer[header.ValLen : header.ValLen+uint32(header.KeyLen)],
-		Value:  buffer[:header.ValLen],
-		Expire: header.Expire,
+		Key:     buffer[header.ValLen : header.ValLen+uint32(header.KeyLen)],
+		Value:   buffer[:header.ValLen],
+		Expire:  header.Expire,
+		Version: header.Version,
 	}
 
 	return kve
@@ -17,16 +17,28 @@ func NewBuffer(size int) *Buffer {
 	}
 }
 
-func (b *Buffer) WriteHeader(h Header) {
-	data := make([]byte, 0, HeaderSize)
+func (b *Buffer) WriteHeader(h Header, layout Layout) {
+	data := make([]byte, 0, layout.HeaderSize())
 
-	data = append(data, h.SizePower)
+	if layout.HasSizeClasses() {
+		data = append(data, h.SizeClass)
+	} else {
+		data = append(data, h.SizeClass>>sizeClassStepBits)
+	}
 	data = append(data, byte(h.Status))
 
 	data = binary.BigEndian.AppendUint16(data, h.KeyLen)
 	data = binary.BigEndian.AppendUint32(data, h.ValLen)
 
-	data = binary.BigEndian.AppendUint32(data, h.Expire)
+	data = AppendExpire(data, h.Expire, layout)
+
+	if layout.HasVersions() {
+		data = binary.BigEndian.AppendUint64(data, h.Version)
+	}
+
+	if layout.HasChecksums() {
+		data = binary.BigEndian.AppendUint32(data, h.Checksum)
+	}
 
 	b.buffer.Write(data)
 }
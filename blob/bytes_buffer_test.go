@@ -14,14 +14,14 @@ func TestBuffer(t *testing.T) {
 		key := []byte("key") // 0x6B, 0x65, 0x79
 
 		h := Header{
-			SizePower: 5,
+			SizeClass: 5 << sizeClassStepBits,
 			Status:    212,
 			KeyLen:    uint16(len(key)),
 			ValLen:    uint32(len(value)),
 			Expire:    0,
 		}
 
-		buffer.WriteHeader(h)
+		buffer.WriteHeader(h, LayoutVersion1)
 		buffer.WriteValue(value)
 		buffer.WriteKey(key)
 
@@ -51,7 +51,7 @@ func TestBuffer(t *testing.T) {
 			Expire: 0,
 		}
 
-		result, size := data.Marshal()
+		result, size := data.Marshal(LayoutVersion1)
 
 		expect := []byte{
 			5,    // size power
@@ -86,14 +86,90 @@ func TestBuffer(t *testing.T) {
 			0x00, 0x00, // padding
 		}
 
-		result := Unmarshal(data)
+		result := Unmarshal(data, LayoutVersion1)
 
 		expect := KVE{
 			Key:    []byte("key"),
 			Value:  []byte{0xCA, 0xFE, 0xBA, 0xBE},
-			Expire: 0x050500,
+			Expire: 0x050500 * 1000, // layout version 1 stores seconds
 		}
 
 		assert.Equal(t, expect, result)
 	})
+
+	t.Run("marshal and unmarshal with version", func(t *testing.T) {
+		data := KVE{
+			Key:     []byte("key"),
+			Value:   []byte{0xCA, 0xFE, 0xBA, 0xBE},
+			Expire:  0x050500 * 1000,
+			Version: 0x0102030405060708,
+		}
+
+		result, size := data.Marshal(LayoutVersion2)
+
+		expect := []byte{
+			5,    // size power
+			212,  // status
+			0, 3, // key len
+			0, 0, 0, 4, // val len
+			0, 5, 5, 0, // expire
+			1, 2, 3, 4, 5, 6, 7, 8, // version
+			0xCA, 0xFE, 0xBA, 0xBE, // value
+			0x6B, 0x65, 0x79, // key
+			0x00, 0x00, 0x00, 0x00, // padding
+			0x00, // padding
+		}
+
+		assert.Equal(t, 32, size)
+		assert.Equal(t, expect, result)
+
+		assert.Equal(t, data, Unmarshal(result, LayoutVersion2))
+	})
+
+	t.Run("marshal and unmarshal with milliseconds expire", func(t *testing.T) {
+		data := KVE{
+			Key:     []byte("key"),
+			Value:   []byte{0xCA, 0xFE, 0xBA, 0xBE},
+			Expire:  0x0102030405,
+			Version: 0x0102030405060708,
+		}
+
+		result, size := data.Marshal(LayoutVersion3)
+
+		expect := []byte{
+			5,    // size power
+			212,  // status
+			0, 3, // key len
+			0, 0, 0, 4, // val len
+			0, 0, 0, 1, 2, 3, 4, 5, // expire
+			1, 2, 3, 4, 5, 6, 7, 8, // version
+			0xCA, 0xFE, 0xBA, 0xBE, // value
+			0x6B, 0x65, 0x79, // key
+			0x00, // padding
+		}
+
+		assert.Equal(t, 32, size)
+		assert.Equal(t, expect, result)
+
+		assert.Equal(t, data, Unmarshal(result, LayoutVersion3))
+	})
+
+	t.Run("milliseconds are truncated for layout with seconds", func(t *testing.T) {
+		data := KVE{
+			Key:    []byte("key"),
+			Value:  []byte{0xCA, 0xFE, 0xBA, 0xBE},
+			Expire: 1500,
+		}
+
+		result, _ := data.Marshal(LayoutVersion2)
+
+		assert.Equal(t, int64(1000), Unmarshal(result, LayoutVersion2).Expire)
+
+		data.Expire = 999
+
+		result, _ = data.Marshal(LayoutVersion2)
+
+		// zero means no expiration, so the smallest timestamp is stored
+		assert.Equal(t, int64(1000), Unmarshal(result, LayoutVersion2).Expire)
+	})
 }
@@ -0,0 +1,28 @@
+package blob
+
+import "hash/crc32"
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum returns CRC32-C of blob's header, value and key. The padding is not covered.
+// The checksum field of the header is treated as zero. The status is covered, so the checksum
+// must be recomputed, when the blob is deleted in place. Otherwise a damaged status could make it live again
+func Checksum(header Header, value []byte, key []byte, layout Layout) uint32 {
+	header.Checksum = 0
+
+	checksum := crc32.Checksum(MarshalHeader(header, layout), checksumTable)
+	checksum = crc32.Update(checksum, checksumTable, value)
+	checksum = crc32.Update(checksum, checksumTable, key)
+
+	return checksum
+}
+
+// IsChecksumValid tells if the unmarshaled blob matches the checksum in its header.
+// Blobs of layouts without checksums are always valid
+func IsChecksumValid(header Header, kve KVE, layout Layout) bool {
+	if !layout.HasChecksums() {
+		return true
+	}
+
+	return Checksum(header, kve.Value, kve.Key, layout) == header.Checksum
+}
@@ -0,0 +1,72 @@
+package blob
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksum(t *testing.T) {
+	kve := KVE{
+		Key:     []byte("key"),
+		Value:   []byte("value"),
+		Expire:  1000,
+		Version: 7,
+	}
+
+	t.Run("marshaled blob is valid", func(t *testing.T) {
+		buffer, _ := kve.Marshal(LayoutVersion5)
+
+		header := UnmarshalHeader(buffer[:HeaderSizeV5], LayoutVersion5)
+		assert.NotZero(t, header.Checksum)
+
+		result := UnmarshalBody(buffer[HeaderSizeV5:], header)
+		assert.True(t, IsChecksumValid(header, result, LayoutVersion5))
+	})
+
+	t.Run("changed value is not valid", func(t *testing.T) {
+		buffer, _ := kve.Marshal(LayoutVersion5)
+		buffer[HeaderSizeV5] ^= 1
+
+		header := UnmarshalHeader(buffer[:HeaderSizeV5], LayoutVersion5)
+		result := UnmarshalBody(buffer[HeaderSizeV5:], header)
+		assert.False(t, IsChecksumValid(header, result, LayoutVersion5))
+	})
+
+	t.Run("changed expire is not valid", func(t *testing.T) {
+		buffer, _ := kve.Marshal(LayoutVersion5)
+		buffer[ExpireOffset] ^= 1
+
+		header := UnmarshalHeader(buffer[:HeaderSizeV5], LayoutVersion5)
+		result := UnmarshalBody(buffer[HeaderSizeV5:], header)
+		assert.False(t, IsChecksumValid(header, result, LayoutVersion5))
+	})
+
+	t.Run("changed status is not valid", func(t *testing.T) {
+		buffer, _ := kve.Marshal(LayoutVersion5)
+		buffer[StatusOffset] = StatusDeleted
+
+		header := UnmarshalHeader(buffer[:HeaderSizeV5], LayoutVersion5)
+		result := UnmarshalBody(buffer[HeaderSizeV5:], header)
+		assert.False(t, IsChecksumValid(header, result, LayoutVersion5))
+	})
+
+	t.Run("layouts without checksums are always valid", func(t *testing.T) {
+		buffer, _ := kve.Marshal(LayoutVersion4)
+		buffer[HeaderSizeV3] ^= 1
+
+		header := UnmarshalHeader(buffer[:HeaderSizeV3], LayoutVersion4)
+		result := UnmarshalBody(buffer[HeaderSizeV3:], header)
+		assert.True(t, IsChecksumValid(header, result, LayoutVersion4))
+	})
+
+	t.Run("lengths must fit the size", func(t *testing.T) {
+		buffer, _ := kve.Marshal(LayoutVersion5)
+
+		header := UnmarshalHeader(buffer[:HeaderSizeV5], LayoutVersion5)
+		assert.True(t, header.FitsSize(LayoutVersion5))
+
+		header.ValLen = 1 << 20
+		assert.False(t, header.FitsSize(LayoutVersion5))
+	})
+}
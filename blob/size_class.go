@@ -0,0 +1,53 @@
+package blob
+
+// Since layout version 4 blob's size is one of size classes instead of a power of two.
+// Each doubling from 2^k to 2^(k+1) has sizeClassesPerDoubling classes: 2^k, 1.25*2^k, 1.5*2^k and 1.75*2^k.
+// So padding wastes at most 20% of blob's size instead of 50%.
+// Header stores the index of blob's size class. The class 4*k is exactly 2^k,
+// so older layouts, which store the power of two, are converted to the class index by multiplying by 4
+const (
+	sizeClassStepBits      = 2
+	sizeClassesPerDoubling = 1 << sizeClassStepBits
+	sizeClassStepMask      = sizeClassesPerDoubling - 1
+
+	minSizeClassPower = sizeClassStepBits // quarter steps of smaller doublings are not whole bytes
+)
+
+// ClassSize returns the size of the size class in bytes
+func ClassSize(class byte) int {
+	power := int(class) >> sizeClassStepBits
+	step := int(class) & sizeClassStepMask
+
+	if power < minSizeClassPower {
+		return 1 << power
+	}
+
+	return 1<<power + step<<(power-sizeClassStepBits)
+}
+
+// SizeClassOf returns the smallest size class, which fits size bytes, and the class's size.
+// Layouts before version 4 use only powers of two
+func SizeClassOf(size int, layout Layout) (class byte, classSize int) {
+	power, powerSize := NextNumberOfPowerOfTwo(size)
+
+	if !layout.HasSizeClasses() || power <= minSizeClassPower {
+		return power << sizeClassStepBits, powerSize
+	}
+
+	// size is greater than 2^(power-1), so one of the classes of the previous doubling may fit it
+	for step := byte(1); step < sizeClassesPerDoubling; step++ {
+		class := (power-1)<<sizeClassStepBits | step
+
+		if ClassSize(class) >= size {
+			return class, ClassSize(class)
+		}
+	}
+
+	return power << sizeClassStepBits, powerSize
+}
+
+// IsClassSize tells if size is exactly the size of some size class of the layout
+func IsClassSize(size int, layout Layout) bool {
+	_, classSize := SizeClassOf(size, layout)
+	return classSize == size
+}
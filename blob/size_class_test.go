@@ -0,0 +1,70 @@
+package blob
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSizeClass(t *testing.T) {
+	t.Run("size classes of layout with size classes", func(t *testing.T) {
+		cases := []struct {
+			size      int
+			classSize int
+		}{
+			{size: 1, classSize: 1},
+			{size: 3, classSize: 4},
+			{size: 8, classSize: 8},
+			{size: 9, classSize: 10},
+			{size: 33, classSize: 40},
+			{size: 1024, classSize: 1024},
+			{size: 1025, classSize: 1280},
+			{size: 1281, classSize: 1536},
+			{size: 1537, classSize: 1792},
+			{size: 1793, classSize: 2048},
+		}
+
+		for _, c := range cases {
+			class, classSize := SizeClassOf(c.size, LayoutVersion4)
+
+			assert.Equal(t, c.classSize, classSize, "size %d", c.size)
+			assert.Equal(t, c.classSize, ClassSize(class), "size %d", c.size)
+		}
+	})
+
+	t.Run("older layouts use powers of two", func(t *testing.T) {
+		class, classSize := SizeClassOf(1025, LayoutVersion3)
+
+		assert.Equal(t, 2048, classSize)
+		assert.Equal(t, byte(11<<sizeClassStepBits), class)
+
+		assert.True(t, IsClassSize(2048, LayoutVersion3))
+		assert.False(t, IsClassSize(1280, LayoutVersion3))
+		assert.True(t, IsClassSize(1280, LayoutVersion4))
+	})
+
+	t.Run("header stores size class index since layout version 4", func(t *testing.T) {
+		data := KVE{
+			Key:   []byte("key"),
+			Value: make([]byte, 1000),
+		}
+
+		result, size := data.Marshal(LayoutVersion4)
+
+		// 24 bytes header + 3 bytes key + 1000 bytes value
+		assert.Equal(t, 1280, size)
+		assert.Len(t, result, 1280)
+		assert.Equal(t, byte(10<<sizeClassStepBits|1), result[0])
+
+		header := UnmarshalHeader(result[:HeaderSizeV3], LayoutVersion4)
+		assert.Equal(t, 1280, header.Size())
+
+		result, size = data.Marshal(LayoutVersion3)
+
+		assert.Equal(t, 2048, size)
+		assert.Equal(t, byte(11), result[0])
+
+		header = UnmarshalHeader(result[:HeaderSizeV3], LayoutVersion3)
+		assert.Equal(t, 2048, header.Size())
+	})
+}
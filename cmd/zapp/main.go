@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Kurt212/zapp"
+)
+
+const usage = `usage: zapp <command> [flags]
+
+commands:
+  recover    restore a backup and replay archived WAL up to a point in time or LSN
+  reshard    change the number of segments of a closed DB
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "recover":
+		runRecover(os.Args[2:])
+	case "reshard":
+		runReshard(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func runRecover(args []string) {
+	flags := flag.NewFlagSet("recover", flag.ExitOnError)
+
+	backupPath := flags.String("backup", "", "path to the full backup `file` made by DB.Backup")
+	archivePath := flags.String("archive", "", "path to the WAL archive `dir`")
+	outPath := flags.String("out", "", "`dir` to recover the DB to. Must not exist or must be empty")
+	targetTime := flags.String("time", "", "replay actions made before or at this RFC3339 `time`")
+	targetLSNs := flags.String("lsn", "", "replay actions up to these `LSNs`, comma separated list of segment=lsn pairs")
+
+	_ = flags.Parse(args)
+
+	if *backupPath == "" || *archivePath == "" || *outPath == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var target zapp.RecoveryTarget
+
+	if *targetTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, *targetTime)
+		if err != nil {
+			log.Fatalf("invalid time %q: %v", *targetTime, err)
+		}
+		target.Time = t
+	}
+
+	if *targetLSNs != "" {
+		lsns, err := parseLSNs(*targetLSNs)
+		if err != nil {
+			log.Fatalf("invalid lsn %q: %v", *targetLSNs, err)
+		}
+		target.LSNs = lsns
+	}
+
+	backup, err := os.Open(*backupPath)
+	if err != nil {
+		log.Fatal("could not open backup: ", err)
+	}
+	defer backup.Close()
+
+	err = zapp.RecoverToPoint(backup, *archivePath, *outPath, target)
+	if err != nil {
+		log.Fatal("could not recover: ", err)
+	}
+}
+
+func runReshard(args []string) {
+	flags := flag.NewFlagSet("reshard", flag.ExitOnError)
+
+	path := flags.String("path", "", "DB's data `dir`. The DB must be closed")
+	from := flags.Int("from", 0, "current `number` of segments")
+	to := flags.Int("to", 0, "new `number` of segments")
+
+	_ = flags.Parse(args)
+
+	if *path == "" || *from <= 0 || *to <= 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	err := zapp.Reshard(*path, *from, *to)
+	if err != nil {
+		log.Fatal("could not reshard: ", err)
+	}
+}
+
+// parseLSNs parses a list like "0=15,1=20" to a map of segment's index to LSN
+func parseLSNs(s string) (map[int]uint64, error) {
+	lsns := make(map[int]uint64)
+
+	for _, pair := range strings.Split(s, ",") {
+		segment, lsn, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected segment=lsn, but got %q", pair)
+		}
+
+		segmentIdx, err := strconv.Atoi(strings.TrimSpace(segment))
+		if err != nil {
+			return nil, err
+		}
+
+		lsnValue, err := strconv.ParseUint(strings.TrimSpace(lsn), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		lsns[segmentIdx] = lsnValue
+	}
+
+	return lsns, nil
+}
@@ -0,0 +1,66 @@
+package zapp
+
+import "time"
+
+// SyncMode tells how durable a write is, when it returns
+type SyncMode int
+
+const (
+	// SyncDefault makes the write as durable as DB's params do: with WAL the write waits until its WAL's record
+	// is on disk, unless WALSyncInterval is set. Without WAL the write is persisted by the next sync of the segment's file
+	SyncDefault SyncMode = iota
+	// SyncNone doesn't append the write to WAL. The write is persisted by the next sync of the segment's file,
+	// so a crash before it loses the write. WAL's history doesn't have the write, so it's considered released.
+	// Incremental backups and WAL archive need the complete history, so with them the write fails with ErrSyncNoneWithWALHistory
+	SyncNone
+	// SyncWAL makes the write wait until its WAL's record is on disk even with WALSyncInterval.
+	// Without WAL the segment's file is synced instead
+	SyncWAL
+	// SyncAlways makes the write wait until both its WAL's record and the segment's file are on disk
+	SyncAlways
+)
+
+// SetOptions are options of DB.SetWithOptions
+type SetOptions struct {
+	TTL  time.Duration // positive TTL sets key's time to live with millisecond precision, otherwise the key has no expiration time
+	Sync SyncMode
+}
+
+// DeleteOptions are options of DB.DeleteWithOptions
+type DeleteOptions struct {
+	Sync SyncMode
+}
+
+// SetWithOptions sets the key's value. Unlike Set the durability is chosen for this write only, see SyncMode.
+// Writes with different sync modes may be mixed. After a crash all writes appended to WAL are recovered
+// in their order, writes not appended to WAL are recovered only if they were synced to the segment's file
+func (db *DB) SetWithOptions(key string, data []byte, options SetOptions) error {
+	if !options.Sync.valid() {
+		return ErrInvalidSyncMode
+	}
+
+	byteKey := []byte(key)
+
+	h := hash(byteKey)
+	segment := db.getSegmentForKey(h)
+
+	return segment.SetWithSync(h, byteKey, data, ttlToExpire(options.TTL), options.Sync)
+}
+
+// DeleteWithOptions deletes the key. Unlike Delete the durability is chosen for this write only, see SyncMode
+func (db *DB) DeleteWithOptions(key string, options DeleteOptions) error {
+	if !options.Sync.valid() {
+		return ErrInvalidSyncMode
+	}
+
+	byteKey := []byte(key)
+
+	h := hash(byteKey)
+	segment := db.getSegmentForKey(h)
+
+	return segment.DeleteWithSync(h, byteKey, options.Sync)
+}
+
+func (m SyncMode) valid() bool {
+	return m >= SyncDefault && m <= SyncAlways
+}
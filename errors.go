@@ -1,6 +1,10 @@
 package zapp
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/Kurt212/zapp/wal"
+)
 
 var (
 	ErrNotFound = errors.New("key not found")
@@ -8,9 +12,42 @@ var (
 	ErrSegmentMagicNumbersDoNotMatch = errors.New("file magic numbers do not match")
 	ErrSegmentUnknownVersionNumber   = errors.New("unknown version number of segment file")
 	ErrUnknownBlobStatus             = errors.New("unkown blob status")
+	ErrCorruptedItem                 = errors.New("item is corrupted")
 
 	ErrInvalidPath        = errors.New("invalid path for storing data")
 	ErrInvalidSegmentsNum = errors.New("invalid number of segments")
 
+	ErrInvalidDataPathWeights = errors.New("data paths' weights must be positive and match data paths")
+
+	ErrSegmentsNumMismatch  = errors.New("number of segments doesn't match data directory")
+	ErrHashFunctionMismatch = errors.New("data directory uses unknown hash function")
+	ErrInvalidManifest      = errors.New("data directory's manifest is invalid")
+	ErrWALRequired          = errors.New("data directory has not applied WAL actions, but WAL is disabled")
+	ErrPlacementMismatch    = errors.New("segments' placement doesn't match data directory")
+
+	// ErrCorruptedWAL is returned, when a segment's WAL file is corrupted not only at its end
+	ErrCorruptedWAL = wal.ErrCorrupted
+
 	ErrClosed = errors.New("segment is closed")
+
+	ErrInvalidCursor = errors.New("invalid scan cursor")
+
+	ErrBatchCommitted = errors.New("batch is already committed")
+
+	ErrVersionsNotSupported = errors.New("segment's file layout doesn't support items' versions")
+
+	ErrCorruptedBackup = errors.New("backup archive is corrupted")
+	ErrDirNotEmpty     = errors.New("directory is not empty")
+
+	ErrIncrementalBackupWithoutWAL = errors.New("incremental backups require WAL")
+	ErrWALHistoryReleased          = errors.New("WAL history since the LSN is released")
+	ErrBackupChainBroken           = errors.New("incremental backup doesn't continue the previous backup")
+
+	ErrInvalidWALArchive = errors.New("WAL archive requires WAL and can not be used with incremental backups")
+
+	ErrInvalidWALSyncInterval = errors.New("WAL sync interval must not be negative and requires WAL")
+	ErrInvalidSyncMode        = errors.New("unknown sync mode")
+	ErrSyncNoneWithWALHistory = errors.New("writes without WAL can not be used with incremental backups or WAL archive")
+
+	ErrInvalidCompactionThreshold = errors.New("compaction threshold must be in range [0, 1)")
 )
@@ -0,0 +1,24 @@
+//go:build linux
+
+package zapp
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocFlKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE. File's size is not changed, even if blocks are allocated after its end
+	fallocFlPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE. Must be used together with FALLOC_FL_KEEP_SIZE
+)
+
+// punchHole deallocates file's blocks in range [offset, offset+size). Reading the range returns zeros.
+// Writing to the range allocates blocks again
+func punchHole(file *os.File, offset int64, size int64) error {
+	return syscall.Fallocate(int(file.Fd()), fallocFlPunchHole|fallocFlKeepSize, offset, size)
+}
+
+// preallocate allocates file's blocks in range [offset, offset+size) without changing file's size
+func preallocate(file *os.File, offset int64, size int64) error {
+	return syscall.Fallocate(int(file.Fd()), fallocFlKeepSize, offset, size)
+}
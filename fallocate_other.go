@@ -0,0 +1,20 @@
+//go:build !linux
+
+package zapp
+
+import (
+	"errors"
+	"os"
+)
+
+var errFallocateNotSupported = errors.New("fallocate is not supported on this platform")
+
+// punchHole is supported only on Linux
+func punchHole(file *os.File, offset int64, size int64) error {
+	return errFallocateNotSupported
+}
+
+// preallocate is supported only on Linux
+func preallocate(file *os.File, offset int64, size int64) error {
+	return errFallocateNotSupported
+}
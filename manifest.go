@@ -0,0 +1,378 @@
+package zapp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+
+	"github.com/Kurt212/zapp/blob"
+	"github.com/Kurt212/zapp/wal"
+)
+
+const (
+	manifestFileName     = "MANIFEST.json"
+	manifestHashFunction = "murmur3_32" // keys are routed to segments by this hash function
+)
+
+// segmentFileNameRegexp matches names of segments' data and WAL files. The first group is segment's index
+var segmentFileNameRegexp = regexp.MustCompile(`^(\d+)_(data|wal)\.bin$`)
+
+// manifest records how the data directory was created.
+// Keys are routed to segments by their hashes modulo the number of segments,
+// so opening the directory with another number of segments or another hash function loses keys
+type manifest struct {
+	SegmentsNum  int    `json:"segments_num"`
+	UseWAL       bool   `json:"use_wal"`
+	HashFunction string `json:"hash_function"`
+	// LayoutVersion is the layout of data files created in the directory. Older data files keep their own layouts
+	LayoutVersion int `json:"layout_version"`
+	// SegmentPaths are directories of segments' data files by segments' indexes. Empty means the data directory
+	SegmentPaths []string `json:"segment_paths,omitempty"`
+	// WALPath is the directory of all WAL files. Empty means the directory of segment's data file
+	WALPath string `json:"wal_path,omitempty"`
+	// Reshard is the manifest after resharding. It's set, while old segments' files are replaced with new ones
+	Reshard *manifest `json:"reshard,omitempty"`
+}
+
+func newManifest(params Params) manifest {
+	m := manifest{
+		SegmentsNum:   params.segmentsNum,
+		UseWAL:        params.useWAL,
+		HashFunction:  manifestHashFunction,
+		LayoutVersion: int(blob.LatestLayout),
+		WALPath:       params.walPath,
+	}
+
+	if len(params.dataPaths) != 0 {
+		m.SegmentPaths = placeSegments(params.segmentsNum, params.dataPaths, params.dataPathWeights)
+	}
+
+	return m
+}
+
+// segmentPath returns the directory of segment's data file
+func (m manifest) segmentPath(dataPath string, segmentIdx int) string {
+	if len(m.SegmentPaths) == 0 {
+		return dataPath
+	}
+
+	return m.SegmentPaths[segmentIdx]
+}
+
+// walPath returns the directory of segment's WAL file
+func (m manifest) walPath(dataPath string, segmentIdx int) string {
+	if m.WALPath == "" {
+		return m.segmentPath(dataPath, segmentIdx)
+	}
+
+	return m.WALPath
+}
+
+// dirs returns distinct directories, which store segments' files
+func (m manifest) dirs(dataPath string) []string {
+	paths, _ := placementWeights(append([]string{dataPath}, m.SegmentPaths...))
+	if m.WALPath != "" {
+		paths, _ = placementWeights(append(paths, m.WALPath))
+	}
+
+	return paths
+}
+
+// checkManifest validates params against the manifest of the data directory and against segments' files.
+// The manifest is written, if the directory doesn't have it yet, and is updated, if WAL is turned on or off.
+// Returns the manifest, which tells where segments' files are
+func checkManifest(params Params) (manifest, error) {
+	m, err := readManifest(params.dataPath)
+	created := os.IsNotExist(err)
+	if created {
+		// the directory is either new or created before manifests were introduced
+		m = newManifest(params)
+
+		if !reflect.DeepEqual(m.dirs(params.dataPath), []string{params.dataPath}) {
+			// files of a directory created before manifests are all in the data directory
+			segmentsNum, err := segmentsNumInDirs([]string{params.dataPath})
+			if err != nil {
+				return m, err
+			}
+
+			if segmentsNum != 0 {
+				return m, fmt.Errorf("%w: segments' files are in %s", ErrPlacementMismatch, params.dataPath)
+			}
+		}
+	} else if err != nil {
+		return m, err
+	} else {
+		// resharding was interrupted, while old segments' files were replaced
+		if m.Reshard != nil {
+			m, err = finishReshard(params.dataPath, m)
+			if err != nil {
+				return m, err
+			}
+		}
+
+		err = checkManifestParams(m, params)
+		if err != nil {
+			return m, err
+		}
+	}
+
+	dirsSegmentsNum, err := segmentsNumInDirs(m.dirs(params.dataPath))
+	if err != nil {
+		return m, err
+	}
+
+	if dirsSegmentsNum > params.segmentsNum {
+		return m, fmt.Errorf(
+			"%w: directory has files of segment %d, but number of segments is %d",
+			ErrSegmentsNumMismatch,
+			dirsSegmentsNum-1,
+			params.segmentsNum,
+		)
+	}
+
+	// a directory created before manifests has files of all its segments, so fewer segments' files mean,
+	// that it was created with fewer segments
+	if created && dirsSegmentsNum != 0 && dirsSegmentsNum != params.segmentsNum {
+		return m, fmt.Errorf(
+			"%w: directory has files of %d segments, but number of segments is %d",
+			ErrSegmentsNumMismatch,
+			dirsSegmentsNum,
+			params.segmentsNum,
+		)
+	}
+
+	if !params.useWAL {
+		hasActions, err := hasUnappliedWALActions(params.dataPath, m, dirsSegmentsNum)
+		if err != nil {
+			return m, err
+		}
+
+		if hasActions {
+			return m, ErrWALRequired
+		}
+	}
+
+	if created || m.UseWAL != params.useWAL {
+		m.UseWAL = params.useWAL
+
+		return m, writeManifest(params.dataPath, m)
+	}
+
+	return m, nil
+}
+
+// checkManifestParams validates params against the existing manifest.
+// Params, which are not set, are taken from the manifest
+func checkManifestParams(m manifest, params Params) error {
+	if m.SegmentsNum != params.segmentsNum {
+		return fmt.Errorf(
+			"%w: directory was created with %d segments, but number of segments is %d",
+			ErrSegmentsNumMismatch,
+			m.SegmentsNum,
+			params.segmentsNum,
+		)
+	}
+
+	if m.HashFunction != manifestHashFunction {
+		return fmt.Errorf("%w: directory uses %q", ErrHashFunctionMismatch, m.HashFunction)
+	}
+
+	if m.LayoutVersion > int(blob.LatestLayout) {
+		return fmt.Errorf("%w: directory uses layout version %d", ErrSegmentUnknownVersionNumber, m.LayoutVersion)
+	}
+
+	if len(params.dataPaths) != 0 &&
+		!reflect.DeepEqual(m.SegmentPaths, placeSegments(params.segmentsNum, params.dataPaths, params.dataPathWeights)) {
+		return fmt.Errorf("%w: data paths differ from recorded segments' paths %v", ErrPlacementMismatch, m.SegmentPaths)
+	}
+
+	if params.walPath != "" && params.walPath != m.WALPath {
+		return fmt.Errorf("%w: WAL path differs from recorded %q", ErrPlacementMismatch, m.WALPath)
+	}
+
+	return nil
+}
+
+func readManifest(dataPath string) (manifest, error) {
+	var m manifest
+
+	content, err := os.ReadFile(filepath.Join(dataPath, manifestFileName))
+	if err != nil {
+		return m, err
+	}
+
+	err = json.Unmarshal(content, &m)
+	if err != nil {
+		return m, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+
+	return m, nil
+}
+
+// writeManifest atomically replaces the manifest of the data directory. The directory is synced, so that the new manifest
+// survives a power loss
+func writeManifest(dataPath string, m manifest) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dataPath, manifestFileName)
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("can not create manifest: %w", err)
+	}
+
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("can not write manifest: %w", err)
+	}
+
+	err = syncDir(dataPath)
+	if err != nil {
+		return fmt.Errorf("can not sync manifest's directory: %w", err)
+	}
+
+	return nil
+}
+
+// segmentsNumInDirs returns the greatest segment's index in names of segments' files in the directories plus one.
+// Returns 0, if there are no segments' files. Directories, which don't exist, are skipped
+func segmentsNumInDirs(dirs []string) (int, error) {
+	segmentsNum := 0
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("can not read %s dir: %w", dir, err)
+		}
+
+		n := segmentsNumInEntries(entries)
+		if n > segmentsNum {
+			segmentsNum = n
+		}
+	}
+
+	return segmentsNum, nil
+}
+
+func segmentsNumInEntries(entries []os.DirEntry) int {
+	segmentsNum := 0
+	for _, entry := range entries {
+		match := segmentFileNameRegexp.FindStringSubmatch(entry.Name())
+		if match == nil || entry.IsDir() {
+			continue
+		}
+
+		segmentIdx, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+
+		if segmentIdx+1 > segmentsNum {
+			segmentsNum = segmentIdx + 1
+		}
+	}
+
+	return segmentsNum
+}
+
+// hasUnappliedWALActions tells if any of segments has WAL's actions, which are not applied to its data file.
+// Closing the DB applies all actions, but WAL files are kept, so only their content matters
+func hasUnappliedWALActions(dataPath string, m manifest, segmentsNum int) (bool, error) {
+	for i := 0; i < segmentsNum; i++ {
+		hasActions, err := segmentHasUnappliedWALActions(
+			dataFilePath(m.segmentPath(dataPath, i), i),
+			walFilePath(m.walPath(dataPath, i), i),
+		)
+		if err != nil {
+			return false, fmt.Errorf("can not read segment's %d WAL file: %w", i, err)
+		}
+
+		if hasActions {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func segmentHasUnappliedWALActions(dataPath string, walPath string) (bool, error) {
+	walFile, err := os.Open(walPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer walFile.Close()
+
+	lastKnownLSN, err := readLastKnownLSN(dataPath)
+	if err != nil {
+		return false, err
+	}
+
+	actions, err := wal.ReadActions(walFile, lastKnownLSN)
+	// WAL with a torn tail needs recovery anyway
+	if errors.Is(err, wal.ErrCorrupted) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, action := range actions {
+		if action.Type != wal.ActionTypeTimeMark {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// readLastKnownLSN reads the last known LSN from the header of the data file.
+// A data file, which doesn't exist or doesn't have a header yet, has zero LSN
+func readLastKnownLSN(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	buffer := make([]byte, segmentFileLastKnownLSNSize)
+
+	_, err = file.ReadAt(buffer, segmentFileLastKnownLSNOffset)
+	if errors.Is(err, io.EOF) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(buffer), nil
+}
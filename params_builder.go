@@ -5,11 +5,21 @@ import "time"
 type Params struct {
 	segmentsNum           int
 	dataPath              string
+	dataPaths             []string
+	dataPathWeights       []int
+	walPath               string
+	walSyncInterval       time.Duration
 	syncPeriod            time.Duration
 	syncPeriodDeltaMax    time.Duration
 	removeExpiredPeriod   time.Duration
 	removeExpiredDeltaMax time.Duration
 	useWAL                bool
+	incrementalBackup     bool
+	walArchivePath        string
+	compactionThreshold   float64
+	compactionCheckPeriod time.Duration
+	punchHoleMinSize      int
+	preallocateChunkSize  int64
 }
 
 type ParamsBuilder struct {
@@ -26,6 +36,8 @@ func NewParamsBuilder(path string) *ParamsBuilder {
 			removeExpiredPeriod:   time.Minute,
 			removeExpiredDeltaMax: 0,
 			useWAL:                true,
+			compactionThreshold:   0,
+			compactionCheckPeriod: time.Minute,
 		},
 	}
 }
@@ -70,6 +82,90 @@ func (pb *ParamsBuilder) UseWAL(use bool) *ParamsBuilder {
 	return pb
 }
 
+// IncrementalBackup enables keeping WAL's history on checkpoints, so that DB.BackupSince can
+// make incremental backups. WAL files grow until the history is released with DB.ReleaseWALHistory.
+// Requires WAL
+func (pb *ParamsBuilder) IncrementalBackup(enable bool) *ParamsBuilder {
+	pb.params.incrementalBackup = enable
+	return pb
+}
+
+// WALArchivePath enables WAL archiving. On each checkpoint WAL's entries are moved to files in this directory
+// instead of being discarded. Archived WAL allows recovering the DB up to some point in time with RecoverToPoint.
+// Archive files are never removed by Zapp. Requires WAL and can not be used together with IncrementalBackup
+func (pb *ParamsBuilder) WALArchivePath(path string) *ParamsBuilder {
+	pb.params.walArchivePath = path
+	return pb
+}
+
+// CompactionThreshold enables automatic compaction of segments' files. When the share of free space
+// in a segment's file reaches threshold, the file is compacted just like with DB.Compact.
+// Threshold must be in range [0, 1). 0 value disables automatic compaction
+func (pb *ParamsBuilder) CompactionThreshold(threshold float64) *ParamsBuilder {
+	pb.params.compactionThreshold = threshold
+	return pb
+}
+
+// CompactionCheckPeriod sets the period time for scheduling a background process of
+// periodic checking segment's fragmentation. Only works if CompactionThreshold > 0.
+// 0 value disables the background process running
+func (pb *ParamsBuilder) CompactionCheckPeriod(period time.Duration) *ParamsBuilder {
+	pb.params.compactionCheckPeriod = period
+	return pb
+}
+
+// PunchHoleMinSize enables deallocating disk blocks of deleted and expired items of this size or greater.
+// The item's header is kept on disk and its offset is reused by new items as usual.
+// Supported only on Linux and by filesystems with FALLOC_FL_PUNCH_HOLE support, otherwise ignored.
+// 0 value disables punching holes
+func (pb *ParamsBuilder) PunchHoleMinSize(size int) *ParamsBuilder {
+	pb.params.punchHoleMinSize = size
+	return pb
+}
+
+// PreallocateChunkSize enables preallocating disk blocks by chunks of this size, when new items are appended
+// to the end of a segment's file. This makes the file less fragmented on disk.
+// Supported only on Linux and by filesystems with fallocate support, otherwise ignored.
+// 0 value disables preallocation
+func (pb *ParamsBuilder) PreallocateChunkSize(size int64) *ParamsBuilder {
+	pb.params.preallocateChunkSize = size
+	return pb
+}
+
+// DataPaths spreads segments' data files over these directories, for example over several drives.
+// Segments are placed round-robin, or in proportion to DataPathWeights if they are set.
+// The manifest is kept in the main data directory, which doesn't store segments' files unless it's listed.
+// The placement is recorded in the manifest, so the DB can be reopened without this param.
+// Empty value keeps all segments in the main data directory
+func (pb *ParamsBuilder) DataPaths(paths []string) *ParamsBuilder {
+	pb.params.dataPaths = paths
+	return pb
+}
+
+// DataPathWeights sets positive weights of DataPaths. The number of segments placed in each directory
+// is proportional to its weight. Must have the same length as DataPaths
+func (pb *ParamsBuilder) DataPathWeights(weights []int) *ParamsBuilder {
+	pb.params.dataPathWeights = weights
+	return pb
+}
+
+// WALPath sets the directory for WAL files of all segments, for example on a dedicated low-latency drive.
+// Empty value keeps each segment's WAL file next to its data file
+func (pb *ParamsBuilder) WALPath(path string) *ParamsBuilder {
+	pb.params.walPath = path
+	return pb
+}
+
+// WALSyncInterval relaxes WAL's durability. WAL's records are written to OS's page cache right away,
+// but WAL files are synced by a background process only once per interval. Writes don't wait for the sync,
+// so they are almost as fast as without WAL. A power loss or an OS crash loses up to the interval of last writes,
+// a crash of the program loses nothing. Requires WAL.
+// 0 value makes each write wait until its WAL's record is synced
+func (pb *ParamsBuilder) WALSyncInterval(interval time.Duration) *ParamsBuilder {
+	pb.params.walSyncInterval = interval
+	return pb
+}
+
 func (pb *ParamsBuilder) Params() Params {
 	return pb.params
 }
@@ -79,9 +175,43 @@ func validateParams(p Params) error {
 		return ErrInvalidPath
 	}
 
-	if p.segmentsNum <= 0 {
+	if p.segmentsNum <= 0 || p.segmentsNum > maxSegmentsNum {
 		return ErrInvalidSegmentsNum
 	}
 
+	for _, path := range p.dataPaths {
+		if path == "" {
+			return ErrInvalidPath
+		}
+	}
+
+	if p.dataPathWeights != nil {
+		if len(p.dataPathWeights) != len(p.dataPaths) {
+			return ErrInvalidDataPathWeights
+		}
+
+		for _, weight := range p.dataPathWeights {
+			if weight <= 0 {
+				return ErrInvalidDataPathWeights
+			}
+		}
+	}
+
+	if p.incrementalBackup && !p.useWAL {
+		return ErrIncrementalBackupWithoutWAL
+	}
+
+	if p.walArchivePath != "" && (!p.useWAL || p.incrementalBackup) {
+		return ErrInvalidWALArchive
+	}
+
+	if p.walSyncInterval < 0 || (p.walSyncInterval > 0 && !p.useWAL) {
+		return ErrInvalidWALSyncInterval
+	}
+
+	if p.compactionThreshold < 0 || p.compactionThreshold >= 1 {
+		return ErrInvalidCompactionThreshold
+	}
+
 	return nil
 }
@@ -0,0 +1,63 @@
+package zapp
+
+// placeSegments returns the directory of each segment's data file.
+// Segments are placed over paths by smooth weighted round-robin: each segment goes to the path
+// with the greatest current weight, then the path's current weight is decreased by the total weight
+// and all current weights are increased by paths' weights. Equal weights give plain round-robin.
+// The placement depends only on its arguments, nil weights mean equal weights
+func placeSegments(segmentsNum int, paths []string, weights []int) []string {
+	if weights == nil {
+		weights = make([]int, len(paths))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+
+	totalWeight := 0
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+
+	currentWeights := make([]int, len(paths))
+	placement := make([]string, 0, segmentsNum)
+
+	for i := 0; i < segmentsNum; i++ {
+		best := 0
+		for j := range paths {
+			currentWeights[j] += weights[j]
+
+			if currentWeights[j] > currentWeights[best] {
+				best = j
+			}
+		}
+
+		currentWeights[best] -= totalWeight
+
+		placement = append(placement, paths[best])
+	}
+
+	return placement
+}
+
+// placementWeights returns distinct directories of the placement in the order of their first appearance
+// and the numbers of segments in them, so that placeSegments spreads another number of segments the same way
+func placementWeights(placement []string) ([]string, []int) {
+	var paths []string
+	var weights []int
+
+	indexes := make(map[string]int)
+	for _, path := range placement {
+		idx, ok := indexes[path]
+		if !ok {
+			idx = len(paths)
+			indexes[path] = idx
+
+			paths = append(paths, path)
+			weights = append(weights, 0)
+		}
+
+		weights[idx]++
+	}
+
+	return paths, weights
+}
@@ -0,0 +1,170 @@
+package zapp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Kurt212/zapp/wal"
+)
+
+// RecoveryTarget is the point, up to which RecoverToPoint replays archived WAL's actions.
+// Zero value means replaying all archived actions
+type RecoveryTarget struct {
+	// Time limits replayed actions to the ones made before or at this time. Zero time means no limit.
+	// Time is known with millisecond precision
+	Time time.Time
+	// LSNs limits replayed actions of each segment to the ones with lower or equal LSN.
+	// Segments, which are not in the map, are not limited by LSN
+	LSNs map[int]uint64
+}
+
+// archivedWALFile is a segment's WAL archive file with its LSN range
+type archivedWALFile struct {
+	path     string
+	firstLSN uint64
+	lastLSN  uint64
+}
+
+// RecoverToPoint restores DB's files from the full backup at path and replays actions from the archived WAL
+// up to the target. The backup must be made by Backup, and WAL must be archived by a DB with WALArchivePath.
+// The directory at path must not exist or must be empty. If recovery fails, then the directory is left empty.
+// Returns ErrBackupChainBroken if archived WAL doesn't continue the backup
+func RecoverToPoint(backup io.Reader, walArchivePath string, path string, target RecoveryTarget) (err error) {
+	err = createEmptyDir(path)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			removeDirContent(path)
+		}
+	}()
+
+	lsns, err := restoreBackup(backup, path)
+	if err != nil {
+		return err
+	}
+
+	for segmentIdx := range lsns {
+		err = recoverSegmentFromWALArchive(walArchivePath, path, segmentIdx, lsns[segmentIdx], target)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Actions are written to WAL files. Opening the DB applies them to data files
+	db, err := New(NewParamsBuilder(path).
+		SegmentsNum(len(lsns)).
+		UseWAL(true).
+		SyncPeriod(0).
+		RemoveExpiredPeriod(0).
+		Params())
+	if err != nil {
+		return fmt.Errorf("can not apply archived wal: %w", err)
+	}
+
+	db.Close()
+
+	return nil
+}
+
+// recoverSegmentFromWALArchive appends archived actions with LSN greater than lsn up to the target to segment's WAL file
+func recoverSegmentFromWALArchive(walArchivePath string, path string, segmentIdx int, lsn uint64, target RecoveryTarget) error {
+	files, err := listArchivedWALFiles(walArchivePath, walArchivePrefix(segmentIdx))
+	if err != nil {
+		return err
+	}
+
+	targetLSN, hasTargetLSN := target.LSNs[segmentIdx]
+
+	var actions []wal.Action
+
+	for _, file := range files {
+		if file.lastLSN <= lsn {
+			continue
+		}
+
+		// archive files may overlap, but must not leave a gap
+		if file.firstLSN > lsn+1 {
+			return fmt.Errorf("%w: segment's %d archived wal starts at lsn %d, but restored only up to lsn %d",
+				ErrBackupChainBroken, segmentIdx, file.firstLSN, lsn)
+		}
+
+		fileActions, err := readArchivedWALFile(file.path, lsn)
+		if err != nil {
+			return err
+		}
+
+		for _, action := range fileActions {
+			if hasTargetLSN && action.LSN > targetLSN {
+				return appendToWALFile(walFilePath(path, segmentIdx), actions)
+			}
+
+			if action.Type == wal.ActionTypeTimeMark {
+				if !target.Time.IsZero() && action.Time > target.Time.UnixMilli() {
+					return appendToWALFile(walFilePath(path, segmentIdx), actions)
+				}
+				continue
+			}
+
+			actions = append(actions, action)
+			lsn = action.LSN
+		}
+	}
+
+	return appendToWALFile(walFilePath(path, segmentIdx), actions)
+}
+
+// listArchivedWALFiles returns segment's WAL archive files sorted by their LSN ranges
+func listArchivedWALFiles(walArchivePath string, prefix string) ([]archivedWALFile, error) {
+	entries, err := os.ReadDir(walArchivePath)
+	if err != nil {
+		return nil, fmt.Errorf("can not read wal archive dir %s: %w", walArchivePath, err)
+	}
+
+	var files []archivedWALFile
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		firstLSN, lastLSN, ok := wal.ParseArchiveFileName(prefix, entry.Name())
+		if !ok {
+			continue
+		}
+
+		files = append(files, archivedWALFile{
+			path:     filepath.Join(walArchivePath, entry.Name()),
+			firstLSN: firstLSN,
+			lastLSN:  lastLSN,
+		})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].firstLSN < files[j].firstLSN
+	})
+
+	return files, nil
+}
+
+func readArchivedWALFile(path string, lsn uint64) ([]wal.Action, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("can not open archived wal file %s: %w", path, err)
+	}
+
+	defer file.Close()
+
+	actions, err := wal.ReadActions(file, lsn)
+	if err != nil {
+		return nil, fmt.Errorf("can not read archived wal file %s: %w", path, err)
+	}
+
+	return actions, nil
+}
@@ -0,0 +1,307 @@
+package zapp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Kurt212/zapp/blob"
+)
+
+const (
+	reshardDirName = "reshard.tmp" // new segments' files are written to this directory inside their future directories
+)
+
+// Reshard changes the number of segments of the closed DB at path from fromSegmentsNum to toSegmentsNum.
+// Keys are routed to segments by their hashes modulo the number of segments, so all items are moved to new segments.
+// Expired items are dropped. WAL is applied to the old segments before resharding, new segments don't have WAL entries.
+// Items get new versions, which are greater than all versions given before, so old versions never match new items.
+//
+// New segments are spread over the same directories as old ones. Their files are written to temporary directories
+// inside them first. If resharding fails before the files are moved, then the DB is left untouched.
+// Before moving the files the manifest records, that resharding is in progress. If moving is interrupted,
+// then the next New or Reshard finishes it.
+// WAL's LSNs are not continued by new segments, so incremental backups and WAL archives made before resharding
+// can not be applied after it. Make a new full backup after resharding
+func Reshard(path string, fromSegmentsNum int, toSegmentsNum int) error {
+	if fromSegmentsNum <= 0 || toSegmentsNum <= 0 || toSegmentsNum > maxSegmentsNum {
+		return ErrInvalidSegmentsNum
+	}
+
+	oldManifest, newManifest, err := prepareReshard(path, fromSegmentsNum, toSegmentsNum)
+	if err != nil {
+		return err
+	}
+
+	return replaceSegmentsFiles(path, oldManifest, newManifest)
+}
+
+// prepareReshard writes new segments' files to temporary directories.
+// Returns the manifests of the DB before and after resharding
+func prepareReshard(path string, fromSegmentsNum int, toSegmentsNum int) (manifest, manifest, error) {
+	// WAL may have actions not applied to data files yet. Opening the DB applies them
+	var useWAL bool
+
+	m, err := readManifest(path)
+	if os.IsNotExist(err) {
+		// the directory was created before manifests were introduced, so all files are in it
+		err = checkSegmentsNum(path, fromSegmentsNum)
+		if err != nil {
+			return m, m, err
+		}
+
+		_, err = os.Stat(walFilePath(path, 0))
+		useWAL = err == nil
+	} else if err != nil {
+		return m, m, err
+	} else {
+		// the previous resharding may have been interrupted, while its files were moved
+		if m.Reshard != nil {
+			m, err = finishReshard(path, m)
+			if err != nil {
+				return m, m, err
+			}
+		}
+
+		useWAL = m.UseWAL
+	}
+
+	oldDB, err := New(NewParamsBuilder(path).
+		SegmentsNum(fromSegmentsNum).
+		UseWAL(useWAL).
+		SyncPeriod(0).
+		RemoveExpiredPeriod(0).
+		Params())
+	if err != nil {
+		return m, m, fmt.Errorf("can not open db with %d segments: %w", fromSegmentsNum, err)
+	}
+
+	// the manifest is written by New, if it didn't exist
+	m, err = readManifest(path)
+	if err != nil {
+		oldDB.Close()
+		return m, m, err
+	}
+
+	reshardedManifest := m
+	reshardedManifest.SegmentsNum = toSegmentsNum
+	reshardedManifest.LayoutVersion = int(blob.LatestLayout)
+
+	pb := NewParamsBuilder(filepath.Join(path, reshardDirName)).
+		SegmentsNum(toSegmentsNum).
+		UseWAL(false).
+		SyncPeriod(0).
+		RemoveExpiredPeriod(0)
+
+	// new segments are spread over the same directories in the same proportions
+	if len(m.SegmentPaths) != 0 {
+		dirs, weights := placementWeights(m.SegmentPaths)
+
+		reshardedManifest.SegmentPaths = placeSegments(toSegmentsNum, dirs, weights)
+
+		reshardDirs := make([]string, 0, len(dirs))
+		for _, dir := range dirs {
+			reshardDirs = append(reshardDirs, filepath.Join(dir, reshardDirName))
+		}
+
+		pb.DataPaths(reshardDirs).DataPathWeights(weights)
+	}
+
+	// leftovers of a previous failed attempt
+	err = removeReshardDirs(path, reshardedManifest)
+	if err != nil {
+		oldDB.Close()
+		return m, reshardedManifest, err
+	}
+
+	newDB, err := New(pb.Params())
+	if err != nil {
+		oldDB.Close()
+		return m, reshardedManifest, fmt.Errorf("can not create db with %d segments: %w", toSegmentsNum, err)
+	}
+
+	err = copySegments(oldDB, newDB)
+
+	// closing syncs new segments' files
+	closeErr := newDB.close()
+	if err == nil {
+		err = closeErr
+	}
+
+	// closing syncs old segments' files and truncates WAL, so WAL files are not needed anymore
+	closeErr = oldDB.close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		removeReshardDirs(path, reshardedManifest)
+		return m, reshardedManifest, err
+	}
+
+	return m, reshardedManifest, nil
+}
+
+// checkSegmentsNum checks that the directory has data files of exactly segmentsNum segments
+func checkSegmentsNum(path string, segmentsNum int) error {
+	_, err := os.Stat(dataFilePath(path, segmentsNum-1))
+	if err != nil {
+		return fmt.Errorf("%w: data file of segment %d: %v", ErrSegmentsNumMismatch, segmentsNum-1, err)
+	}
+
+	_, err = os.Stat(dataFilePath(path, segmentsNum))
+	if err == nil {
+		return fmt.Errorf("%w: data file of segment %d exists", ErrSegmentsNumMismatch, segmentsNum)
+	}
+
+	return nil
+}
+
+// copySegments sets all not expired items of oldDB to newDB.
+// New segments continue versions from the greatest version of old segments
+func copySegments(oldDB *DB, newDB *DB) error {
+	var lastVersion uint64
+	for _, segment := range oldDB.segments {
+		if segment.lastVersion > lastVersion {
+			lastVersion = segment.lastVersion
+		}
+	}
+
+	for _, segment := range newDB.segments {
+		segment.lastVersion = lastVersion
+	}
+
+	for idx, segment := range oldDB.segments {
+		var setErr error
+
+		_, err := segment.Scan(func(key, value []byte, expire int64) bool {
+			keyHash := hash(key)
+
+			setErr = newDB.getSegmentForKey(keyHash).Set(keyHash, key, value, expire)
+
+			return setErr == nil
+		})
+		if err == nil {
+			err = setErr
+		}
+		if err != nil {
+			return fmt.Errorf("can not copy items of segment %d: %w", idx, err)
+		}
+	}
+
+	return nil
+}
+
+// replaceSegmentsFiles replaces old segments' files and the manifest with new ones from temporary directories.
+// New files are persisted and the manifest records the replacing before any old file is touched
+func replaceSegmentsFiles(path string, oldManifest manifest, newManifest manifest) error {
+	for _, dir := range newManifest.dirs(path) {
+		// WAL's directory may have no new files
+		err := syncDir(filepath.Join(dir, reshardDirName))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			err = syncDir(dir)
+		}
+		if err != nil {
+			return fmt.Errorf("can not sync new segments' files in %s dir: %w", dir, err)
+		}
+	}
+
+	oldManifest.Reshard = &newManifest
+
+	err := writeManifest(path, oldManifest)
+	if err != nil {
+		return err
+	}
+
+	_, err = finishReshard(path, oldManifest)
+
+	return err
+}
+
+// finishReshard moves new segments' files to their places and removes old segments' files, which are not replaced.
+// m is the manifest, which records the replacing. Each step may be repeated, so finishing may be interrupted again.
+// Returns the manifest after resharding
+func finishReshard(path string, m manifest) (manifest, error) {
+	oldManifest := m
+	oldManifest.Reshard = nil
+
+	newManifest := *m.Reshard
+
+	// new data files are moved first, old data files with the same names are replaced by them
+	for i := 0; i < newManifest.SegmentsNum; i++ {
+		newPath := newManifest.segmentPath(path, i)
+
+		err := os.Rename(dataFilePath(filepath.Join(newPath, reshardDirName), i), dataFilePath(newPath, i))
+		// the file was moved before the interruption
+		if err != nil && !os.IsNotExist(err) {
+			return m, fmt.Errorf("can not move data file of segment %d: %w", i, err)
+		}
+	}
+
+	err := syncDirs(newManifest.dirs(path))
+	if err != nil {
+		return m, err
+	}
+
+	// old WAL's actions are applied, but they must not be applied to new segments
+	for i := 0; i < oldManifest.SegmentsNum; i++ {
+		err := os.Remove(walFilePath(oldManifest.walPath(path, i), i))
+		if err != nil && !os.IsNotExist(err) {
+			return m, fmt.Errorf("can not remove wal file of segment %d: %w", i, err)
+		}
+	}
+
+	// old data files, which are not replaced by new ones, are removed
+	for i := 0; i < oldManifest.SegmentsNum; i++ {
+		oldPath := oldManifest.segmentPath(path, i)
+		if i < newManifest.SegmentsNum && newManifest.segmentPath(path, i) == oldPath {
+			continue
+		}
+
+		err := os.Remove(dataFilePath(oldPath, i))
+		if err != nil && !os.IsNotExist(err) {
+			return m, fmt.Errorf("can not remove data file of segment %d: %w", i, err)
+		}
+	}
+
+	err = syncDirs(oldManifest.dirs(path))
+	if err != nil {
+		return m, err
+	}
+
+	err = writeManifest(path, newManifest)
+	if err != nil {
+		return m, err
+	}
+
+	return newManifest, removeReshardDirs(path, newManifest)
+}
+
+// syncDirs syncs all directories
+func syncDirs(dirs []string) error {
+	for _, dir := range dirs {
+		err := syncDir(dir)
+		if err != nil {
+			return fmt.Errorf("can not sync %s dir: %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// removeReshardDirs removes temporary directories of new segments' files
+func removeReshardDirs(path string, m manifest) error {
+	for _, dir := range m.dirs(path) {
+		reshardPath := filepath.Join(dir, reshardDirName)
+
+		err := os.RemoveAll(reshardPath)
+		if err != nil {
+			return fmt.Errorf("can not remove %s dir: %w", reshardPath, err)
+		}
+	}
+
+	return nil
+}
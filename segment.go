@@ -3,10 +3,12 @@ package zapp
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Kurt212/zapp/blob"
@@ -15,14 +17,22 @@ import (
 )
 
 const (
-	segmentFileLayoutVerion1       = 1
+	// segment file's layout version is the same as layout version of blobs stored in the file
+	segmentFileLayoutVersion1      = byte(blob.LayoutVersion1)
+	segmentFileLayoutVersion2      = byte(blob.LayoutVersion2) // adds items' versions and segment's last version in reserved bytes
+	segmentFileLayoutVersion3      = byte(blob.LayoutVersion3) // stores items' expire as int64 unix milliseconds
+	segmentFileLayoutVersion4      = byte(blob.LayoutVersion4) // pads items to size classes instead of powers of two
+	segmentFileLayoutVersion5      = byte(blob.LayoutVersion5) // adds items' checksums
+	segmentFileLatestLayoutVersion = byte(blob.LatestLayout)
 	segmentFileDefaultLastKnownLSN = 0
 
 	segmentFileMagicNumbersSize   = 3  // bytes
 	segmentFileLayoutSize         = 1  // byte
 	segmentFileLayoutReservedSize = 12 // bytes
+	segmentFileLastVersionSize    = 8  // bytes. Stored in reserved bytes since layout version 2
 	segmentFileLastKnownLSNSize   = 8  // bytes
 
+	segmentFileLastVersionOffset  = segmentFileMagicNumbersSize + segmentFileLayoutSize
 	segmentFileLastKnownLSNOffset = segmentFileMagicNumbersSize + segmentFileLayoutSize + segmentFileLayoutReservedSize
 
 	segmentFileHeaderSize = segmentFileMagicNumbersSize + segmentFileLayoutSize + segmentFileLayoutReservedSize + segmentFileLastKnownLSNSize
@@ -33,33 +43,104 @@ var (
 )
 
 type segment struct {
-	file          *os.File // used to store segment's items data on disk
-	fileSizeBytes int64    // internally count file's size to generate a valid offset for new item if there's no empty offset already existing
-
-	mtx                sync.RWMutex              // mutex is used globally to access this segment. Each operation on segment needs locking. Read operations acquire read lock, write operation acquire write lock
-	hashToOffsetMap    map[uint32][]itemMetaInfo // this is a list of items with the same hash value. Hash collisions sometimes happen and it's needed to deal with them. Although collisions happen quite not often
-	emptySizeToOffsets map[int][]int64           // this is a list of known empty offset of certain sizes. When key is deleted or expired, its offset will be reused later to store new data. That's why segment tracks all empty offsets
-	closedChan         chan struct{}             // this is a generic technic to notify each subprocess assosiated with this segment, that it must be terminated gracefully, because segment is closed and is no longer serving requests
-	closed             bool                      // set to true value when segment's Close() method has been called. Should check this before doing anything with segment, because segment might have been closed already but don't know yet
+	file          *os.File     // used to store segment's items data on disk
+	filePath      string       // path of segment's file. Compaction replaces the file at this path with a new one
+	generation    uint16       // incremented on each compaction and on file's truncation below handed out scan offsets. They invalidate offsets, so scan cursors must know about them
+	scannedEnd    atomic.Int64 // the greatest offset handed out by ScanPage in the current generation. Truncation of the file above it doesn't invalidate cursors
+	fileSizeBytes int64        // internally count file's size to generate a valid offset for new item if there's no empty offset already existing
+	layout        blob.Layout  // layout of the file's blobs. Read from file's header. New files are always created with the latest layout
+	lastVersion   uint64       // the greatest version given to an item in this segment. Each set gives the item a new greater version
+
+	mtx             sync.RWMutex              // mutex is used globally to access this segment. Each operation on segment needs locking. Read operations acquire read lock, write operation acquire write lock
+	hashToOffsetMap map[uint32][]itemMetaInfo // this is a list of items with the same hash value. Hash collisions sometimes happen and it's needed to deal with them. Although collisions happen quite not often
+	freeSlots       *freeSlots                // known empty offsets grouped by their sizes. When key is deleted or expired, its offset will be reused later to store new data. Larger slots are split and neighbour slots are merged like in buddy allocator
+	expireIndex     *expireIndex              // min-heap of items with expiration time. Used to collect expired items without visiting all items
+	closedChan      chan struct{}             // this is a generic technic to notify each subprocess assosiated with this segment, that it must be terminated gracefully, because segment is closed and is no longer serving requests
+	closed          bool                      // set to true value when segment's Close() method has been called. Should check this before doing anything with segment, because segment might have been closed already but don't know yet
 
 	wal          *wal.W // optional. wal is an object to work with write ahead log, generate new log entries and get log sequence numbers (LSNs). User may not want to work with WAL and increase write-operations throughput.
 	lastKnownLSN uint64 // lastKnownLSN is the last known wal's LSN appliend to this segment
+
+	pendingWrites []*pendingWrite          // writes appended to WAL, which are waiting for WAL's sync to be applied. Ordered by LSNs
+	pendingHashes map[uint32]int           // number of pending writes for each key's hash
+	pendingItems  map[string]*pendingWrite // the last pending single key's write of each key
+
+	recoveredBatches [][]wal.BatchPart // batches found in WAL on segment creation. Their parts may be missing in other segments, so WAL is not truncated until DB recovers them
+	retainWALHistory bool              // if true, then WAL is not truncated on checkpoints. The history is kept for incremental backups until it's released explicitly
+	walArchivePath   string            // optional. If set, then WAL's entries are moved to this directory on checkpoints instead of being discarded
+	walArchivePrefix string            // prefix of segment's WAL archive files names. Archive directory is shared by all segments
+
+	walSyncInterval time.Duration // if set, then WAL is synced by a background process once per interval and writes don't wait for the sync
+
+	compactCheckPeriod time.Duration // how often fragmentation is checked. Zero value disables automatic compaction
+	compactThreshold   float64       // share of free space in the file, which triggers automatic compaction
+
+	punchHoleMinSize     int         // empty blobs of this size or greater have their bodies' disk blocks deallocated. Zero value disables punching holes
+	holesToPunch         []hole      // empty blobs, which bodies are deallocated after their headers are synced
+	splitSlots           []splitSlot // free slots, which are split after headers of their rest parts are synced
+	preallocateChunkSize int64       // disk blocks are preallocated by chunks of this size, when items are appended. Zero value disables preallocation
+	preallocatedEnd      int64       // the end of preallocated space. It may be greater, than the file's size
+}
+
+// segmentOption sets optional segment's settings on creation
+type segmentOption func(seg *segment)
+
+// withWALArchive makes the segment move WAL's entries to the archive directory on checkpoints
+func withWALArchive(archivePath string, segmentIdx int) segmentOption {
+	return func(seg *segment) {
+		seg.walArchivePath = archivePath
+		seg.walArchivePrefix = walArchivePrefix(segmentIdx)
+	}
+}
+
+// withAutoCompaction makes the segment check its fragmentation periodically and compact the file,
+// when the share of free space reaches threshold
+func withAutoCompaction(checkPeriod time.Duration, threshold float64) segmentOption {
+	return func(seg *segment) {
+		seg.compactCheckPeriod = checkPeriod
+		seg.compactThreshold = threshold
+	}
+}
+
+// withPunchHoles makes the segment deallocate disk blocks of empty blobs of minSize or greater
+func withPunchHoles(minSize int) segmentOption {
+	return func(seg *segment) {
+		seg.punchHoleMinSize = minSize
+	}
+}
+
+// withPreallocation makes the segment preallocate disk blocks by chunks of chunkSize, when items are appended
+func withPreallocation(chunkSize int64) segmentOption {
+	return func(seg *segment) {
+		seg.preallocateChunkSize = chunkSize
+	}
+}
+
+// withWALSyncInterval makes the segment sync WAL once per interval instead of waiting for the sync on each write
+func withWALSyncInterval(interval time.Duration) segmentOption {
+	return func(seg *segment) {
+		seg.walSyncInterval = interval
+	}
+}
+
+// withRetainedWALHistory makes the segment keep WAL's history on checkpoints
+func withRetainedWALHistory() segmentOption {
+	return func(seg *segment) {
+		seg.retainWALHistory = true
+	}
 }
 
 type itemMetaInfo struct {
 	// TODO make meta info more compact. Try to store offset, size and expire time in a single int64 or so.
 	// Storing inmemory meta data about on-disk items is necessary.
 	// But segment should try to waste as little RAM as possible so that it can store more keys inside
-	offset     int64  // at which offset in segment's file data is located
-	size       int    // the length of data in current offset in bytes
-	expireTime uint32 // the time at which this offset no longer must be considered valid. now >= expireTime => item is invalid
+	offset     int64 // at which offset in segment's file data is located
+	size       int   // the length of data in current offset in bytes
+	expireTime int64 // unix milliseconds at which this offset no longer must be considered valid. now >= expireTime => item is invalid
 }
 
 func (i itemMetaInfo) IsExpired(now time.Time) bool {
-	if i.expireTime == 0 {
-		return false
-	}
-	return now.Unix() >= int64(i.expireTime)
+	return blob.IsExpireReached(i.expireTime, now)
 }
 
 func newSegment(
@@ -67,32 +148,61 @@ func newSegment(
 	walFile *os.File,
 	collectExpiredItemsPeriod time.Duration,
 	syncFileDuration time.Duration,
+	options ...segmentOption,
 ) (*segment, error) {
 	seg := &segment{
-		file:               dataFile,
-		mtx:                sync.RWMutex{},
-		hashToOffsetMap:    make(map[uint32][]itemMetaInfo),
-		emptySizeToOffsets: make(map[int][]int64),
-		closedChan:         make(chan struct{}),
-		closed:             false,
-		wal:                nil, // wal will be initiated after reading file from disk
+		file:            dataFile,
+		filePath:        dataFile.Name(),
+		mtx:             sync.RWMutex{},
+		hashToOffsetMap: make(map[uint32][]itemMetaInfo),
+		freeSlots:       newFreeSlots(),
+		expireIndex:     newExpireIndex(),
+		pendingHashes:   make(map[uint32]int),
+		pendingItems:    make(map[string]*pendingWrite),
+		closedChan:      make(chan struct{}),
+		closed:          false,
+		wal:             nil, // wal will be initiated after reading file from disk
+	}
+
+	for _, option := range options {
+		option(seg)
 	}
 
 	// read whole file and make fill hash to offset map and empty size to offset map
 	// also reads lastKnownLSN from file
-	err := seg.loadDataFromDisk()
+	damagedBlobs, err := seg.loadDataFromDisk(walFile != nil)
 	if err != nil {
 		return nil, fmt.Errorf("can not load data from disk: %w", err)
 	}
 
 	if walFile != nil {
-		walManager, unaplliedActions, err := wal.CreateWalAndReturnNotAppliedActions(walFile, seg.lastKnownLSN)
+		// damaged items are restored by reapplying WAL's actions starting from the action, which has written them
+		walManager, unaplliedActions, err := wal.CreateWalAndReturnNotAppliedActions(walFile, replayFromLSN(seg.lastKnownLSN, damagedBlobs))
 		if err != nil {
 			return nil, err
 		}
 
+		err = seg.rawFreeDamagedBlobs(damagedBlobs, unaplliedActions)
+		if err != nil {
+			return nil, fmt.Errorf("can not load data from disk: %w", err)
+		}
+
 		seg.wal = walManager
 
+		// time marks allow to replay archived WAL up to some point in time
+		if seg.walArchivePath != "" {
+			seg.wal.EnableTimeMarks()
+		}
+
+		if seg.walSyncInterval > 0 {
+			seg.wal.EnableDeferredSync()
+		}
+
+		// With WAL item's version is the LSN of the action, which has set it.
+		// Segment may have worked without WAL before and given greater versions, than WAL's LSNs,
+		// so LSNs must continue from the last version
+		seg.wal.AdvanceLSN(seg.lastVersion)
+
 		if len(unaplliedActions) > 0 {
 			err = seg.performUnappliedWALActions(unaplliedActions)
 			if err != nil {
@@ -106,25 +216,38 @@ func newSegment(
 		}
 	}
 
+	// items, which are still expired after WAL's recovery, are not needed anymore
+	for seg.rawCollectExpiredItems() {
+	}
+
 	if syncFileDuration > 0 {
 		go seg.fsyncLoop(syncFileDuration)
 	}
 
+	if seg.wal != nil && seg.walSyncInterval > 0 {
+		go seg.walSyncLoop(seg.walSyncInterval)
+	}
+
 	if collectExpiredItemsPeriod > 0 {
 		go seg.collectExpiredItemsLoop(collectExpiredItemsPeriod)
 	}
 
+	if seg.compactCheckPeriod > 0 && seg.compactThreshold > 0 {
+		go seg.compactLoop(seg.compactCheckPeriod, seg.compactThreshold)
+	}
+
 	return seg, nil
 }
 
-// loadDataFromDisk reads whole on disk file and restores in memory state
-func (seg *segment) loadDataFromDisk() error {
+// loadDataFromDisk reads whole on disk file and restores in memory state.
+// With WAL items, which blobs are damaged, may be restored by WAL's actions, so their blobs are returned instead of an error
+func (seg *segment) loadDataFromDisk(withWAL bool) ([]damagedBlob, error) {
 	file := seg.file
 
 	// move file cursor to the beginning of the file
 	fileBeginOffset, err := file.Seek(0, constants.OriginWhence)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// read segment file header and validate it
@@ -136,7 +259,7 @@ func (seg *segment) loadDataFromDisk() error {
 	if err == io.EOF {
 		// reuse same buffer to write file header to the new created file
 		copy(fileHeaderBuffer, segmentFileBeginMagicNumbers)
-		fileHeaderBuffer[segmentFileMagicNumbersSize] = segmentFileLayoutVerion1
+		fileHeaderBuffer[segmentFileMagicNumbersSize] = segmentFileLatestLayoutVersion
 
 		lastLSNBuffer := make([]byte, 0, segmentFileLastKnownLSNSize)
 		lastLSNBuffer = binary.BigEndian.AppendUint64(lastLSNBuffer, segmentFileDefaultLastKnownLSN)
@@ -145,80 +268,114 @@ func (seg *segment) loadDataFromDisk() error {
 
 		_, err = file.WriteAt(fileHeaderBuffer, fileBeginOffset)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		seg.fileSizeBytes = segmentFileHeaderSize
+		seg.preallocatedEnd = segmentFileHeaderSize
 		seg.lastKnownLSN = segmentFileDefaultLastKnownLSN
+		seg.layout = blob.LatestLayout
 
-		return nil
+		return nil, nil
 	}
 	// if this is not EOF, then trigger error
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// parse header from the buffer
 	fileMagicNumbers := fileHeaderBuffer[:segmentFileMagicNumbersSize]
 
 	if !bytes.Equal(fileMagicNumbers, segmentFileBeginMagicNumbers) {
-		return ErrSegmentMagicNumbersDoNotMatch
+		return nil, ErrSegmentMagicNumbersDoNotMatch
 	}
 
 	fileVersion := fileHeaderBuffer[segmentFileMagicNumbersSize]
-	if fileVersion != segmentFileLayoutVerion1 {
-		return ErrSegmentUnknownVersionNumber
+	if !blob.Layout(fileVersion).IsKnown() {
+		return nil, ErrSegmentUnknownVersionNumber
 	}
-	// here may be some other reads for data from reserved bytes in header
+
+	seg.layout = blob.Layout(fileVersion)
 
 	// initialize lastKnownLSN from header
 	lastKnownLSNBuffer := fileHeaderBuffer[segmentFileLastKnownLSNOffset:]
 	seg.lastKnownLSN = binary.BigEndian.Uint64(lastKnownLSNBuffer)
 
-	now := time.Now() // to check the expire fields of the items
+	// Last version in header is written on each fsync, so it may be lower, than some items' versions.
+	// Each item on disk, even deleted one, keeps its version, so the greatest of them is taken.
+	// With WAL versions are LSNs, so the last applied LSN is also taken
+	seg.lastVersion = seg.lastKnownLSN
+	if seg.layout.HasVersions() {
+		lastVersionBuffer := fileHeaderBuffer[segmentFileLastVersionOffset : segmentFileLastVersionOffset+segmentFileLastVersionSize]
+
+		lastVersion := binary.BigEndian.Uint64(lastVersionBuffer)
+		if lastVersion > seg.lastVersion {
+			seg.lastVersion = lastVersion
+		}
+	}
+
+	headerSize := seg.layout.HeaderSize()
+
+	var damagedBlobs []damagedBlob
 
 	visitorFunc := func(file *os.File, currentOffset int64, blobHeader blob.Header) error {
 		blobSize := blobHeader.Size()
 
+		if blobHeader.Version > seg.lastVersion {
+			seg.lastVersion = blobHeader.Version
+		}
+
 		switch {
-		// If meet an expired blob, then treat it as a deleted blob.
-		// On disk it will remain expired until someone overwrites it
-		case blobHeader.IsExpired(now):
-			fallthrough
 		case blobHeader.Status == blob.StatusDeleted:
-			// this is an empty blob, so just save it to empty sizes map
-			offsetsSlice := seg.emptySizeToOffsets[blobSize]
-
-			offsetsSlice = append(offsetsSlice, currentOffset)
-
-			seg.emptySizeToOffsets[blobSize] = offsetsSlice
+			// this is an empty blob, so just save it to free slots. It may be merged with the previous empty blob
+			seg.rawFreeSlot(currentOffset, blobSize)
 
+		// Expired items are loaded as well. The expire change, which makes an item alive again, may be lost from the file,
+		// but still be in WAL. Expired items are collected after WAL's actions are reapplied
 		case blobHeader.Status == blob.StatusOK:
 			// blob size is sum of header size and body size
-			bodySize := blobSize - blob.HeaderSize
+			bodySize := blobSize - headerSize
 
 			// read blob's body from disk
 			blobBodyBuffer := make([]byte, bodySize)
 
-			_, err := file.ReadAt(blobBodyBuffer, currentOffset+blob.HeaderSize)
+			_, err := file.ReadAt(blobBodyBuffer, currentOffset+int64(headerSize))
+			// the blob was appended only partially, when the file was not synced yet
+			if err == io.EOF && withWAL {
+				damagedBlobs = append(damagedBlobs, damagedBlob{offset: currentOffset, version: blobHeader.Version, tail: true})
+				return errStopVisiting
+			}
 			if err != nil {
 				return err
 			}
 
-			kve := blob.UnmarshalBody(blobBodyBuffer, blobHeader)
+			kve, err := seg.unmarshalItemBody(currentOffset, blobHeader, blobBodyBuffer)
+			// The blob was written only partially, when the file was not synced yet. Its size is taken from the header,
+			// only if the header's lengths fit it
+			if errors.Is(err, ErrCorruptedItem) && withWAL && blobHeader.FitsSize(seg.layout) {
+				damagedBlobs = append(damagedBlobs, damagedBlob{offset: currentOffset, size: blobSize, version: blobHeader.Version})
+				return nil
+			}
+			if err != nil {
+				return err
+			}
 
 			// calculate hash from key and store data about this blob in hash to offset map
 			keyHash := hash(kve.Key)
 
 			hashOffsets := seg.hashToOffsetMap[keyHash]
 
-			hashOffsets = append(hashOffsets, itemMetaInfo{
+			offsetInfo := itemMetaInfo{
 				offset:     currentOffset,
 				size:       blobSize,
 				expireTime: blobHeader.Expire,
-			})
+			}
+
+			hashOffsets = append(hashOffsets, offsetInfo)
 
 			seg.hashToOffsetMap[keyHash] = hashOffsets
+
+			seg.expireIndex.Track(keyHash, offsetInfo)
 		default:
 			panic(ErrUnknownBlobStatus)
 		}
@@ -227,47 +384,171 @@ func (seg *segment) loadDataFromDisk() error {
 
 	var lastOffset int64
 	lastOffset, err = seg.visitOnDiskItems(visitorFunc)
-	if err != nil {
-		return fmt.Errorf("got error when restoring state from disk: %w", err)
+	// the partially appended blob is the end of the file
+	if err != nil && !errors.Is(err, errStopVisiting) {
+		return nil, fmt.Errorf("got error when restoring state from disk: %w", err)
 	}
 
 	seg.fileSizeBytes = lastOffset
+	seg.preallocatedEnd = lastOffset
+
+	return damagedBlobs, nil
+}
+
+func (seg *segment) Set(hash uint32, key []byte, value []byte, expire int64) error {
+	return seg.SetWithSync(hash, key, value, expire, SyncDefault)
+}
+
+// SetWithSync sets the key. The set is durable according to the sync mode, when it returns
+func (seg *segment) SetWithSync(hash uint32, key []byte, value []byte, expire int64, sync SyncMode) error {
+	write, err := seg.set(hash, key, value, expire, sync)
+	if err != nil {
+		return err
+	}
+
+	seg.waitApplied(write, sync)
 
 	return nil
 }
 
-func (seg *segment) Set(hash uint32, key []byte, value []byte, expire uint32) error {
+// set sets the key under the lock. With WAL it returns the pending write, which is applied after WAL's sync.
+// Nil pending write means that the key is set already
+func (seg *segment) set(hash uint32, key []byte, value []byte, expire int64, sync SyncMode) (*pendingWrite, error) {
 	seg.mtx.Lock()
 	defer seg.mtx.Unlock()
 
 	if seg.closed {
-		return ErrClosed
+		return nil, ErrClosed
+	}
+
+	if sync == SyncNone {
+		if seg.keepsWALHistory() {
+			return nil, ErrSyncNoneWithWALHistory
+		}
+
+		return nil, seg.rawUnloggedSet(hash, key, value, expire)
+	}
+
+	write, err := seg.rawLoggedSet(hash, key, value, expire)
+	if err != nil {
+		return nil, err
+	}
+
+	if write == nil {
+		seg.rawSyncFileForMode(sync)
+	}
+
+	return write, nil
+}
+
+// setCondition decides if conditional set must be performed.
+// current is the current key's item. exists is false, if the key is not found or expired
+type setCondition func(current blob.KVE, exists bool) bool
+
+// SetIf sets the key only if condition returns true for the current key's value.
+// Checking the condition and setting the key are done under the same write lock, so nobody can change the key in between.
+// Returns true if the key was set
+func (seg *segment) SetIf(hash uint32, key []byte, value []byte, expire int64, condition setCondition) (bool, error) {
+	ok, write, err := seg.setIf(hash, key, value, expire, condition)
+	if err != nil || !ok {
+		return false, err
 	}
 
+	seg.waitApplied(write, SyncDefault)
+
+	return true, nil
+}
+
+// setIf checks the condition and sets the key under the lock. With WAL it returns the pending write
+func (seg *segment) setIf(hash uint32, key []byte, value []byte, expire int64, condition setCondition) (bool, *pendingWrite, error) {
+	seg.mtx.Lock()
+	defer seg.mtx.Unlock()
+
+	if seg.closed {
+		return false, nil, ErrClosed
+	}
+
+	exists := true
+
+	// the condition must see all previous writes of the key
+	current, err := seg.rawCurrentItem(hash, key)
+	if errors.Is(err, ErrNotFound) {
+		exists = false
+	} else if err != nil {
+		return false, nil, err
+	}
+
+	if !condition(current, exists) {
+		return false, nil, nil
+	}
+
+	// conditional set is logged to WAL as a usual set action, so WAL recovery doesn't need to check conditions again
+	write, err := seg.rawLoggedSet(hash, key, value, expire)
+	if err != nil {
+		return false, nil, err
+	}
+
+	return true, write, nil
+}
+
+// rawLoggedSet appends set action to WAL and returns the pending write, which sets the key after WAL's sync.
+// Without WAL the key is set right away
+func (seg *segment) rawLoggedSet(hash uint32, key []byte, value []byte, expire int64) (*pendingWrite, error) {
 	// if wal manager field is nil, then do nothing with the WAL logic and work without it
 	// this increases performace dramatically
-	if seg.wal != nil {
-		lsn, err := seg.wal.AppendSet(key, value, expire)
-		if err != nil {
-			panic(fmt.Errorf("got error when append set action to WAL: %w", err))
-		}
+	if seg.wal == nil {
+		return nil, seg.rawSet(hash, key, value, expire, seg.rawNextVersion())
+	}
 
-		err = seg.rawWriteLastKnownLSN(lsn)
-		if err != nil {
-			panic(fmt.Errorf("got error when trying to write last known LSN %d to segment: %w", lsn, err))
-		}
+	lsn, err := seg.wal.AppendSet(key, value, expire)
+	if err != nil {
+		panic(fmt.Errorf("got error when append set action to WAL: %w", err))
+	}
+
+	// with WAL's sync interval the write returns before it's applied, and the caller may change the value meanwhile
+	if seg.walSyncInterval > 0 {
+		value = bytes.Clone(value)
+	}
+
+	item := pendingItem{
+		kve: blob.KVE{
+			Key:     key,
+			Value:   value,
+			Expire:  expire,
+			Version: lsn,
+		},
 	}
 
-	return seg.rawSet(hash, key, value, expire)
+	// with WAL item's version is always the LSN of its set action
+	// so that the same versions are given, when actions are reapplied from WAL
+	write := seg.rawAddPendingItem(lsn, hash, item, func() error {
+		return seg.rawSet(hash, key, value, expire, lsn)
+	})
+
+	return write, nil
+}
+
+// rawNextVersion returns the version for the next set without WAL
+func (seg *segment) rawNextVersion() uint64 {
+	return seg.lastVersion + 1
 }
-func (seg *segment) rawSet(hash uint32, key []byte, value []byte, expire uint32) error {
+
+func (seg *segment) rawSet(hash uint32, key []byte, value []byte, expire int64, version uint64) error {
 	// convert duration to timestamp only if it's not empty
 	kve := blob.KVE{
-		Key:    key,
-		Value:  value,
-		Expire: expire,
+		Key:     key,
+		Value:   value,
+		Expire:  expire,
+		Version: version,
 	}
 
+	if version > seg.lastVersion {
+		seg.lastVersion = version
+	}
+
+	// the offset of the previous blob of the same key. Zero value means that the key is new
+	var previousOffset int64 = 0
+
 	// first try to find if there is this key already set
 	// if found same existing key, delete old one and mark its disk space as empty
 	offsetsWithCurrentHash, ok := seg.hashToOffsetMap[hash]
@@ -285,7 +566,7 @@ func (seg *segment) rawSet(hash uint32, key []byte, value []byte, expire uint32)
 				))
 			}
 
-			kveOnDisk := blob.Unmarshal(dataBuffer)
+			kveOnDisk := blob.Unmarshal(dataBuffer, seg.layout)
 			onDiskKey := kveOnDisk.Key
 
 			// if found previous blob of current key
@@ -293,20 +574,13 @@ func (seg *segment) rawSet(hash uint32, key []byte, value []byte, expire uint32)
 			// because we are replacing it with a new value now
 			if bytes.Equal(key, onDiskKey) {
 				// write on disk that data is deleted
-				deletedStatusByte := []byte{blob.StatusDeleted}
-
-				_, err := seg.file.WriteAt(deletedStatusByte, offsetInfo.offset+blob.StatusOffset)
-				if err != nil {
-					panic(fmt.Errorf(
-						"tried to write delete status at offset %d but got error: %w",
-						offsetInfo.offset+blob.StatusOffset,
-						err,
-					))
-				}
+				seg.rawWriteDeletedStatus(offsetInfo.offset)
 
 				// Add this offset to list of free empty offsets and delete from hash to offset map
 				seg.rawDeleteOffsetFromMemory(hash, offsetInfo)
 
+				previousOffset = offsetInfo.offset
+
 				// now as duplicate index is found it's ok to stop the for-loop
 				break
 			}
@@ -318,31 +592,19 @@ func (seg *segment) rawSet(hash uint32, key []byte, value []byte, expire uint32)
 	// if can not find empty offset, then append at the end of the file
 
 	// marshal the data into one solid binary blob
-	binaryBlob, sizeOfBlob := kve.Marshal()
-
-	var offset int64 = 0
-
-	emptyOffsets, ok := seg.emptySizeToOffsets[sizeOfBlob]
-	if ok && len(emptyOffsets) > 0 {
-		offset = emptyOffsets[0]
-
-		// Swap the first value with the last value. And decrement slice size by 1.
-		// This is a cheap way to delete item from slice without O(N) operation
-		// TODO also make it more understandable
-		if len(emptyOffsets) > 1 {
-			emptyOffsets[0] = emptyOffsets[len(emptyOffsets)-1]
-			emptyOffsets = emptyOffsets[:len(emptyOffsets)-1]
-		} else {
-			emptyOffsets = emptyOffsets[:0]
-		}
+	binaryBlob, sizeOfBlob := kve.Marshal(seg.layout)
 
-		seg.emptySizeToOffsets[sizeOfBlob] = emptyOffsets
-	}
+	// An existing key is never moved to a lower offset, than its previous blob had.
+	// Cursor based scans walk the file from the beginning to the end,
+	// so this guarantees that a key which exists during the whole scan is not missed
+	offset := seg.rawTakeEmptyOffset(sizeOfBlob, previousOffset)
 
 	appendAtTheEnd := false
 	if offset == 0 {
 		offset = seg.fileSizeBytes
 		appendAtTheEnd = true
+
+		seg.rawPreallocate(sizeOfBlob)
 	}
 
 	_, err := seg.file.WriteAt(binaryBlob, offset)
@@ -364,15 +626,19 @@ func (seg *segment) rawSet(hash uint32, key []byte, value []byte, expire uint32)
 		offsetsWithCurrentHash = nil
 	}
 
-	// modify seg.hashToOffsetMap map and save new offset for current hash
-	offsetsWithCurrentHash = append(offsetsWithCurrentHash, itemMetaInfo{
+	offsetInfo := itemMetaInfo{
 		offset:     offset,
 		size:       sizeOfBlob,
 		expireTime: expire,
-	})
+	}
+
+	// modify seg.hashToOffsetMap map and save new offset for current hash
+	offsetsWithCurrentHash = append(offsetsWithCurrentHash, offsetInfo)
 
 	seg.hashToOffsetMap[hash] = offsetsWithCurrentHash
 
+	seg.expireIndex.Track(hash, offsetInfo)
+
 	return nil
 }
 
@@ -391,17 +657,85 @@ func (seg *segment) Get(hash uint32, key []byte) ([]byte, error) {
 	return seg.rawGet(hash, key)
 }
 
+// GetVersioned returns key's value and its version.
+// Segments with layout version 1 don't store items' versions
+func (seg *segment) GetVersioned(hash uint32, key []byte) ([]byte, uint64, error) {
+	seg.mtx.RLock()
+	defer seg.mtx.RUnlock()
+
+	if seg.closed {
+		return nil, 0, ErrClosed
+	}
+
+	if !seg.layout.HasVersions() {
+		return nil, 0, ErrVersionsNotSupported
+	}
+
+	kve, err := seg.rawReadItem(hash, key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return kve.Value, kve.Version, nil
+}
+
+// HasVersions tells if the segment's file layout stores items' versions.
+// The layout is never changed, so it's safe to call without locking
+func (seg *segment) HasVersions() bool {
+	return seg.layout.HasVersions()
+}
+
+// WALTornTail returns the torn tail of segment's WAL file, which was truncated, when the segment was opened.
+// Zero size means that WAL file didn't have a torn tail or WAL is not used
+func (seg *segment) WALTornTail() wal.TornTail {
+	if seg.wal == nil {
+		return wal.TornTail{}
+	}
+
+	return seg.wal.TornTail()
+}
+
 func (seg *segment) rawGet(hash uint32, key []byte) ([]byte, error) {
+	kve, err := seg.rawReadItem(hash, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return kve.Value, nil
+}
+
+// rawGetItem finds not expired key's item on disk
+func (seg *segment) rawGetItem(hash uint32, key []byte) (blob.KVE, error) {
+	_, kve, err := seg.rawFindItem(hash, key)
+	if err != nil {
+		return blob.KVE{}, err
+	}
+
+	return kve, nil
+}
+
+// rawFindItem finds not expired key's item on disk and returns its in memory meta info as well
+func (seg *segment) rawFindItem(hash uint32, key []byte) (itemMetaInfo, blob.KVE, error) {
+	return seg.rawFindStoredItem(hash, key, false)
+}
+
+// rawFindStoredItem works just like rawFindItem, but finds expired items as well, if withExpired is true.
+// A not expired item is preferred, if the key has several items
+func (seg *segment) rawFindStoredItem(hash uint32, key []byte, withExpired bool) (itemMetaInfo, blob.KVE, error) {
 	offsetsWithCurrentHash, ok := seg.hashToOffsetMap[hash]
 	if !ok {
-		return nil, ErrNotFound
+		return itemMetaInfo{}, blob.KVE{}, ErrNotFound
 	}
 
 	now := time.Now()
 
+	var expiredInfo itemMetaInfo
+	var expiredKVE blob.KVE
+	expiredFound := false
+
 	for _, offsetInfo := range offsetsWithCurrentHash {
 		// if expired then do not try to read it from disk
-		if offsetInfo.IsExpired(now) {
+		if offsetInfo.IsExpired(now) && !withExpired {
 			continue
 		}
 
@@ -417,7 +751,11 @@ func (seg *segment) rawGet(hash uint32, key []byte) ([]byte, error) {
 			))
 		}
 
-		kveOnDisk := blob.Unmarshal(dataBuffer)
+		kveOnDisk, err := seg.unmarshalItem(offsetInfo.offset, dataBuffer)
+		if err != nil {
+			return itemMetaInfo{}, blob.KVE{}, err
+		}
+
 		onDiskKey := kveOnDisk.Key
 
 		// if met the same key, then this is the value, which should be returned
@@ -426,39 +764,102 @@ func (seg *segment) rawGet(hash uint32, key []byte) ([]byte, error) {
 			// must check if key is expired now. Then pretend that we didn't see it and return NotFound
 			// Later backgroud routine, which deletes all expired keys, will clean it and add to empty map
 			if kveOnDisk.IsExpired(now) {
-				return nil, ErrNotFound
+				if !withExpired {
+					return itemMetaInfo{}, blob.KVE{}, ErrNotFound
+				}
+
+				if !expiredFound {
+					expiredInfo, expiredKVE, expiredFound = offsetInfo, kveOnDisk, true
+				}
+
+				continue
 			}
 
-			return kveOnDisk.Value, nil
+			return offsetInfo, kveOnDisk, nil
 		}
 	}
 
-	return nil, ErrNotFound
+	if expiredFound {
+		return expiredInfo, expiredKVE, nil
+	}
+
+	return itemMetaInfo{}, blob.KVE{}, ErrNotFound
 }
 
 func (seg *segment) Delete(hash uint32, key []byte) error {
+	return seg.DeleteWithSync(hash, key, SyncDefault)
+}
+
+// DeleteWithSync deletes the key. The deletion is durable according to the sync mode, when it returns
+func (seg *segment) DeleteWithSync(hash uint32, key []byte, sync SyncMode) error {
+	write, err := seg.delete(hash, key, sync)
+	if err != nil {
+		return err
+	}
+
+	seg.waitApplied(write, sync)
+
+	return nil
+}
+
+// delete deletes the key under the lock. With WAL it returns the pending write, which is applied after WAL's sync.
+// Nil pending write means that the key is deleted already
+func (seg *segment) delete(hash uint32, key []byte, sync SyncMode) (*pendingWrite, error) {
 	seg.mtx.Lock()
 	defer seg.mtx.Unlock()
 
 	if seg.closed {
-		return ErrClosed
+		return nil, ErrClosed
+	}
+
+	if sync == SyncNone {
+		if seg.keepsWALHistory() {
+			return nil, ErrSyncNoneWithWALHistory
+		}
+
+		return nil, seg.rawUnloggedDelete(hash, key)
 	}
 
 	// if wal manager field is nil, then do nothing with the WAL logic and work without it
 	// this increases performace dramatically
-	if seg.wal != nil {
-		lsn, err := seg.wal.AppendDel(key)
+	if seg.wal == nil {
+		err := seg.rawDelete(hash, key)
 		if err != nil {
-			panic(fmt.Errorf("got error when append del action to WAL: %w", err))
+			return nil, err
 		}
 
-		err = seg.rawWriteLastKnownLSN(lsn)
-		if err != nil {
-			panic(fmt.Errorf("got error when trying to write last known LSN %d to segment: %w", lsn, err))
-		}
+		seg.rawSyncFileForMode(sync)
+
+		return nil, nil
+	}
+
+	// check that the key exists before appending to WAL
+	_, err := seg.rawCurrentItem(hash, key)
+	if err != nil {
+		return nil, err
 	}
 
-	return seg.rawDelete(hash, key)
+	lsn, err := seg.wal.AppendDel(key)
+	if err != nil {
+		panic(fmt.Errorf("got error when append del action to WAL: %w", err))
+	}
+
+	item := pendingItem{
+		kve:     blob.KVE{Key: key},
+		deleted: true,
+	}
+
+	write := seg.rawAddPendingItem(lsn, hash, item, func() error {
+		err := seg.rawDelete(hash, key)
+		// the key might have expired and been collected, while waiting for WAL's sync
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+
+		return err
+	})
+
+	return write, nil
 }
 
 func (seg *segment) rawDelete(hash uint32, key []byte) error {
@@ -491,7 +892,7 @@ func (seg *segment) rawDelete(hash uint32, key []byte) error {
 			))
 		}
 
-		kveOnDisk := blob.Unmarshal(dataBuffer)
+		kveOnDisk := blob.Unmarshal(dataBuffer, seg.layout)
 		onDiskKey := kveOnDisk.Key
 
 		// if found previous blob of current key
@@ -511,31 +912,50 @@ func (seg *segment) rawDelete(hash uint32, key []byte) error {
 	}
 
 	// write on disk that data is deleted
+	seg.rawWriteDeletedStatus(itemOffsetInfo.offset)
+
+	seg.rawDeleteOffsetFromMemory(hash, itemOffsetInfo)
+
+	return nil
+}
+
+// rawWriteDeletedStatus marks the blob at offset as deleted on disk.
+// The checksum covers the status, so with checksums the whole header is rewritten with a new checksum
+func (seg *segment) rawWriteDeletedStatus(offset int64) {
+	if seg.layout.HasChecksums() {
+		header, ok := seg.rawDeletedHeader(offset)
+		if ok {
+			_, err := seg.file.WriteAt(blob.MarshalHeader(header, seg.layout), offset)
+			if err != nil {
+				panic(fmt.Errorf("tried to write deleted item's header at offset %d but got error: %w", offset, err))
+			}
+
+			return
+		}
+	}
+
 	deletedStatusByte := []byte{blob.StatusDeleted}
 
-	_, err := seg.file.WriteAt(deletedStatusByte, itemOffsetInfo.offset+blob.StatusOffset)
+	_, err := seg.file.WriteAt(deletedStatusByte, offset+blob.StatusOffset)
 	if err != nil {
 		panic(fmt.Errorf(
 			"tried to write deleted status at offset %d but got error: %w",
-			itemOffsetInfo.offset+blob.StatusOffset,
+			offset+blob.StatusOffset,
 			err,
 		))
 	}
-
-	seg.rawDeleteOffsetFromMemory(hash, itemOffsetInfo)
-
-	return nil
 }
 
-// rawDeleteOffsetFromMemory removes offset from offset map and adds this offset to empty map
+// rawDeleteOffsetFromMemory removes offset from offset map and adds this offset to empty map.
+// Returns false if the offset is not found in offset map
 func (seg *segment) rawDeleteOffsetFromMemory(
 	hash uint32, offsetInfo itemMetaInfo,
-) {
+) bool {
 	// first find this offset in hashToOffsetMap
 	offsetsWithCurrentHash, ok := seg.hashToOffsetMap[hash]
 	// if there's no any offset with such hash, then do nothing
 	if !ok {
-		return
+		return false
 	}
 
 	itemIdx := -1
@@ -547,15 +967,13 @@ func (seg *segment) rawDeleteOffsetFromMemory(
 
 	// if didn't find this offset with such size in the list of hash offsets, then do nothing
 	if itemIdx == -1 {
-		return
+		return false
 	}
 
-	// Add this offset to list of free empty offsets
-	emptyOffsets := seg.emptySizeToOffsets[offsetInfo.size]
-
-	emptyOffsets = append(emptyOffsets, offsetInfo.offset)
+	seg.expireIndex.Untrack(offsetInfo.offset)
 
-	seg.emptySizeToOffsets[offsetInfo.size] = emptyOffsets
+	// Add this offset to free slots
+	seg.rawFreeSlot(offsetInfo.offset, offsetInfo.size)
 
 	// Just replace duplicate with the last item and then crop the slice
 	currentLength := len(offsetsWithCurrentHash)
@@ -568,9 +986,19 @@ func (seg *segment) rawDeleteOffsetFromMemory(
 	}
 
 	seg.hashToOffsetMap[hash] = offsetsWithCurrentHash
+
+	return true
 }
 
 func (seg *segment) Close() {
+	err := seg.close()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// close works just like Close, but returns the error of closing segment's file
+func (seg *segment) close() error {
 	seg.mtx.Lock()
 	defer seg.mtx.Unlock()
 
@@ -582,11 +1010,10 @@ func (seg *segment) Close() {
 
 	err := seg.file.Close()
 	if err != nil {
-		panic(fmt.Errorf(
-			"tried to close segment's file when closing segment, but got error: %w",
-			err,
-		))
+		return fmt.Errorf("tried to close segment's file when closing segment, but got error: %w", err)
 	}
+
+	return nil
 }
 
 func (seg *segment) rawWriteLastKnownLSN(lastKnownLSN uint64) error {
@@ -602,3 +1029,21 @@ func (seg *segment) rawWriteLastKnownLSN(lastKnownLSN uint64) error {
 
 	return nil
 }
+
+// rawWriteLastVersion writes segment's last version to the file's header.
+// Segments with layout version 1 don't store versions at all
+func (seg *segment) rawWriteLastVersion() error {
+	if !seg.layout.HasVersions() {
+		return nil
+	}
+
+	var buffer []byte
+	buffer = binary.BigEndian.AppendUint64(buffer, seg.lastVersion)
+
+	_, err := seg.file.WriteAt(buffer, segmentFileLastVersionOffset)
+	if err != nil {
+		return fmt.Errorf("got error when writing last version to segment's file: %w", err)
+	}
+
+	return nil
+}
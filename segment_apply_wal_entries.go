@@ -16,14 +16,14 @@ func (seg *segment) performUnappliedWALActions(actions []wal.Action) error {
 
 	SWITCH:
 		switch action.Type {
-		case wal.ActionTypeSet:
+		case wal.ActionTypeSet, wal.ActionTypeSetMilli:
 			key := action.Key
 			value := action.Value
 			expire := action.Expire
 
 			keyHash := hash(key)
 
-			err := seg.rawSet(keyHash, key, value, expire)
+			err := seg.rawSet(keyHash, key, value, expire, lsn)
 			if err != nil {
 				return fmt.Errorf("got error when performing SET action from wal with lsn %d: %w", lsn, err)
 			}
@@ -41,6 +41,36 @@ func (seg *segment) performUnappliedWALActions(actions []wal.Action) error {
 			if err != nil {
 				return fmt.Errorf("got error when performing DEL action from wal with lsn %d: %w", lsn, err)
 			}
+		case wal.ActionTypeExpire, wal.ActionTypeExpireMilli:
+			key := action.Key
+
+			keyHash := hash(key)
+
+			// The expire change may be lost from the file, then the item is expired on disk, but it's still loaded.
+			// So the item is found whatever its expire time is
+			offsetInfo, kve, err := seg.rawFindStoredItem(keyHash, key, true)
+			// if error is not found, then this is okay cause
+			// the key might have been deleted, when the action was reapplied
+			if errors.Is(err, ErrNotFound) {
+				break SWITCH
+			}
+			if err != nil {
+				return fmt.Errorf("got error when performing EXPIRE action from wal with lsn %d: %w", lsn, err)
+			}
+
+			seg.rawWriteExpire(keyHash, offsetInfo, kve, action.Expire)
+		case wal.ActionTypeBatch:
+			// the first part of the batch always belongs to this segment
+			// other parts are recovered by the DB, when all segments are opened
+			err := seg.rawApplyBatchActions(action.Batch[0].Actions, lsn)
+			if err != nil {
+				return fmt.Errorf("got error when performing BATCH action from wal with lsn %d: %w", lsn, err)
+			}
+
+			seg.recoveredBatches = append(seg.recoveredBatches, action.Batch)
+		case wal.ActionTypeTimeMark:
+			// time mark doesn't change data and has the LSN of the next action
+			continue
 		default:
 			return fmt.Errorf("unknown action type %d", action.Type)
 		}
@@ -55,3 +85,94 @@ func (seg *segment) performUnappliedWALActions(actions []wal.Action) error {
 
 	return nil
 }
+
+// rawApplyBatchActions applies batch's set and del actions, which belong to this segment.
+// lsn is the LSN of the batch in this segment's WAL. It's used as a version for all set items.
+// Zero lsn means working without WAL, then each item gets the next segment's version
+func (seg *segment) rawApplyBatchActions(actions []wal.Action, lsn uint64) error {
+	for _, action := range actions {
+		keyHash := hash(action.Key)
+
+		switch action.Type {
+		case wal.ActionTypeSet, wal.ActionTypeSetMilli:
+			version := lsn
+			if version == 0 {
+				version = seg.rawNextVersion()
+			}
+
+			err := seg.rawSet(keyHash, action.Key, action.Value, action.Expire, version)
+			if err != nil {
+				return err
+			}
+		case wal.ActionTypeDel:
+			err := seg.rawDelete(keyHash, action.Key)
+			// deleting a not existing key in a batch is not an error
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown batch's action type %d", action.Type)
+		}
+	}
+
+	return nil
+}
+
+// RecoverBatchPart applies the part of a batch recovered from another segment's WAL,
+// if this segment has not seen the batch yet. This happens when the program stopped in the middle of committing the batch
+func (seg *segment) RecoverBatchPart(part wal.BatchPart) error {
+	seg.mtx.Lock()
+	defer seg.mtx.Unlock()
+
+	if seg.closed {
+		return ErrClosed
+	}
+
+	// LSN for the batch was reserved in this segment's WAL before appending it to any WAL.
+	// If segment has already applied this LSN, then the batch was appended to this segment's WAL too
+	if seg.lastKnownLSN >= part.LSN {
+		return nil
+	}
+
+	err := seg.rawApplyBatchActions(part.Actions, part.LSN)
+	if err != nil {
+		return err
+	}
+
+	err = seg.rawWriteLastKnownLSN(part.LSN)
+	if err != nil {
+		return err
+	}
+
+	if seg.wal != nil {
+		// LSN for the batch was reserved in this WAL, so usually the part can be appended to keep WAL's history complete
+		if seg.wal.LastLSN()+1 == part.LSN {
+			_, err = seg.wal.AppendBatch([]wal.BatchPart{part})
+			if err != nil {
+				return err
+			}
+		} else {
+			seg.wal.AdvanceLSN(part.LSN)
+		}
+	}
+
+	// the batch is not in this segment's WAL, so it must be persisted right now
+	seg.rawFsync()
+
+	return nil
+}
+
+// FinishBatchesRecovery is called when all batches found in this segment's WAL are recovered in other segments.
+// Now it's safe to create a new checkpoint and truncate the WAL
+func (seg *segment) FinishBatchesRecovery() {
+	seg.mtx.Lock()
+	defer seg.mtx.Unlock()
+
+	if seg.closed {
+		return
+	}
+
+	seg.recoveredBatches = nil
+
+	seg.rawFsync()
+}
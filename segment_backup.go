@@ -0,0 +1,97 @@
+package zapp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/Kurt212/zapp/wal"
+)
+
+// rawWriteBackup copies the segment's data file to w.
+// The data file already contains all applied changes, so the copy doesn't need the WAL.
+// Segment's last version is written to the copy's header, because in the file it's updated only on fsync.
+// The caller must hold at least the segment's read lock, so that the file is not changed while copying
+func (seg *segment) rawWriteBackup(w io.Writer) error {
+	fileHeaderBuffer := make([]byte, segmentFileHeaderSize)
+
+	_, err := seg.file.ReadAt(fileHeaderBuffer, 0)
+	if err != nil {
+		return fmt.Errorf("can not read segment's file header: %w", err)
+	}
+
+	if seg.layout.HasVersions() {
+		binary.BigEndian.PutUint64(
+			fileHeaderBuffer[segmentFileLastVersionOffset:segmentFileLastVersionOffset+segmentFileLastVersionSize],
+			seg.lastVersion,
+		)
+	}
+
+	_, err = w.Write(fileHeaderBuffer)
+	if err != nil {
+		return err
+	}
+
+	itemsReader := io.NewSectionReader(seg.file, segmentFileHeaderSize, seg.fileSizeBytes-segmentFileHeaderSize)
+
+	_, err = io.Copy(w, itemsReader)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// rawWALActionsSince returns all WAL's actions applied after lsn.
+// Returns ErrWALHistoryReleased, if some of them are not kept in WAL anymore
+func (seg *segment) rawWALActionsSince(lsn uint64) ([]wal.Action, error) {
+	if seg.wal == nil {
+		return nil, ErrIncrementalBackupWithoutWAL
+	}
+
+	if lsn > seg.lastKnownLSN {
+		return nil, fmt.Errorf("%w: lsn %d is greater than the last applied lsn %d", ErrBackupChainBroken, lsn, seg.lastKnownLSN)
+	}
+
+	if lsn < seg.wal.ReleasedLSN() {
+		return nil, ErrWALHistoryReleased
+	}
+
+	actions, err := seg.wal.ActionsSince(lsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// actions of pending writes are not applied yet, they belong to the next backup
+	for i, action := range actions {
+		if action.LSN > seg.lastKnownLSN {
+			return actions[:i], nil
+		}
+	}
+
+	return actions, nil
+}
+
+// ReleaseWALHistory removes WAL's actions up to lsn, which are kept for incremental backups.
+// Actions, which are not persisted in the segment's file yet, are kept anyway
+func (seg *segment) ReleaseWALHistory(lsn uint64) error {
+	seg.mtx.Lock()
+	defer seg.mtx.Unlock()
+
+	if seg.closed {
+		return ErrClosed
+	}
+
+	if seg.wal == nil {
+		return nil
+	}
+
+	// make sure that all applied actions are persisted, so that they are not needed for recovery
+	seg.rawFsync()
+
+	if lsn > seg.lastKnownLSN {
+		lsn = seg.lastKnownLSN
+	}
+
+	return seg.wal.ReleaseHistory(lsn)
+}
@@ -0,0 +1,66 @@
+package zapp
+
+import (
+	"fmt"
+
+	"github.com/Kurt212/zapp/blob"
+)
+
+// unmarshalItem unmarshals and verifies the whole blob of a live item
+func (seg *segment) unmarshalItem(offset int64, buffer []byte) (blob.KVE, error) {
+	headerSize := seg.layout.HeaderSize()
+
+	header := blob.UnmarshalHeader(buffer[:headerSize], seg.layout)
+
+	return seg.unmarshalItemBody(offset, header, buffer[headerSize:])
+}
+
+// rawDeletedHeader reads the header and the body of the blob at offset and returns the header
+// with the deleted status and the checksum of the deleted blob.
+// Returns false, if the header's lengths don't fit the blob, then the blob is detected as corrupted anyway
+func (seg *segment) rawDeletedHeader(offset int64) (blob.Header, bool) {
+	headerSize := seg.layout.HeaderSize()
+
+	headerBuffer := make([]byte, headerSize)
+
+	_, err := seg.file.ReadAt(headerBuffer, offset)
+	if err != nil {
+		panic(fmt.Errorf("tried to read item's header at offset %d but got error: %w", offset, err))
+	}
+
+	header := blob.UnmarshalHeader(headerBuffer, seg.layout)
+	if !header.FitsSize(seg.layout) {
+		return header, false
+	}
+
+	body := make([]byte, int(header.KeyLen)+int(header.ValLen))
+
+	_, err = seg.file.ReadAt(body, offset+int64(headerSize))
+	if err != nil {
+		panic(fmt.Errorf("tried to read item's body at offset %d but got error: %w", offset, err))
+	}
+
+	kve := blob.UnmarshalBody(body, header)
+
+	header.Status = blob.StatusDeleted
+	header.Checksum = blob.Checksum(header, kve.Value, kve.Key, seg.layout)
+
+	return header, true
+}
+
+// unmarshalItemBody unmarshals and verifies the body of a live item's blob.
+// Returns ErrCorruptedItem, if the header's lengths don't fit the blob or the checksum doesn't match.
+// Layouts before version 5 don't have checksums, so only the lengths are checked
+func (seg *segment) unmarshalItemBody(offset int64, header blob.Header, body []byte) (blob.KVE, error) {
+	if !header.FitsSize(seg.layout) {
+		return blob.KVE{}, fmt.Errorf("%w: item's length at offset %d doesn't fit its size", ErrCorruptedItem, offset)
+	}
+
+	kve := blob.UnmarshalBody(body, header)
+
+	if !blob.IsChecksumValid(header, kve, seg.layout) {
+		return blob.KVE{}, fmt.Errorf("%w: item's checksum at offset %d doesn't match", ErrCorruptedItem, offset)
+	}
+
+	return kve, nil
+}
@@ -1,9 +1,15 @@
 package zapp
 
 import (
+	"sort"
 	"time"
 )
 
+const (
+	collectExpiredItemsBatchSize   = 1024                   // max number of expired items collected under a single lock
+	collectExpiredItemsMaxDuration = 500 * time.Microsecond // max time of holding the lock while collecting expired items
+)
+
 func (seg *segment) collectExpiredItemsLoop(
 	tickDelay time.Duration,
 ) {
@@ -24,32 +30,88 @@ func (seg *segment) collectExpiredItemsLoop(
 	}
 }
 
+// collectExpiredItems collects all expired items in small increments.
+// The segment's lock is released between increments, so that reads and writes are not blocked for long
 func (seg *segment) collectExpiredItems() {
-	// here visit all items on disk
-	// check their TTL
-	// in case an item is expired mark delete it from inmemory state
+	for {
+		seg.mtx.Lock()
 
-	seg.mtx.Lock()
-	defer seg.mtx.Unlock()
+		if seg.closed {
+			seg.mtx.Unlock()
+			return
+		}
 
-	if seg.closed {
-		return
-	}
+		hasMore := seg.rawCollectExpiredItems()
 
-	seg.rawCollectExpiredItems()
+		seg.mtx.Unlock()
+
+		if !hasMore {
+			return
+		}
+	}
 }
 
-func (seg *segment) rawCollectExpiredItems() {
-	now := time.Now()
+// rawCollectExpiredItems removes expired items from inmemory state, marks their blobs as deleted on disk
+// and marks their offsets as empty.
+// Only the items, which really expired, are visited, because they are taken from the top of the expire index.
+// A single call collects at most collectExpiredItemsBatchSize items and stops after collectExpiredItemsMaxDuration.
+// Returns true if there may be more expired items to collect.
+//
+// Marking expired blobs as deleted is not logged to WAL. Expiration is deterministic:
+// an expired item can not become alive again, so reapplying WAL after a crash gives the same logical state
+// whether the deleted status reached the disk or not.
+//
+// Items with pending writes are skipped. Their writes were accepted, while the items were alive,
+// so they must be applied to the items first
+func (seg *segment) rawCollectExpiredItems() bool {
+	startTime := time.Now()
 
-	for hash, offsets := range seg.hashToOffsetMap {
-		for _, offsetInfo := range offsets {
-			if !offsetInfo.IsExpired(now) {
-				continue
-			}
+	var expiredEntries, pendingEntries []expireIndexEntry
 
-			// find the item by hash in inmemory state and mark it as empty offset
-			seg.rawDeleteOffsetFromMemory(hash, offsetInfo)
+	hasMore := true
+
+	for len(expiredEntries) < collectExpiredItemsBatchSize {
+		entry, ok := seg.expireIndex.Min()
+		if !ok || !entry.info.IsExpired(startTime) {
+			hasMore = false
+			break
+		}
+
+		seg.expireIndex.Untrack(entry.info.offset)
+
+		if seg.pendingHashes[entry.hash] > 0 {
+			pendingEntries = append(pendingEntries, entry)
+			continue
+		}
+
+		expiredEntries = append(expiredEntries, entry)
+
+		if time.Since(startTime) >= collectExpiredItemsMaxDuration {
+			break
 		}
 	}
+
+	// they are collected after their pending writes are applied
+	for _, entry := range pendingEntries {
+		seg.expireIndex.Track(entry.hash, entry.info)
+	}
+
+	// only pending items are left, they can't be collected until their writes are applied
+	if len(expiredEntries) == 0 {
+		hasMore = false
+	}
+
+	// write to the file in the order of offsets, so that the disk is accessed sequentially
+	sort.Slice(expiredEntries, func(i, j int) bool {
+		return expiredEntries[i].info.offset < expiredEntries[j].info.offset
+	})
+
+	for _, entry := range expiredEntries {
+		// find the item by hash in inmemory state and mark it as empty offset
+		if seg.rawDeleteOffsetFromMemory(entry.hash, entry.info) {
+			seg.rawWriteDeletedStatus(entry.info.offset)
+		}
+	}
+
+	return hasMore
 }
@@ -0,0 +1,228 @@
+package zapp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	compactFileSuffix = ".compact" // the new file is written next to the segment's file and then replaces it
+)
+
+func (seg *segment) compactLoop(checkPeriod time.Duration, threshold float64) {
+	// zero values mean user wants to disable automatic compaction
+	if checkPeriod == 0 || threshold == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(checkPeriod)
+
+	for {
+		select {
+		case <-ticker.C:
+			seg.compactIfFragmented(threshold)
+		case <-seg.closedChan:
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// compactIfFragmented compacts the segment, if the share of free space in its file reaches threshold
+func (seg *segment) compactIfFragmented(threshold float64) {
+	seg.mtx.Lock()
+	defer seg.mtx.Unlock()
+
+	if seg.closed {
+		return
+	}
+
+	if seg.rawFragmentation() < threshold {
+		return
+	}
+
+	// on error the segment keeps working with the old file, next check will try again
+	_ = seg.rawCompact()
+}
+
+// Compact rewrites segment's live items densely into a new file and atomically replaces the old file with it
+func (seg *segment) Compact() error {
+	seg.mtx.Lock()
+	defer seg.mtx.Unlock()
+
+	if seg.closed {
+		return ErrClosed
+	}
+
+	return seg.rawCompact()
+}
+
+// Fragmentation returns the share of free space in segment's file, from 0 to 1
+func (seg *segment) Fragmentation() (float64, error) {
+	seg.mtx.RLock()
+	defer seg.mtx.RUnlock()
+
+	if seg.closed {
+		return 0, ErrClosed
+	}
+
+	return seg.rawFragmentation(), nil
+}
+
+// rawFragmentation returns the share of free space in segment's file.
+// Expired items, which are not collected yet, are not counted as free space
+func (seg *segment) rawFragmentation() float64 {
+	itemsSize := seg.fileSizeBytes - segmentFileHeaderSize
+	if itemsSize == 0 {
+		return 0
+	}
+
+	return float64(seg.freeSlots.TotalSize()) / float64(itemsSize)
+}
+
+// rawCompact writes live items one after another into a new file in the order of their offsets,
+// so that cursor based scans still see the items in the same order.
+// Expired items are dropped. The file's layout, last version and last known LSN are kept,
+// so WAL doesn't notice the change. The new file replaces the old one by rename.
+//
+// The old file is synced before compaction. If the process crashes before rename is persisted,
+// then the old file is still complete and WAL is not needed to recover it. The directory is synced after rename,
+// so that later checkpoints never truncate WAL, while the old file may still come back.
+// Errors before rename leave the segment untouched
+func (seg *segment) rawCompact() error {
+	seg.rawFsync()
+
+	compactPath := seg.filePath + compactFileSuffix
+
+	newFile, err := os.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("can not create compacted file %s: %w", compactPath, err)
+	}
+
+	hashToOffsetMap, fileSizeBytes, err := seg.rawWriteCompactedFile(newFile)
+	if err == nil {
+		err = newFile.Sync()
+	}
+	if err == nil {
+		err = os.Rename(compactPath, seg.filePath)
+	}
+	if err != nil {
+		newFile.Close()
+		os.Remove(compactPath)
+		return fmt.Errorf("can not compact segment's file: %w", err)
+	}
+
+	// the rename must be persisted before WAL's checkpoints rely on the new file
+	err = syncDir(filepath.Dir(seg.filePath))
+	if err != nil {
+		panic(fmt.Errorf("tried to sync segment's directory after compaction, but got error: %w", err))
+	}
+
+	err = seg.file.Close()
+	if err != nil {
+		panic(fmt.Errorf("tried to close segment's old file after compaction, but got error: %w", err))
+	}
+
+	seg.file = newFile
+	seg.fileSizeBytes = fileSizeBytes
+	seg.preallocatedEnd = fileSizeBytes
+	seg.hashToOffsetMap = hashToOffsetMap
+	seg.freeSlots = newFreeSlots()
+	seg.holesToPunch = nil
+	seg.splitSlots = nil
+	seg.rawNextGeneration()
+
+	seg.expireIndex = newExpireIndex()
+	for hash, offsets := range hashToOffsetMap {
+		for _, offsetInfo := range offsets {
+			seg.expireIndex.Track(hash, offsetInfo)
+		}
+	}
+
+	return nil
+}
+
+// rawWriteCompactedFile writes file's header and live items to newFile.
+// Returns the new in memory state of the items and the size of the written file
+func (seg *segment) rawWriteCompactedFile(newFile *os.File) (map[uint32][]itemMetaInfo, int64, error) {
+	type hashAndInfo struct {
+		hash uint32
+		info itemMetaInfo
+	}
+
+	now := time.Now()
+
+	var items []hashAndInfo
+	for hash, offsets := range seg.hashToOffsetMap {
+		for _, offsetInfo := range offsets {
+			if offsetInfo.IsExpired(now) {
+				continue
+			}
+
+			items = append(items, hashAndInfo{hash: hash, info: offsetInfo})
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].info.offset < items[j].info.offset
+	})
+
+	fileHeaderBuffer := make([]byte, segmentFileHeaderSize)
+
+	_, err := seg.file.ReadAt(fileHeaderBuffer, 0)
+	if err != nil {
+		return nil, 0, fmt.Errorf("can not read segment's file header: %w", err)
+	}
+
+	if seg.layout.HasVersions() {
+		binary.BigEndian.PutUint64(
+			fileHeaderBuffer[segmentFileLastVersionOffset:segmentFileLastVersionOffset+segmentFileLastVersionSize],
+			seg.lastVersion,
+		)
+	}
+
+	binary.BigEndian.PutUint64(fileHeaderBuffer[segmentFileLastKnownLSNOffset:], seg.lastKnownLSN)
+
+	writer := bufio.NewWriter(newFile)
+
+	_, err = writer.Write(fileHeaderBuffer)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hashToOffsetMap := make(map[uint32][]itemMetaInfo, len(seg.hashToOffsetMap))
+	offset := int64(segmentFileHeaderSize)
+
+	for _, item := range items {
+		blobBuffer := make([]byte, item.info.size)
+
+		_, err := seg.file.ReadAt(blobBuffer, item.info.offset)
+		if err != nil {
+			return nil, 0, fmt.Errorf("tried to read item's data at offset %d but got error: %w", item.info.offset, err)
+		}
+
+		_, err = writer.Write(blobBuffer)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		offsetInfo := item.info
+		offsetInfo.offset = offset
+
+		hashToOffsetMap[item.hash] = append(hashToOffsetMap[item.hash], offsetInfo)
+
+		offset += int64(item.info.size)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return hashToOffsetMap, offset, nil
+}
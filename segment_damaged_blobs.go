@@ -0,0 +1,67 @@
+package zapp
+
+import (
+	"fmt"
+
+	"github.com/Kurt212/zapp/wal"
+)
+
+// damagedBlob is a live item's blob, which didn't pass verification on load.
+// Usually it's a blob, which was written only partially, because the file was not synced before a crash
+type damagedBlob struct {
+	offset  int64
+	size    int
+	version uint64
+	tail    bool // the blob is cut by the end of the file
+}
+
+// replayFromLSN returns the LSN, after which WAL's actions must be reapplied.
+// The actions, which have written damaged blobs, are reapplied as well as all actions after them
+func replayFromLSN(lastKnownLSN uint64, damagedBlobs []damagedBlob) uint64 {
+	lsn := lastKnownLSN
+
+	for _, damaged := range damagedBlobs {
+		if damaged.version > 0 && damaged.version-1 < lsn {
+			lsn = damaged.version - 1
+		}
+	}
+
+	return lsn
+}
+
+// rawFreeDamagedBlobs turns damaged blobs into free slots, if their items are restored by reapplying WAL's actions.
+// An item is restored, only if the action, which has written its blob, is still in WAL.
+// Otherwise the item is lost and ErrCorruptedItem is returned
+func (seg *segment) rawFreeDamagedBlobs(damagedBlobs []damagedBlob, actions []wal.Action) error {
+	writtenVersions := make(map[uint64]struct{}, len(actions))
+
+	for _, action := range actions {
+		switch action.Type {
+		case wal.ActionTypeSet, wal.ActionTypeSetMilli, wal.ActionTypeBatch:
+			writtenVersions[action.LSN] = struct{}{}
+		}
+	}
+
+	for _, damaged := range damagedBlobs {
+		if _, ok := writtenVersions[damaged.version]; !ok || damaged.version == 0 {
+			return fmt.Errorf("%w: item at offset %d can not be recovered from WAL", ErrCorruptedItem, damaged.offset)
+		}
+	}
+
+	for _, damaged := range damagedBlobs {
+		if damaged.tail {
+			// the partial blob is the last one, so the file ends right before it
+			err := seg.file.Truncate(damaged.offset)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		seg.rawWriteDeletedStatus(damaged.offset)
+		seg.rawFreeSlot(damaged.offset, damaged.size)
+	}
+
+	return nil
+}
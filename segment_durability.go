@@ -0,0 +1,50 @@
+package zapp
+
+// rawUnloggedSet sets the key without appending to WAL.
+// With WAL the item's version is still a new LSN, so that versions are never given twice
+func (seg *segment) rawUnloggedSet(hash uint32, key []byte, value []byte, expire int64) error {
+	// previous writes of the key must not be applied after this one
+	seg.rawApplyPendingWritesOf(hash)
+
+	version := seg.rawNextVersion()
+	if seg.wal != nil {
+		version = seg.rawSkipWALLSN()
+	}
+
+	return seg.rawSet(hash, key, value, expire, version)
+}
+
+// rawUnloggedDelete deletes the key without appending to WAL
+func (seg *segment) rawUnloggedDelete(hash uint32, key []byte) error {
+	seg.rawApplyPendingWritesOf(hash)
+
+	if seg.wal != nil {
+		seg.rawSkipWALLSN()
+	}
+
+	return seg.rawDelete(hash, key)
+}
+
+// rawSkipWALLSN takes the next WAL's LSN for the write, which is not appended to WAL.
+// WAL's history is not complete without the write, so it's considered released.
+// The last known LSN is not changed, because WAL's actions before the write must still be reapplied after a crash
+func (seg *segment) rawSkipWALLSN() uint64 {
+	lsn := seg.wal.LastLSN() + 1
+
+	seg.wal.AdvanceLSN(lsn)
+
+	return lsn
+}
+
+// keepsWALHistory tells if WAL's history is needed by incremental backups or WAL archive.
+// Writes not appended to WAL would make the history incomplete, so they are not allowed then
+func (seg *segment) keepsWALHistory() bool {
+	return seg.retainWALHistory || seg.walArchivePath != ""
+}
+
+// rawSyncFileForMode syncs the segment's file, if the sync mode requires it
+func (seg *segment) rawSyncFileForMode(sync SyncMode) {
+	if sync == SyncAlways || (sync == SyncWAL && seg.wal == nil) {
+		seg.rawSyncFile()
+	}
+}
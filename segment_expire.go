@@ -0,0 +1,146 @@
+package zapp
+
+import (
+	"fmt"
+
+	"github.com/Kurt212/zapp/blob"
+)
+
+// GetExpire returns key's expire timestamp in unix milliseconds. Zero value means that the key has no expiration time
+func (seg *segment) GetExpire(hash uint32, key []byte) (int64, error) {
+	seg.mtx.RLock()
+	defer seg.mtx.RUnlock()
+
+	if seg.closed {
+		return 0, ErrClosed
+	}
+
+	kve, err := seg.rawReadItem(hash, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return kve.Expire, nil
+}
+
+// SetExpire changes only the expire timestamp of an existing key. Zero expire removes key's expiration time.
+// The value is not rewritten, only the expire field in blob's header is updated in place.
+// The key's version is not changed
+func (seg *segment) SetExpire(hash uint32, key []byte, expire int64) error {
+	write, err := seg.setExpire(hash, key, expire)
+	if err != nil {
+		return err
+	}
+
+	seg.waitApplied(write, SyncDefault)
+
+	return nil
+}
+
+// setExpire changes the expire timestamp under the lock. With WAL it returns the pending write, which is applied after WAL's sync
+func (seg *segment) setExpire(hash uint32, key []byte, expire int64) (*pendingWrite, error) {
+	seg.mtx.Lock()
+	defer seg.mtx.Unlock()
+
+	if seg.closed {
+		return nil, ErrClosed
+	}
+
+	// if wal manager field is nil, then do nothing with the WAL logic and work without it
+	if seg.wal == nil {
+		return nil, seg.rawSetExpire(hash, key, expire)
+	}
+
+	// check that the key exists before appending to WAL
+	kve, err := seg.rawCurrentItem(hash, key)
+	if err != nil {
+		return nil, err
+	}
+
+	lsn, err := seg.wal.AppendExpire(key, expire)
+	if err != nil {
+		panic(fmt.Errorf("got error when append expire action to WAL: %w", err))
+	}
+
+	kve.Expire = expire
+
+	write := seg.rawAddPendingItem(lsn, hash, pendingItem{kve: kve}, func() error {
+		// the key existed, when the change was accepted. It may have expired since then, but expired items
+		// with pending writes are not collected, so it's still stored. Just like WAL's replay, the change brings it back
+		offsetInfo, kve, err := seg.rawFindStoredItem(hash, key, true)
+		if err != nil {
+			return err
+		}
+
+		seg.rawWriteExpire(hash, offsetInfo, kve, expire)
+
+		return nil
+	})
+
+	return write, nil
+}
+
+func (seg *segment) rawSetExpire(hash uint32, key []byte, expire int64) error {
+	offsetInfo, kve, err := seg.rawFindItem(hash, key)
+	if err != nil {
+		return err
+	}
+
+	seg.rawWriteExpire(hash, offsetInfo, kve, expire)
+
+	return nil
+}
+
+// rawWriteExpire writes the new expire of the item to its blob's header and updates in memory state
+func (seg *segment) rawWriteExpire(hash uint32, offsetInfo itemMetaInfo, kve blob.KVE, expire int64) {
+	if seg.layout.HasChecksums() {
+		// the checksum covers expire, so the whole header is rewritten
+		seg.rawWriteItemHeader(offsetInfo, kve, expire)
+	} else {
+		expireBuffer := blob.AppendExpire(nil, expire, seg.layout)
+
+		_, err := seg.file.WriteAt(expireBuffer, offsetInfo.offset+blob.ExpireOffset)
+		if err != nil {
+			panic(fmt.Errorf(
+				"tried to write expire at offset %d but got error: %w",
+				offsetInfo.offset+blob.ExpireOffset,
+				err,
+			))
+		}
+	}
+
+	offsetsWithCurrentHash := seg.hashToOffsetMap[hash]
+
+	for idx := range offsetsWithCurrentHash {
+		if offsetsWithCurrentHash[idx].offset == offsetInfo.offset {
+			offsetsWithCurrentHash[idx].expireTime = expire
+
+			seg.expireIndex.Track(hash, offsetsWithCurrentHash[idx])
+		}
+	}
+}
+
+// rawWriteItemHeader writes the header of the live item with a new expire and a new checksum
+func (seg *segment) rawWriteItemHeader(offsetInfo itemMetaInfo, kve blob.KVE, expire int64) {
+	sizeClass, _ := blob.SizeClassOf(offsetInfo.size, seg.layout)
+
+	header := blob.Header{
+		SizeClass: sizeClass,
+		Status:    blob.StatusOK,
+		KeyLen:    uint16(len(kve.Key)),
+		ValLen:    uint32(len(kve.Value)),
+		Expire:    expire,
+		Version:   kve.Version,
+	}
+
+	header.Checksum = blob.Checksum(header, kve.Value, kve.Key, seg.layout)
+
+	_, err := seg.file.WriteAt(blob.MarshalHeader(header, seg.layout), offsetInfo.offset)
+	if err != nil {
+		panic(fmt.Errorf(
+			"tried to write item's header at offset %d but got error: %w",
+			offsetInfo.offset,
+			err,
+		))
+	}
+}
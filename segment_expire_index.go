@@ -0,0 +1,102 @@
+package zapp
+
+import (
+	"container/heap"
+)
+
+// expireIndex is a mutable min-heap of segment's items, which have expiration time.
+// The item, which expires first, is always on top. So collecting expired items touches only the items,
+// which really expired, instead of visiting all segment's items.
+// Items are identified by their offsets, because each offset in segment's file holds at most one live item.
+// expireIndex is not safe for concurrent use. It's guarded by segment's lock
+type expireIndex struct {
+	entries   []expireIndexEntry
+	positions map[int64]int // item's offset to its position in entries
+}
+
+type expireIndexEntry struct {
+	hash uint32
+	info itemMetaInfo
+}
+
+func newExpireIndex() *expireIndex {
+	return &expireIndex{
+		positions: make(map[int64]int),
+	}
+}
+
+// Track adds the item to the index or updates its expiration time, if the item is already tracked.
+// The item without expiration time is removed from the index
+func (idx *expireIndex) Track(hash uint32, info itemMetaInfo) {
+	if info.expireTime == 0 {
+		idx.Untrack(info.offset)
+		return
+	}
+
+	entry := expireIndexEntry{
+		hash: hash,
+		info: info,
+	}
+
+	if position, ok := idx.positions[info.offset]; ok {
+		idx.entries[position] = entry
+		heap.Fix(idx, position)
+		return
+	}
+
+	heap.Push(idx, entry)
+}
+
+// Untrack removes the item at offset from the index. Does nothing if the item is not tracked
+func (idx *expireIndex) Untrack(offset int64) {
+	position, ok := idx.positions[offset]
+	if !ok {
+		return
+	}
+
+	heap.Remove(idx, position)
+}
+
+// Min returns the item, which expires first. Returns false if the index is empty
+func (idx *expireIndex) Min() (expireIndexEntry, bool) {
+	if len(idx.entries) == 0 {
+		return expireIndexEntry{}, false
+	}
+
+	return idx.entries[0], true
+}
+
+// Len, Less, Swap, Push and Pop implement heap.Interface. Don't call Push and Pop directly, use Track and Untrack
+
+func (idx *expireIndex) Len() int {
+	return len(idx.entries)
+}
+
+func (idx *expireIndex) Less(i, j int) bool {
+	return idx.entries[i].info.expireTime < idx.entries[j].info.expireTime
+}
+
+func (idx *expireIndex) Swap(i, j int) {
+	idx.entries[i], idx.entries[j] = idx.entries[j], idx.entries[i]
+
+	idx.positions[idx.entries[i].info.offset] = i
+	idx.positions[idx.entries[j].info.offset] = j
+}
+
+func (idx *expireIndex) Push(x any) {
+	entry := x.(expireIndexEntry)
+
+	idx.positions[entry.info.offset] = len(idx.entries)
+	idx.entries = append(idx.entries, entry)
+}
+
+func (idx *expireIndex) Pop() any {
+	lastIdx := len(idx.entries) - 1
+
+	entry := idx.entries[lastIdx]
+
+	idx.entries = idx.entries[:lastIdx]
+	delete(idx.positions, entry.info.offset)
+
+	return entry
+}
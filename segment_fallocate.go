@@ -0,0 +1,76 @@
+package zapp
+
+// hole is an empty blob, which body's disk blocks are deallocated on the next sync of the segment's file
+type hole struct {
+	offset int64
+	size   int
+}
+
+// rawSchedulePunchHole remembers the empty blob, if it's large enough to deallocate its body's disk blocks.
+// The body may be deallocated on disk before the blob's deleted or merged header reaches the disk,
+// then a crash would leave a live header with a zeroed body or no header at all.
+// So holes are punched only after the segment's file is synced
+func (seg *segment) rawSchedulePunchHole(offset int64, size int) {
+	if seg.punchHoleMinSize <= 0 || size < seg.punchHoleMinSize {
+		return
+	}
+
+	seg.holesToPunch = append(seg.holesToPunch, hole{offset: offset, size: size})
+}
+
+// rawPunchScheduledHoles punches holes in empty blobs, which headers are synced already.
+// Blobs, which were taken or merged with their neighbours since then, are skipped
+func (seg *segment) rawPunchScheduledHoles() {
+	holes := seg.holesToPunch
+	seg.holesToPunch = nil
+
+	for _, h := range holes {
+		if seg.freeSlots.Contains(h.offset, h.size) {
+			seg.rawPunchHole(h.offset, h.size)
+		}
+	}
+}
+
+// rawPunchHole deallocates disk blocks of the empty blob's body, if the blob is large enough.
+// The blob's header is kept, so the file can still be visited blob by blob and the offset can be reused.
+// Punching holes is an optimization, so if the filesystem doesn't support it, then it's just disabled
+func (seg *segment) rawPunchHole(offset int64, size int) {
+	if seg.punchHoleMinSize <= 0 || size < seg.punchHoleMinSize {
+		return
+	}
+
+	headerSize := int64(seg.layout.HeaderSize())
+
+	err := punchHole(seg.file, offset+headerSize, int64(size)-headerSize)
+	if err != nil {
+		seg.punchHoleMinSize = 0
+	}
+}
+
+// rawPreallocate allocates disk blocks for size bytes appended at the end of the file.
+// Blocks are allocated by chunks, so that the file is less fragmented on disk.
+// The file's size is not changed, so preallocated space is not visible to the segment.
+// Preallocation is an optimization, so if the filesystem doesn't support it, then it's just disabled
+func (seg *segment) rawPreallocate(size int) {
+	if seg.preallocateChunkSize <= 0 {
+		return
+	}
+
+	end := seg.fileSizeBytes + int64(size)
+	if end <= seg.preallocatedEnd {
+		return
+	}
+
+	chunkSize := seg.preallocateChunkSize
+	if int64(size) > chunkSize {
+		chunkSize = int64(size)
+	}
+
+	err := preallocate(seg.file, seg.fileSizeBytes, chunkSize)
+	if err != nil {
+		seg.preallocateChunkSize = 0
+		return
+	}
+
+	seg.preallocatedEnd = seg.fileSizeBytes + chunkSize
+}
@@ -0,0 +1,107 @@
+//go:build linux
+
+package zapp
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentFallocate(t *testing.T) {
+	diskUsage := func(t *testing.T, path string) int64 {
+		stat, err := os.Stat(path)
+		require.NoError(t, err)
+
+		return stat.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+
+	t.Run("punch holes in large empty blobs", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		segment, err := newSegment(dataFile, nil, 0, 0, withPunchHoles(1<<20))
+		require.NoError(t, err)
+
+		defer segment.Close()
+
+		largeValue := bytes.Repeat([]byte("a"), 4<<20)
+
+		large := []byte("large")
+		err = segment.Set(hash(large), large, largeValue, 0)
+		require.NoError(t, err)
+
+		small := []byte("small")
+		err = segment.Set(hash(small), small, []byte("value"), 0)
+		require.NoError(t, err)
+
+		segment.fsync()
+
+		usageBefore := diskUsage(t, dataFile.Name())
+
+		err = segment.Delete(hash(large), large)
+		require.NoError(t, err)
+
+		// the hole is punched only after the deleted header is synced
+		require.Equal(t, usageBefore, diskUsage(t, dataFile.Name()))
+
+		segment.fsync()
+
+		if segment.punchHoleMinSize == 0 {
+			t.Skip("filesystem doesn't support punching holes")
+		}
+
+		require.Less(t, diskUsage(t, dataFile.Name()), usageBefore-(3<<20))
+
+		// the empty blob's offset is reused
+		sizeBefore := segment.fileSizeBytes
+
+		err = segment.Set(hash(large), large, largeValue, 0)
+		require.NoError(t, err)
+
+		require.Equal(t, sizeBefore, segment.fileSizeBytes)
+
+		value, err := segment.Get(hash(large), large)
+		require.NoError(t, err)
+		require.Equal(t, largeValue, value)
+
+		value, err = segment.Get(hash(small), small)
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+	})
+
+	t.Run("preallocate keeps file's size", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		segment, err := newSegment(dataFile, nil, 0, 0, withPreallocation(1<<20))
+		require.NoError(t, err)
+
+		defer segment.Close()
+
+		key := []byte("key")
+		err = segment.Set(hash(key), key, []byte("value"), 0)
+		require.NoError(t, err)
+
+		if segment.preallocateChunkSize == 0 {
+			t.Skip("filesystem doesn't support preallocation")
+		}
+
+		require.Equal(t, segmentFileHeaderSize+(1<<20), int(segment.preallocatedEnd))
+
+		stat, err := os.Stat(dataFile.Name())
+		require.NoError(t, err)
+		require.Equal(t, segment.fileSizeBytes, stat.Size())
+
+		value, err := segment.Get(hash(key), key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+	})
+}
@@ -0,0 +1,317 @@
+package zapp
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Kurt212/zapp/blob"
+)
+
+// freeSlots keeps offsets of empty blobs grouped by blobs' sizes.
+// When a key is deleted or expired, its blob becomes empty and its space is reused later to store new data.
+// Slots are also indexed by their offsets and ends, so that neighbour slots are found quickly.
+// freeSlots is not safe for concurrent use. It's guarded by segment's lock
+type freeSlots struct {
+	bySize       map[int]map[int64]struct{}
+	sizeByOffset map[int64]int
+	offsetByEnd  map[int64]int64
+}
+
+func newFreeSlots() *freeSlots {
+	return &freeSlots{
+		bySize:       make(map[int]map[int64]struct{}),
+		sizeByOffset: make(map[int64]int),
+		offsetByEnd:  make(map[int64]int64),
+	}
+}
+
+func (fs *freeSlots) Add(offset int64, size int) {
+	offsets, ok := fs.bySize[size]
+	if !ok {
+		offsets = make(map[int64]struct{})
+		fs.bySize[size] = offsets
+	}
+
+	offsets[offset] = struct{}{}
+
+	fs.sizeByOffset[offset] = size
+	fs.offsetByEnd[offset+int64(size)] = offset
+}
+
+// Remove removes the slot. Returns false if there's no such slot
+func (fs *freeSlots) Remove(offset int64, size int) bool {
+	if !fs.Contains(offset, size) {
+		return false
+	}
+
+	offsets := fs.bySize[size]
+
+	delete(offsets, offset)
+
+	if len(offsets) == 0 {
+		delete(fs.bySize, size)
+	}
+
+	delete(fs.sizeByOffset, offset)
+	delete(fs.offsetByEnd, offset+int64(size))
+
+	return true
+}
+
+func (fs *freeSlots) Contains(offset int64, size int) bool {
+	slotSize, ok := fs.sizeByOffset[offset]
+	return ok && slotSize == size
+}
+
+// At returns the size of the slot at offset. Returns false if there's no such slot
+func (fs *freeSlots) At(offset int64) (int, bool) {
+	size, ok := fs.sizeByOffset[offset]
+	return size, ok
+}
+
+// EndingAt returns the slot, which ends right before end. Returns false if there's no such slot
+func (fs *freeSlots) EndingAt(end int64) (offset int64, size int, ok bool) {
+	offset, ok = fs.offsetByEnd[end]
+	if !ok {
+		return 0, 0, false
+	}
+
+	return offset, fs.sizeByOffset[offset], true
+}
+
+// Take finds a slot of exactly this size, which is not lower than minOffset, and removes it.
+// Returns false if there's no such slot
+func (fs *freeSlots) Take(size int, minOffset int64) (int64, bool) {
+	for offset := range fs.bySize[size] {
+		if offset < minOffset {
+			continue
+		}
+
+		fs.Remove(offset, size)
+
+		return offset, true
+	}
+
+	return 0, false
+}
+
+// Sizes returns sizes of all slots in ascending order
+func (fs *freeSlots) Sizes() []int {
+	sizes := make([]int, 0, len(fs.bySize))
+	for size := range fs.bySize {
+		sizes = append(sizes, size)
+	}
+
+	sort.Ints(sizes)
+
+	return sizes
+}
+
+func (fs *freeSlots) Len() int {
+	return len(fs.sizeByOffset)
+}
+
+// TotalSize returns the sum of all slots' sizes
+func (fs *freeSlots) TotalSize() int64 {
+	var total int64
+	for size, offsets := range fs.bySize {
+		total += int64(size) * int64(len(offsets))
+	}
+
+	return total
+}
+
+// rawFreeSlot adds the empty blob to free slots and merges it with its free neighbours.
+// The merged blob gets a new empty header on disk, so that the file can still be visited blob by blob
+func (seg *segment) rawFreeSlot(offset int64, size int) {
+	var mergedOffset int64
+	var mergedSize int
+
+	if seg.layout.HasSizeClasses() {
+		mergedOffset, mergedSize = seg.rawMergeNeighbourSlots(offset, size)
+	} else {
+		mergedOffset, mergedSize = seg.rawMergeBuddySlots(offset, size)
+	}
+
+	if mergedSize != size {
+		seg.rawWriteEmptyHeader(mergedOffset, mergedSize)
+	}
+
+	seg.freeSlots.Add(mergedOffset, mergedSize)
+
+	seg.rawSchedulePunchHole(mergedOffset, mergedSize)
+}
+
+// rawMergeBuddySlots merges the empty blob with its buddy, if the buddy is free as well. Used with power of two sizes.
+// The buddy of a blob of size S at relative offset O is the blob of size S at relative offset O xor S.
+// It's always the neighbour blob right before or right after this one. Offsets are relative to the end of the file's header.
+// Merged blobs are merged further with their buddies. Returns the merged blob
+func (seg *segment) rawMergeBuddySlots(offset int64, size int) (int64, int) {
+	for {
+		relativeOffset := offset - segmentFileHeaderSize
+		buddyOffset := (relativeOffset ^ int64(size)) + segmentFileHeaderSize
+
+		if !seg.freeSlots.Remove(buddyOffset, size) {
+			return offset, size
+		}
+
+		if buddyOffset < offset {
+			offset = buddyOffset
+		}
+
+		size *= 2
+	}
+}
+
+// rawMergeNeighbourSlots merges the empty blob with free blobs right before and right after it,
+// if the merged size is one of the layout's size classes. Used with size classes. Returns the merged blob
+func (seg *segment) rawMergeNeighbourSlots(offset int64, size int) (int64, int) {
+	for {
+		merged := false
+
+		previousOffset, previousSize, ok := seg.freeSlots.EndingAt(offset)
+		if ok && blob.IsClassSize(previousSize+size, seg.layout) {
+			seg.freeSlots.Remove(previousOffset, previousSize)
+
+			offset = previousOffset
+			size += previousSize
+			merged = true
+		}
+
+		nextSize, ok := seg.freeSlots.At(offset + int64(size))
+		if ok && blob.IsClassSize(size+nextSize, seg.layout) {
+			seg.freeSlots.Remove(offset+int64(size), nextSize)
+
+			size += nextSize
+			merged = true
+		}
+
+		if !merged {
+			return offset, size
+		}
+	}
+}
+
+// rawTakeEmptyOffset finds an empty offset of needed size, which is not lower than minOffset,
+// and removes it from free slots. Returns 0 if there's no free slot of exactly this size.
+// Then the smallest greater slot is scheduled to be split on the next sync of the segment's file, see rawScheduleSplit
+func (seg *segment) rawTakeEmptyOffset(size int, minOffset int64) int64 {
+	for _, slotSize := range seg.freeSlots.Sizes() {
+		if slotSize < size || !seg.rawCanSplitSlot(slotSize, size) {
+			continue
+		}
+
+		// a single slot is enough, until the scheduled one is split
+		if slotSize > size && seg.rawHasScheduledSplit(size) {
+			return 0
+		}
+
+		offset, ok := seg.freeSlots.Take(slotSize, minOffset)
+		if !ok {
+			continue
+		}
+
+		if slotSize > size {
+			seg.rawScheduleSplit(offset, slotSize, size)
+
+			return 0
+		}
+
+		return offset
+	}
+
+	return 0
+}
+
+// splitSlot is a free slot, which is split on the next sync of the segment's file.
+// The first part of size becomes a free slot of its own
+type splitSlot struct {
+	offset   int64
+	slotSize int
+	size     int
+}
+
+// rawScheduleSplit removes the slot from use until the next sync of the segment's file and writes headers of its rest parts.
+// A new blob written to the first part is shorter than the slot, so the file is read past it right to the rest's headers.
+// If the blob reached the disk before them, a crash would leave old bytes in their place.
+// The old slot's header still covers the rest's headers, so they are harmless until the first part gets its own header
+func (seg *segment) rawScheduleSplit(offset int64, slotSize int, size int) {
+	if seg.layout.HasSizeClasses() {
+		seg.rawWriteEmptyHeader(offset+int64(size), slotSize-size)
+	} else {
+		// power of two slot is split in halves. The first half is split further, the second one becomes free
+		for halfSize := slotSize / 2; halfSize >= size; halfSize /= 2 {
+			seg.rawWriteEmptyHeader(offset+int64(halfSize), halfSize)
+		}
+	}
+
+	seg.splitSlots = append(seg.splitSlots, splitSlot{offset: offset, slotSize: slotSize, size: size})
+}
+
+// rawHasScheduledSplit tells if a slot is already being split to get a free slot of size
+func (seg *segment) rawHasScheduledSplit(size int) bool {
+	for _, split := range seg.splitSlots {
+		if split.size == size {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rawSplitScheduledSlots splits slots, which rest's headers are synced already, and makes all their parts free.
+// Headers of the first parts reach the disk not later than the next sync. Until then a crash leaves the old slot's headers,
+// which hide items written to the rest parts, but they are still in WAL
+func (seg *segment) rawSplitScheduledSlots() {
+	splits := seg.splitSlots
+	seg.splitSlots = nil
+
+	for _, split := range splits {
+		seg.rawWriteEmptyHeader(split.offset, split.size)
+
+		if seg.layout.HasSizeClasses() {
+			seg.rawFreeSlot(split.offset+int64(split.size), split.slotSize-split.size)
+		} else {
+			for halfSize := split.slotSize / 2; halfSize >= split.size; halfSize /= 2 {
+				seg.freeSlots.Add(split.offset+int64(halfSize), halfSize)
+			}
+		}
+
+		// added after the rest, so that they are not merged back
+		seg.freeSlots.Add(split.offset, split.size)
+	}
+}
+
+// rawCanSplitSlot tells if a blob of size can be taken from a free slot of slotSize.
+// Power of two slots can always be split in halves. With size classes the rest of the slot must be a size class itself
+func (seg *segment) rawCanSplitSlot(slotSize int, size int) bool {
+	if slotSize == size || !seg.layout.HasSizeClasses() {
+		return true
+	}
+
+	restSize := slotSize - size
+
+	return restSize >= seg.layout.HeaderSize() && blob.IsClassSize(restSize, seg.layout)
+}
+
+// rawWriteEmptyHeader writes the header of an empty blob of size at offset.
+// The header carries segment's last version, because versions of blobs, which are overwritten by it, are lost.
+// On load the greatest version of all blobs is taken, so it must not decrease
+func (seg *segment) rawWriteEmptyHeader(offset int64, size int) {
+	sizeClass, _ := blob.SizeClassOf(size, seg.layout)
+
+	header := blob.MarshalHeader(blob.Header{
+		SizeClass: sizeClass,
+		Status:    blob.StatusDeleted,
+		Version:   seg.lastVersion,
+	}, seg.layout)
+
+	_, err := seg.file.WriteAt(header, offset)
+	if err != nil {
+		panic(fmt.Errorf(
+			"tried to write empty blob's header at offset %d but got error: %w",
+			offset,
+			err,
+		))
+	}
+}
@@ -23,11 +23,53 @@ func (s *segment) fsyncLoop(syncInterval time.Duration) {
 	}
 }
 
+// rawSyncFile persists the segment's file without creating a new checkpoint in WAL
+func (s *segment) rawSyncFile() {
+	err := s.rawWriteLastVersion()
+	if err != nil {
+		panic(fmt.Errorf("tried to write last version to segment's file, but got error: %w", err))
+	}
+
+	// WAL's actions must be on disk before the segment's file, which has them applied
+	if s.wal != nil {
+		err = s.wal.Sync()
+		if err != nil {
+			panic(fmt.Errorf("tried to sync WAL, but got error: %w", err))
+		}
+	}
+
+	err = s.file.Sync()
+	if err != nil {
+		panic(fmt.Errorf("tried to fsync segment's file, but got error: %w", err))
+	}
+}
+
+// walSyncLoop syncs WAL's records, which writes don't wait for. A power loss loses records up to the interval.
+// The segment's lock is not taken, so writers are not blocked by the sync
+func (s *segment) walSyncLoop(syncInterval time.Duration) {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := s.wal.Sync()
+			if err != nil {
+				panic(fmt.Errorf("tried to sync WAL, but got error: %w", err))
+			}
+
+			s.applySyncedWrites()
+		case <-s.closedChan:
+			return
+		}
+	}
+}
+
 // fsync runs the process of persisting segment's file to disk
 // The generic problem of all databases is that raw writing to underlying hardware is too expensive.
 // OS buffers file changes implicitly and asynchronosly transfers the buffer to the hardware.
 // Zapp uses Write Ahead Logging (WAL) to achieve consistency and durability.
-// Each Write to data generates a new entry, which is appended to WAL and persisted to real disk hardware synchronosly.
+// Each Write to data generates a new entry, which is appended to WAL and persisted to real disk hardware before the write returns.
 // Segment's file contains the Recent Log Sequence Number (LSN) at the beginning header, which refers to one of the real existing WAL entries.
 // Periodically segments file needs to be persisted to the hardware explicitly so that it is guaranteed, that a new checkpoint in WAL file can be created.
 // Once the segment's file is persisted, the WAL file may be truncated because it's safe to loose actios, which are persisted to disk in segments.
@@ -44,14 +86,32 @@ func (s *segment) fsync() {
 }
 
 func (s *segment) rawFsync() {
-	err := s.file.Sync()
-	if err != nil {
-		panic(fmt.Errorf("tried to fsync segment's file, but got error: %w", err))
-	}
+	// WAL is truncated by the checkpoint, so all its actions must be applied to the segment's file first
+	s.rawApplyPendingWrites()
+
+	// free space at the end of the file is cheap to return to the filesystem without compaction
+	s.rawTruncateFreeTail()
+
+	s.rawSyncFile()
+
+	// headers of empty blobs are on disk now, so their bodies can be deallocated
+	s.rawPunchScheduledHoles()
+
+	// headers of split slots' rest parts are on disk now, so the first parts may be written.
+	// It's done after punching holes, because merged rest parts must be synced first
+	s.rawSplitScheduledSlots()
+
+	var err error
 
 	// we support working without WAL at all, so this is okay
-	if s.wal != nil {
-		err = s.wal.Checkpoint()
+	// WAL can not be truncated, while batches found in it are not recovered in all other segments
+	// WAL's history may be retained for incremental backups
+	if s.wal != nil && len(s.recoveredBatches) == 0 && !s.retainWALHistory {
+		if s.walArchivePath != "" {
+			err = s.wal.ArchiveAndCheckpoint(s.walArchivePath, s.walArchivePrefix)
+		} else {
+			err = s.wal.Checkpoint()
+		}
 		if err != nil {
 			panic(fmt.Errorf("can not create new checkpoint in WAL: %w", err))
 		}
@@ -1,6 +1,7 @@
 package zapp
 
 import (
+	"fmt"
 	"io"
 	"os"
 
@@ -13,6 +14,16 @@ import (
 // the function returns last offset in file where it stopped. By default the returned offset is the end of the file.
 func (s *segment) visitOnDiskItems(
 	visitorFunc func(file *os.File, offset int64, header blob.Header) error,
+) (lastOffset int64, _ error) {
+	// the beginning of the first item on dist is at fixed offset after file header bytes
+	return s.visitOnDiskItemsFrom(segmentFileHeaderSize, visitorFunc)
+}
+
+// visitOnDiskItemsFrom works just like visitOnDiskItems, but starts visiting from the item at startOffset.
+// startOffset must point to the beginning of some item on disk
+func (s *segment) visitOnDiskItemsFrom(
+	startOffset int64,
+	visitorFunc func(file *os.File, offset int64, header blob.Header) error,
 ) (lastOffset int64, _ error) {
 	// calling function must aquire segment's mutex itself, if needed
 	// this function is too low level
@@ -21,12 +32,13 @@ func (s *segment) visitOnDiskItems(
 	// if you need to access item's value or key, you must read it from file yourself
 	// by default only item's header is read and passed to the visitor function
 
-	// the beginning of the first item on dist is at fixed offset after file header bytes
-	currentOffset := int64(segmentFileHeaderSize)
+	currentOffset := startOffset
+
+	headerSize := s.layout.HeaderSize()
 
 	for {
 		// read fixed sized header
-		blobHeaderBuffer := make([]byte, blob.HeaderSize)
+		blobHeaderBuffer := make([]byte, headerSize)
 
 		_, err := s.file.ReadAt(blobHeaderBuffer, currentOffset)
 		if err != nil {
@@ -37,10 +49,15 @@ func (s *segment) visitOnDiskItems(
 			return currentOffset, err
 		}
 
-		blobHeader := blob.UnmarshalHeader(blobHeaderBuffer)
+		blobHeader := blob.UnmarshalHeader(blobHeaderBuffer, s.layout)
 
 		blobSize := blobHeader.Size()
 
+		// a corrupted header may have garbage size, so visiting can not go on
+		if blobSize < headerSize {
+			return currentOffset, fmt.Errorf("%w: blob's size at offset %d is too small", ErrCorruptedItem, currentOffset)
+		}
+
 		// pass all needed data to visitor function, so it can do whatever it wants with this item
 		// if visitor function return an error, finish visiting process and return the error
 		// when the error happens, return current item's offset at which the error happend.
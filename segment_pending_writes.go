@@ -0,0 +1,235 @@
+package zapp
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/Kurt212/zapp/blob"
+)
+
+// With WAL a write is applied to the segment's file only after its WAL's action is synced to disk.
+// Otherwise a crash could leave the segment's file with a change, which is missing in WAL.
+// Writers append their actions to WAL under the segment's lock and put their writes to the pending writes.
+// Then they wait for WAL's sync without the lock, so that concurrent writers share a single sync.
+// Synced writes are applied in the order of their LSNs by the first writer, which takes the lock again.
+// With WAL's sync interval writers don't wait for the sync. Their writes are applied after the background sync.
+// Each single key's write keeps the key's item, as it is after the write, so reads of the key are served from it
+// without waiting for the sync. Writers check their conditions against these items as well.
+// Batches are applied before they return, so they don't keep items.
+
+// pendingWrite is a write, which is appended to WAL, but is not applied to the segment's file yet
+type pendingWrite struct {
+	lsn     uint64       // LSN of the write's WAL action
+	hashes  []uint32     // hashes of the keys changed by the write
+	apply   func() error // applies the write to the segment's file and in memory state
+	applied bool
+	item    *pendingItem // the key's item after a single key's write. Nil for batches
+}
+
+// pendingItem is the key's item after a pending write
+type pendingItem struct {
+	kve     blob.KVE
+	deleted bool
+}
+
+// rawAddPendingWrite puts the write, which WAL's action has lsn, to the pending writes
+func (seg *segment) rawAddPendingWrite(lsn uint64, hashes []uint32, apply func() error) *pendingWrite {
+	write := &pendingWrite{
+		lsn:    lsn,
+		hashes: hashes,
+		apply:  apply,
+	}
+
+	seg.pendingWrites = append(seg.pendingWrites, write)
+
+	for _, hash := range hashes {
+		seg.pendingHashes[hash]++
+	}
+
+	return write
+}
+
+// rawAddPendingItem puts the single key's write to the pending writes.
+// item is the key's item after the write, it's returned by reads until the write is applied
+func (seg *segment) rawAddPendingItem(lsn uint64, hash uint32, item pendingItem, apply func() error) *pendingWrite {
+	write := seg.rawAddPendingWrite(lsn, []uint32{hash}, apply)
+	write.item = &item
+
+	seg.pendingItems[string(item.kve.Key)] = write
+
+	return write
+}
+
+// rawCurrentItem finds not expired key's item including pending writes of the key.
+// Writers use it, because their writes are applied after all pending writes
+func (seg *segment) rawCurrentItem(hash uint32, key []byte) (blob.KVE, error) {
+	write, ok := seg.pendingItems[string(key)]
+	if !ok {
+		return seg.rawGetItem(hash, key)
+	}
+
+	if write.item.deleted || write.item.kve.IsExpired(time.Now()) {
+		return blob.KVE{}, ErrNotFound
+	}
+
+	// the value is returned to the caller, who may change it
+	kve := write.item.kve
+	kve.Value = bytes.Clone(kve.Value)
+
+	return kve, nil
+}
+
+// rawReadItem finds not expired key's item for readers.
+// With WAL's sync interval writes return before they are applied, so pending writes are read as well.
+// Otherwise pending writes have not returned yet and they may still be lost, so they are not visible
+func (seg *segment) rawReadItem(hash uint32, key []byte) (blob.KVE, error) {
+	if seg.walSyncInterval > 0 {
+		return seg.rawCurrentItem(hash, key)
+	}
+
+	return seg.rawGetItem(hash, key)
+}
+
+// rawApplySyncedWrites applies pending writes, which WAL's actions are synced, in the order of their LSNs.
+// The last known LSN is written after the writes are applied
+func (seg *segment) rawApplySyncedWrites() {
+	syncedLSN := seg.wal.SyncedLSN()
+
+	appliedCount := 0
+
+	for _, write := range seg.pendingWrites {
+		if write.lsn > syncedLSN {
+			break
+		}
+
+		err := write.apply()
+		if err != nil {
+			panic(fmt.Errorf("got error when applying write with lsn %d: %w", write.lsn, err))
+		}
+
+		write.applied = true
+
+		for _, hash := range write.hashes {
+			seg.pendingHashes[hash]--
+			if seg.pendingHashes[hash] == 0 {
+				delete(seg.pendingHashes, hash)
+			}
+		}
+
+		// a later write of the key keeps its own item
+		if write.item != nil && seg.pendingItems[string(write.item.kve.Key)] == write {
+			delete(seg.pendingItems, string(write.item.kve.Key))
+		}
+
+		appliedCount++
+	}
+
+	if appliedCount == 0 {
+		return
+	}
+
+	lsn := seg.pendingWrites[appliedCount-1].lsn
+
+	seg.pendingWrites = append(seg.pendingWrites[:0], seg.pendingWrites[appliedCount:]...)
+
+	err := seg.rawWriteLastKnownLSN(lsn)
+	if err != nil {
+		panic(fmt.Errorf("got error when trying to write last known LSN %d to segment: %w", lsn, err))
+	}
+}
+
+// rawApplyPendingWrites waits until all pending writes are synced to WAL and applies them.
+// The lock is held during the sync, so it's used only when the segment's state must include all writes
+func (seg *segment) rawApplyPendingWrites() {
+	if len(seg.pendingWrites) == 0 {
+		return
+	}
+
+	err := seg.wal.WaitSynced(seg.pendingWrites[len(seg.pendingWrites)-1].lsn)
+	if err != nil {
+		panic(fmt.Errorf("got error when syncing WAL: %w", err))
+	}
+
+	seg.rawApplySyncedWrites()
+}
+
+// rawApplyPendingWritesOf applies all pending writes, if some of them change a key with the hash.
+// It's used before reading the key's state under the write lock
+func (seg *segment) rawApplyPendingWritesOf(hash uint32) {
+	if seg.pendingHashes[hash] > 0 {
+		seg.rawApplyPendingWrites()
+	}
+}
+
+// waitApplied blocks until the pending write is synced to WAL and applied, if the sync mode requires it.
+// The segment's lock must not be held, so that concurrent writers append their actions meanwhile and share a single WAL's sync.
+// Nil write means that the write is already applied
+func (seg *segment) waitApplied(write *pendingWrite, sync SyncMode) {
+	if write == nil {
+		return
+	}
+
+	// with the sync interval WAL is synced by the background process, unless the write asks to wait
+	if sync == SyncDefault && seg.walSyncInterval > 0 {
+		return
+	}
+
+	err := seg.wal.WaitSynced(write.lsn)
+	if err != nil {
+		panic(fmt.Errorf("got error when syncing WAL: %w", err))
+	}
+
+	seg.mtx.Lock()
+	defer seg.mtx.Unlock()
+
+	// Close applies all pending writes
+	if seg.closed {
+		return
+	}
+
+	if !write.applied {
+		seg.rawApplySyncedWrites()
+	}
+
+	if sync == SyncAlways {
+		seg.rawSyncFile()
+	}
+}
+
+// applySyncedWrites applies pending writes, which are synced by the background WAL's sync
+func (seg *segment) applySyncedWrites() {
+	seg.mtx.Lock()
+	defer seg.mtx.Unlock()
+
+	if seg.closed {
+		return
+	}
+
+	seg.rawApplySyncedWrites()
+}
+
+// rLockApplied takes the read lock for reading the segment's file directly, like scans and backups do.
+// With WAL's sync interval writes may have returned before they are applied, so they are applied first.
+// WAL's sync is waited for without the lock, so writers are not blocked by it.
+// Writes made meanwhile may be left pending, they are concurrent with the reader
+func (seg *segment) rLockApplied() {
+	seg.mtx.RLock()
+
+	if seg.walSyncInterval == 0 || len(seg.pendingWrites) == 0 {
+		return
+	}
+
+	lsn := seg.pendingWrites[len(seg.pendingWrites)-1].lsn
+
+	seg.mtx.RUnlock()
+
+	err := seg.wal.WaitSynced(lsn)
+	if err != nil {
+		panic(fmt.Errorf("got error when syncing WAL: %w", err))
+	}
+
+	seg.applySyncedWrites()
+
+	seg.mtx.RLock()
+}
@@ -0,0 +1,216 @@
+package zapp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Kurt212/zapp/blob"
+)
+
+// errStopVisiting is returned by visitor functions to stop visiting on disk items early.
+// It never leaves the segment
+var errStopVisiting = errors.New("stop visiting")
+
+// Scan calls fn for every live and not expired item stored in the segment.
+// The whole segment's file is walked under the read lock, so the segment's items are seen as a consistent snapshot.
+// Writers of this segment wait until the walk is finished. Readers are not blocked.
+// If fn returns false, then Scan stops and returns false as well
+func (seg *segment) Scan(fn func(key, value []byte, expire int64) bool) (bool, error) {
+	seg.rLockApplied()
+	defer seg.mtx.RUnlock()
+
+	if seg.closed {
+		return false, ErrClosed
+	}
+
+	return seg.rawScan(fn)
+}
+
+func (seg *segment) rawScan(fn func(key, value []byte, expire int64) bool) (bool, error) {
+	_, err := seg.rawScanFrom(segmentFileHeaderSize, fn)
+	if errors.Is(err, errStopVisiting) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ScanPage collects up to count live and not expired items, starting from the item at startOffset.
+// The read lock is held only while the page is collected, so writers can make progress between pages.
+// Returns the offset to continue scanning from and the segment's generation, which the offset belongs to.
+// Zero next offset means that the end of the segment is reached.
+// startOffset lower than the file's header size means the beginning of the segment.
+// If the segment was compacted or truncated after startOffset was returned, or the empty blob at startOffset was merged
+// with its neighbour, then startOffset may point to the middle of some item, so the segment is scanned from the beginning.
+// The generation wraps around within scan cursor's bits, so an old cursor may get the current generation again.
+// Such a cursor's offset is greater, than all offsets handed out in the current generation, then ErrInvalidCursor is returned.
+// The first page sees all writes returned before it. Writes made during the scan may be seen or not
+func (seg *segment) ScanPage(startOffset int64, generation uint16, count int) (_ []Item, nextOffset int64, nextGeneration uint16, _ error) {
+	if startOffset < segmentFileHeaderSize {
+		seg.rLockApplied()
+	} else {
+		seg.mtx.RLock()
+	}
+	defer seg.mtx.RUnlock()
+
+	if seg.closed {
+		return nil, 0, 0, ErrClosed
+	}
+
+	if startOffset >= segmentFileHeaderSize && generation == seg.generation && startOffset > seg.scannedEnd.Load() {
+		return nil, 0, 0, ErrInvalidCursor
+	}
+
+	if startOffset < segmentFileHeaderSize || generation != seg.generation || !seg.rawIsBlobOffset(startOffset) {
+		startOffset = segmentFileHeaderSize
+	}
+
+	var items []Item
+
+	fn := func(key, value []byte, expire int64) bool {
+		items = append(items, Item{
+			Key:      key,
+			Value:    value,
+			ExpireAt: expireToTime(expire),
+		})
+
+		return len(items) < count
+	}
+
+	nextOffset, err := seg.rawScanFrom(startOffset, fn)
+	if errors.Is(err, errStopVisiting) {
+		// the page is full, but the end of the file may be reached already
+		if nextOffset >= seg.fileSizeBytes {
+			nextOffset = 0
+		}
+
+		seg.noteScannedOffset(nextOffset)
+
+		return items, nextOffset, seg.generation, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return items, 0, seg.generation, nil
+}
+
+// noteScannedOffset remembers the offset handed out to a scan cursor.
+// Pages are collected under the read lock concurrently, so the greatest offset is updated atomically
+func (seg *segment) noteScannedOffset(offset int64) {
+	for {
+		scannedEnd := seg.scannedEnd.Load()
+		if offset <= scannedEnd || seg.scannedEnd.CompareAndSwap(scannedEnd, offset) {
+			return
+		}
+	}
+}
+
+// rawNextGeneration invalidates all offsets handed out to scan cursors.
+// The generation wraps around within the bits, which scan cursors have for it.
+// Handed out offsets are forgotten, so that cursors of the wrapped generation are detected by ScanPage
+func (seg *segment) rawNextGeneration() {
+	seg.generation = (seg.generation + 1) & scanCursorGenerationMask
+	seg.scannedEnd.Store(0)
+}
+
+// rawScanFrom visits items starting from startOffset and calls fn for each live item.
+// If fn returns false, then errStopVisiting is returned with the offset of the next item after the last visited one
+func (seg *segment) rawScanFrom(
+	startOffset int64,
+	fn func(key, value []byte, expire int64) bool,
+) (nextOffset int64, _ error) {
+	now := time.Now()
+
+	headerSize := seg.layout.HeaderSize()
+
+	visitorFunc := func(file *os.File, currentOffset int64, blobHeader blob.Header) error {
+		// deleted and expired blobs are not visible to the users
+		if blobHeader.Status != blob.StatusOK || blobHeader.IsExpired(now) {
+			return nil
+		}
+
+		bodySize := blobHeader.Size() - headerSize
+
+		blobBodyBuffer := make([]byte, bodySize)
+
+		_, err := file.ReadAt(blobBodyBuffer, currentOffset+int64(headerSize))
+		if err != nil {
+			return fmt.Errorf("tried to read item's body at offset %d but got error: %w", currentOffset, err)
+		}
+
+		kve, err := seg.unmarshalItemBody(currentOffset, blobHeader, blobBodyBuffer)
+		if err != nil {
+			return err
+		}
+
+		if !fn(kve.Key, kve.Value, kve.Expire) {
+			nextOffset = currentOffset + int64(blobHeader.Size())
+			return errStopVisiting
+		}
+
+		return nil
+	}
+
+	_, err := seg.visitOnDiskItemsFrom(startOffset, visitorFunc)
+	if err != nil {
+		return nextOffset, err
+	}
+
+	return 0, nil
+}
+
+// rawIsBlobOffset tells if some blob starts at offset. It's true if offset belongs to a free slot or to an item of
+// in memory state. The end of the file is a valid offset as well
+func (seg *segment) rawIsBlobOffset(offset int64) bool {
+	if offset >= seg.fileSizeBytes {
+		return true
+	}
+
+	headerSize := seg.layout.HeaderSize()
+
+	blobHeaderBuffer := make([]byte, headerSize)
+
+	_, err := seg.file.ReadAt(blobHeaderBuffer, offset)
+	if err != nil {
+		return false
+	}
+
+	blobHeader := blob.UnmarshalHeader(blobHeaderBuffer, seg.layout)
+
+	blobSize := blobHeader.Size()
+
+	if int64(blobSize) > seg.fileSizeBytes-offset || blobSize < headerSize {
+		return false
+	}
+
+	if seg.freeSlots.Contains(offset, blobSize) {
+		return true
+	}
+
+	if blobHeader.Status != blob.StatusOK || int(blobHeader.KeyLen)+int(blobHeader.ValLen) > blobSize-headerSize {
+		return false
+	}
+
+	blobBodyBuffer := make([]byte, blobSize-headerSize)
+
+	_, err = seg.file.ReadAt(blobBodyBuffer, offset+int64(headerSize))
+	if err != nil {
+		return false
+	}
+
+	kve := blob.UnmarshalBody(blobBodyBuffer, blobHeader)
+
+	for _, offsetInfo := range seg.hashToOffsetMap[hash(kve.Key)] {
+		if offsetInfo.offset == offset {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,11 +2,14 @@ package zapp
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/Kurt212/zapp/blob"
 	"github.com/Kurt212/zapp/constants"
 	"github.com/Kurt212/zapp/wal"
 	"github.com/stretchr/testify/require"
@@ -196,14 +199,14 @@ func TestOpenFromExistingSegmentFiles(t *testing.T) {
 				Type:   wal.ActionTypeSet,
 				Key:    []byte("key1"),
 				Value:  []byte("value1"),
-				Expire: uint32(expiredTime.Unix()),
+				Expire: expiredTime.UnixMilli(),
 				LSN:    1,
 			},
 			{
 				Type:   wal.ActionTypeSet,
 				Key:    []byte("key2"),
 				Value:  []byte("value2"),
-				Expire: uint32(notExpiredTime.Unix()),
+				Expire: notExpiredTime.UnixMilli(),
 				LSN:    2,
 			},
 		}
@@ -1059,7 +1062,7 @@ func TestWritesAndDeletes(t *testing.T) {
 		now := time.Now()
 		expireTime := now.Add(-time.Second) // already expired
 
-		err = segment.Set(hash(key), key, value, uint32(expireTime.Unix()))
+		err = segment.Set(hash(key), key, value, expireTime.UnixMilli())
 		require.NoError(t, err)
 
 		// run delete expired items
@@ -1176,7 +1179,7 @@ func TestWorkWithoutWAL(t *testing.T) {
 		now := time.Now()
 		expiredTime := now.Add(-time.Hour)
 
-		err = segment.Set(hash(key), key, value, uint32(expiredTime.Unix()))
+		err = segment.Set(hash(key), key, value, expiredTime.UnixMilli())
 		require.NoError(t, err)
 
 		segment.rawCollectExpiredItems()
@@ -1186,3 +1189,1051 @@ func TestWorkWithoutWAL(t *testing.T) {
 		require.ErrorIs(t, err, ErrNotFound)
 	})
 }
+
+func TestSegmentVersions(t *testing.T) {
+	t.Run("layout version 1 has no versions", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		err = makeSegment(dataFile, map[string]v{
+			"key1": {value: []byte("value1")},
+		})
+		require.NoError(t, err)
+
+		segment, err := newSegment(dataFile, nil, time.Hour, time.Hour)
+		require.NoError(t, err)
+
+		defer segment.Close()
+
+		key := []byte("key1")
+
+		_, _, err = segment.GetVersioned(hash(key), key)
+		require.ErrorIs(t, err, ErrVersionsNotSupported)
+
+		// usual operations still work
+		err = segment.Set(hash(key), key, []byte("value2"), 0)
+		require.NoError(t, err)
+
+		value, err := segment.Get(hash(key), key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("value2"), value)
+	})
+
+	t.Run("wal replay gives the same versions", func(t *testing.T) {
+		dir := os.TempDir()
+
+		dataFile, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		walFile, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(walFile.Name())
+
+		err = makeWAL(walFile, []wal.Action{
+			{Type: wal.ActionTypeSet, Key: []byte("key1"), Value: []byte("value1"), LSN: 1},
+			{Type: wal.ActionTypeSet, Key: []byte("key2"), Value: []byte("value2"), LSN: 2},
+			{Type: wal.ActionTypeSet, Key: []byte("key1"), Value: []byte("value3"), LSN: 3},
+		})
+		require.NoError(t, err)
+
+		segment, err := newSegment(dataFile, walFile, time.Hour, time.Hour)
+		require.NoError(t, err)
+
+		defer segment.Close()
+
+		key := []byte("key1")
+
+		value, version, err := segment.GetVersioned(hash(key), key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("value3"), value)
+		require.Equal(t, uint64(3), version)
+
+		require.Equal(t, uint64(3), segment.lastVersion)
+	})
+}
+
+func TestSegmentExpire(t *testing.T) {
+	t.Run("restore expire from wal", func(t *testing.T) {
+		dir := os.TempDir()
+
+		dataFile, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		walFile, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(walFile.Name())
+
+		expire := time.Now().Add(time.Hour).UnixMilli()
+
+		err = makeWAL(walFile, []wal.Action{
+			{Type: wal.ActionTypeSet, Key: []byte("key1"), Value: []byte("value1"), LSN: 1},
+			{Type: wal.ActionTypeSet, Key: []byte("key2"), Value: []byte("value2"), LSN: 2},
+			{Type: wal.ActionTypeExpireMilli, Key: []byte("key1"), Expire: expire, LSN: 3},
+			{Type: wal.ActionTypeExpireMilli, Key: []byte("key2"), Expire: time.Now().Add(-time.Hour).UnixMilli(), LSN: 4},
+			{Type: wal.ActionTypeExpireMilli, Key: []byte("key100500"), Expire: expire, LSN: 5},
+		})
+		require.NoError(t, err)
+
+		segment, err := newSegment(dataFile, walFile, time.Hour, time.Hour)
+		require.NoError(t, err)
+
+		defer segment.Close()
+
+		require.Equal(t, uint64(5), segment.lastKnownLSN)
+
+		key := []byte("key1")
+
+		actualExpire, err := segment.GetExpire(hash(key), key)
+		require.NoError(t, err)
+		require.Equal(t, expire, actualExpire)
+
+		value, err := segment.Get(hash(key), key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), value)
+
+		key = []byte("key2")
+
+		_, err = segment.Get(hash(key), key)
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("first layout keeps expire in seconds", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		expire := time.Now().Add(time.Hour).UnixMilli()
+
+		err = makeSegment(dataFile, map[string]v{
+			"key1": {value: []byte("value1"), expire: expire},
+		})
+		require.NoError(t, err)
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		defer segment.Close()
+
+		require.Equal(t, blob.LayoutVersion1, segment.layout)
+
+		key := []byte("key1")
+
+		actualExpire, err := segment.GetExpire(hash(key), key)
+		require.NoError(t, err)
+		require.Equal(t, expire/1000*1000, actualExpire)
+
+		key = []byte("key2")
+
+		err = segment.Set(hash(key), key, []byte("value2"), expire)
+		require.NoError(t, err)
+
+		actualExpire, err = segment.GetExpire(hash(key), key)
+		require.NoError(t, err)
+		require.Equal(t, expire/1000*1000, actualExpire)
+	})
+}
+
+func TestSegmentExpireIndex(t *testing.T) {
+	t.Run("collect only expired items", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		defer segment.Close()
+
+		expired := time.Now().Add(-time.Hour).UnixMilli()
+		alive := time.Now().Add(time.Hour).UnixMilli()
+
+		// more expired items than a single increment can collect
+		expiredCount := collectExpiredItemsBatchSize + 10
+
+		for i := 0; i < expiredCount; i++ {
+			key := []byte(fmt.Sprintf("expired%d", i))
+
+			err := segment.Set(hash(key), key, []byte("value"), expired)
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("alive%d", i))
+
+			err := segment.Set(hash(key), key, []byte("value"), alive)
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("persistent%d", i))
+
+			err := segment.Set(hash(key), key, []byte("value"), 0)
+			require.NoError(t, err)
+		}
+
+		// overwriting and deleting items keeps the index consistent
+		key := []byte("alive0")
+		err = segment.Set(hash(key), key, []byte("value"), 0)
+		require.NoError(t, err)
+
+		key = []byte("alive1")
+		err = segment.Delete(hash(key), key)
+		require.NoError(t, err)
+
+		key = []byte("persistent0")
+		err = segment.SetExpire(hash(key), key, expired)
+		require.NoError(t, err)
+
+		key = []byte("expired0")
+		err = segment.SetExpire(hash(key), key, 0)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		require.Equal(t, expiredCount+8+1, segment.expireIndex.Len())
+
+		segment.collectExpiredItems()
+
+		require.Equal(t, 8, segment.expireIndex.Len())
+
+		entry, ok := segment.expireIndex.Min()
+		require.True(t, ok)
+		require.Equal(t, alive, entry.info.expireTime)
+
+		itemsCount := 0
+		for _, offsets := range segment.hashToOffsetMap {
+			itemsCount += len(offsets)
+		}
+		require.Equal(t, 9+9, itemsCount)
+	})
+
+	t.Run("expire index is restored from disk", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		alive := time.Now().Add(time.Hour).UnixMilli()
+
+		err = makeSegment(dataFile, map[string]v{
+			"key1": {value: []byte("value1"), expire: alive},
+			"key2": {value: []byte("value2"), expire: alive + 1000},
+			"key3": {value: []byte("value3")},
+			"key4": {value: []byte("value4"), expire: time.Now().Add(-time.Hour).UnixMilli()},
+		})
+		require.NoError(t, err)
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		defer segment.Close()
+
+		require.Equal(t, 2, segment.expireIndex.Len())
+
+		entry, ok := segment.expireIndex.Min()
+		require.True(t, ok)
+		require.Equal(t, alive/1000*1000, entry.info.expireTime)
+	})
+
+	t.Run("expired blobs are marked deleted on disk", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		defer segment.Close()
+
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("expired%d", i))
+
+			err := segment.Set(hash(key), key, []byte("value"), time.Now().Add(-time.Hour).UnixMilli())
+			require.NoError(t, err)
+
+			key = []byte(fmt.Sprintf("alive%d", i))
+
+			err = segment.Set(hash(key), key, []byte("value"), time.Now().Add(time.Hour).UnixMilli())
+			require.NoError(t, err)
+		}
+
+		segment.collectExpiredItems()
+
+		statuses := map[blob.Status]int{}
+
+		_, err = segment.visitOnDiskItems(func(file *os.File, offset int64, header blob.Header) error {
+			statuses[header.Status]++
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, map[blob.Status]int{blob.StatusOK: 10, blob.StatusDeleted: 10}, statuses)
+	})
+}
+
+func TestSegmentCompact(t *testing.T) {
+	t.Run("compact drops deleted and expired items", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		check := func(segment *segment) {
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("key%d", i))
+
+				value, err := segment.Get(hash(key), key)
+				if i%2 == 0 || i == 1 {
+					require.ErrorIs(t, err, ErrNotFound)
+					continue
+				}
+
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("value%d", i)), value)
+			}
+		}
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+
+			err := segment.Set(hash(key), key, []byte(fmt.Sprintf("value%d", i)), 0)
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 100; i += 2 {
+			key := []byte(fmt.Sprintf("key%d", i))
+
+			err := segment.Delete(hash(key), key)
+			require.NoError(t, err)
+		}
+
+		key := []byte("key1")
+		err = segment.SetExpire(hash(key), key, time.Now().Add(-time.Hour).UnixMilli())
+		require.NoError(t, err)
+
+		fragmentation, err := segment.Fragmentation()
+		require.NoError(t, err)
+		require.InDelta(t, 0.5, fragmentation, 0.01)
+
+		sizeBefore := segment.fileSizeBytes
+
+		err = segment.Compact()
+		require.NoError(t, err)
+
+		fragmentation, err = segment.Fragmentation()
+		require.NoError(t, err)
+		require.Zero(t, fragmentation)
+
+		require.Less(t, segment.fileSizeBytes, sizeBefore/2+segmentFileHeaderSize)
+		require.Equal(t, uint16(1), segment.generation)
+		require.Equal(t, 0, segment.expireIndex.Len())
+
+		stat, err := os.Stat(dataFile.Name())
+		require.NoError(t, err)
+		require.Equal(t, segment.fileSizeBytes, stat.Size())
+
+		check(segment)
+
+		// new items are appended to the compacted file
+		key = []byte("new key")
+		err = segment.Set(hash(key), key, []byte("new value"), 0)
+		require.NoError(t, err)
+
+		segment.Close()
+
+		reopenedFile, err := os.OpenFile(dataFile.Name(), os.O_RDWR, 0644)
+		require.NoError(t, err)
+
+		reopened, err := newSegment(reopenedFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		defer reopened.Close()
+
+		check(reopened)
+
+		value, err := reopened.Get(hash(key), key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("new value"), value)
+	})
+
+	t.Run("compact keeps wal consistent", func(t *testing.T) {
+		dir := os.TempDir()
+
+		dataFile, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		walFile, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(walFile.Name())
+
+		// checkpoints truncate WAL, so it must be opened in append mode
+		walFile, err = os.OpenFile(walFile.Name(), wal.FileFlags, 0644)
+		require.NoError(t, err)
+
+		segment, err := newSegment(dataFile, walFile, 0, 0)
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+
+			err := segment.Set(hash(key), key, []byte("old"), 0)
+			require.NoError(t, err)
+
+			err = segment.Delete(hash(key), key)
+			require.NoError(t, err)
+		}
+
+		err = segment.Compact()
+		require.NoError(t, err)
+
+		key := []byte("key")
+		err = segment.Set(hash(key), key, []byte("value"), 0)
+		require.NoError(t, err)
+
+		lastKnownLSN := segment.lastKnownLSN
+
+		// simulate a crash: the set is only in WAL, the segment is not closed
+		walData, err := os.ReadFile(walFile.Name())
+		require.NoError(t, err)
+
+		restoredWAL, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(restoredWAL.Name())
+
+		_, err = restoredWAL.Write(walData)
+		require.NoError(t, err)
+
+		segment.Close()
+
+		reopenedFile, err := os.OpenFile(dataFile.Name(), os.O_RDWR, 0644)
+		require.NoError(t, err)
+
+		reopened, err := newSegment(reopenedFile, restoredWAL, 0, 0)
+		require.NoError(t, err)
+
+		defer reopened.Close()
+
+		require.Equal(t, lastKnownLSN, reopened.lastKnownLSN)
+
+		value, err := reopened.Get(hash(key), key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+
+		key = []byte("key0")
+		_, err = reopened.Get(hash(key), key)
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestSegmentTruncateFreeTail(t *testing.T) {
+	t.Run("free blobs at the end of the file are truncated", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		defer segment.Close()
+
+		var offsets []int64
+
+		for i := 0; i < 10; i++ {
+			offsets = append(offsets, segment.fileSizeBytes)
+
+			key := []byte(fmt.Sprintf("key%d", i))
+
+			err := segment.Set(hash(key), key, []byte("value"), 0)
+			require.NoError(t, err)
+		}
+
+		// the blob in the middle is not at the tail, so it stays in the file
+		for _, i := range []int{3, 7, 8, 9} {
+			key := []byte(fmt.Sprintf("key%d", i))
+
+			err := segment.Delete(hash(key), key)
+			require.NoError(t, err)
+		}
+
+		segment.fsync()
+
+		require.Equal(t, offsets[7], segment.fileSizeBytes)
+
+		// no scan cursor points to the truncated blobs, so offsets are still valid
+		require.Equal(t, uint16(0), segment.generation)
+
+		stat, err := os.Stat(dataFile.Name())
+		require.NoError(t, err)
+		require.Equal(t, offsets[7], stat.Size())
+
+		require.Equal(t, 1, segment.freeSlots.Len())
+
+		// nothing to truncate anymore
+		segment.fsync()
+
+		require.Equal(t, uint16(0), segment.generation)
+
+		key := []byte("new key")
+		err = segment.Set(hash(key), key, []byte("value"), 0)
+		require.NoError(t, err)
+
+		value, err := segment.Get(hash(key), key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+	})
+
+	t.Run("truncation below scan cursor changes generation", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		defer segment.Close()
+
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+
+			err := segment.Set(hash(key), key, []byte("value"), 0)
+			require.NoError(t, err)
+		}
+
+		_, nextOffset, generation, err := segment.ScanPage(0, 0, 8)
+		require.NoError(t, err)
+		require.NotZero(t, nextOffset)
+
+		for _, i := range []int{7, 8, 9} {
+			key := []byte(fmt.Sprintf("key%d", i))
+
+			err := segment.Delete(hash(key), key)
+			require.NoError(t, err)
+		}
+
+		segment.fsync()
+
+		require.Less(t, segment.fileSizeBytes, nextOffset)
+		require.Equal(t, generation+1, segment.generation)
+
+		// the cursor's offset is not valid anymore, so the segment is scanned from the beginning
+		items, _, _, err := segment.ScanPage(nextOffset, generation, 10)
+		require.NoError(t, err)
+		require.Len(t, items, 7)
+	})
+}
+
+func TestSegmentFreeSlots(t *testing.T) {
+	// with layout version 3 a blob of 2 bytes key and 30 bytes value takes 64 bytes, and of 100 bytes value takes 128 bytes
+	smallValue := bytes.Repeat([]byte("s"), 30)
+	mediumValue := bytes.Repeat([]byte("m"), 100)
+
+	reopen := func(t *testing.T, path string) *segment {
+		file, err := os.OpenFile(path, os.O_RDWR, 0644)
+		require.NoError(t, err)
+
+		segment, err := newSegment(file, nil, 0, 0)
+		require.NoError(t, err)
+
+		return segment
+	}
+
+	t.Run("large free slot is split in halves for smaller items", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		err = makeEmptySegment(dataFile, segmentFileLayoutVersion3)
+		require.NoError(t, err)
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		large := []byte("large")
+		err = segment.Set(hash(large), large, bytes.Repeat([]byte("l"), 4000), 0)
+		require.NoError(t, err)
+
+		last := []byte("last")
+		err = segment.Set(hash(last), last, smallValue, 0)
+		require.NoError(t, err)
+
+		err = segment.Delete(hash(large), large)
+		require.NoError(t, err)
+
+		fileSize := segment.fileSizeBytes
+
+		// the slot is split on the next sync, so the item, which needs the split, is appended
+		key := []byte("00")
+		err = segment.Set(hash(key), key, smallValue, 0)
+		require.NoError(t, err)
+
+		require.Equal(t, fileSize+64, segment.fileSizeBytes)
+
+		segment.fsync()
+
+		// 4096 bytes slot is split in halves down to 64 bytes
+		require.True(t, segment.freeSlots.Contains(segmentFileHeaderSize, 64))
+		for size := 64; size < 4096; size *= 2 {
+			require.True(t, segment.freeSlots.Contains(segmentFileHeaderSize+int64(size), size))
+		}
+
+		fileSize = segment.fileSizeBytes
+
+		// two 64 bytes slots fit two small items
+		for i := 1; i < 3; i++ {
+			key := []byte(fmt.Sprintf("%02d", i))
+
+			err := segment.Set(hash(key), key, smallValue, 0)
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, fileSize, segment.fileSizeBytes)
+		require.Equal(t, 5, segment.freeSlots.Len())
+
+		segment.Close()
+
+		// split slots' headers are written on disk, so the file is still readable blob by blob
+		reopened := reopen(t, dataFile.Name())
+		defer reopened.Close()
+
+		require.Equal(t, fileSize, reopened.fileSizeBytes)
+
+		for i := 0; i < 3; i++ {
+			key := []byte(fmt.Sprintf("%02d", i))
+
+			value, err := reopened.Get(hash(key), key)
+			require.NoError(t, err)
+			require.Equal(t, smallValue, value)
+		}
+	})
+
+	t.Run("free buddies are merged", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		err = makeEmptySegment(dataFile, segmentFileLayoutVersion3)
+		require.NoError(t, err)
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		for _, key := range []string{"k1", "k2", "k3", "k4"} {
+			err := segment.Set(hash([]byte(key)), []byte(key), smallValue, 0)
+			require.NoError(t, err)
+		}
+
+		for _, key := range []string{"k1", "k2"} {
+			err := segment.Delete(hash([]byte(key)), []byte(key))
+			require.NoError(t, err)
+		}
+
+		require.True(t, segment.freeSlots.Contains(segmentFileHeaderSize, 128))
+		require.Equal(t, 1, segment.freeSlots.Len())
+
+		// a scan cursor pointing to the merged blob is not valid anymore
+		require.True(t, segment.rawIsBlobOffset(segmentFileHeaderSize))
+		require.False(t, segment.rawIsBlobOffset(segmentFileHeaderSize+64))
+		require.True(t, segment.rawIsBlobOffset(segmentFileHeaderSize+128))
+
+		fileSize := segment.fileSizeBytes
+
+		key := []byte("k5")
+		err = segment.Set(hash(key), key, mediumValue, 0)
+		require.NoError(t, err)
+
+		require.Equal(t, fileSize, segment.fileSizeBytes)
+		require.Equal(t, 0, segment.freeSlots.Len())
+
+		err = segment.Delete(hash(key), key)
+		require.NoError(t, err)
+
+		segment.Close()
+
+		// merged blob's header is written on disk
+		reopened := reopen(t, dataFile.Name())
+		defer reopened.Close()
+
+		require.True(t, reopened.freeSlots.Contains(segmentFileHeaderSize, 128))
+		require.Equal(t, 1, reopened.freeSlots.Len())
+
+		for _, key := range []string{"k3", "k4"} {
+			value, err := reopened.Get(hash([]byte(key)), []byte(key))
+			require.NoError(t, err)
+			require.Equal(t, smallValue, value)
+		}
+	})
+}
+
+func TestSegmentSizeClasses(t *testing.T) {
+	reopen := func(t *testing.T, path string) *segment {
+		file, err := os.OpenFile(path, os.O_RDWR, 0644)
+		require.NoError(t, err)
+
+		segment, err := newSegment(file, nil, 0, 0)
+		require.NoError(t, err)
+
+		return segment
+	}
+
+	t.Run("free slot is split, if the rest is a size class", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		require.Equal(t, blob.LatestLayout, segment.layout)
+
+		// 24 bytes header + 5 bytes key + 2000 bytes value take 2048 bytes
+		large := []byte("large")
+		err = segment.Set(hash(large), large, bytes.Repeat([]byte("l"), 2000), 0)
+		require.NoError(t, err)
+
+		last := []byte("last")
+		err = segment.Set(hash(last), last, []byte("value"), 0)
+		require.NoError(t, err)
+
+		err = segment.Delete(hash(large), large)
+		require.NoError(t, err)
+
+		fileSize := segment.fileSizeBytes
+
+		// the slot is split on the next sync, so the item, which needs the split, is appended
+		appended := []byte("k0")
+		appendedValue := bytes.Repeat([]byte("0"), 1200)
+		err = segment.Set(hash(appended), appended, appendedValue, 0)
+		require.NoError(t, err)
+
+		require.Equal(t, fileSize+1280, segment.fileSizeBytes)
+
+		segment.fsync()
+
+		// 1280 bytes part leaves 768 bytes free slot
+		require.True(t, segment.freeSlots.Contains(segmentFileHeaderSize, 1280))
+		require.True(t, segment.freeSlots.Contains(segmentFileHeaderSize+1280, 768))
+
+		fileSize = segment.fileSizeBytes
+
+		values := map[string][]byte{
+			"k1": bytes.Repeat([]byte("1"), 1200),
+			"k2": bytes.Repeat([]byte("2"), 700),
+		}
+
+		for key, value := range values {
+			err := segment.Set(hash([]byte(key)), []byte(key), value, 0)
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, fileSize, segment.fileSizeBytes)
+		require.Equal(t, 0, segment.freeSlots.Len())
+
+		values[string(appended)] = appendedValue
+
+		segment.Close()
+
+		reopened := reopen(t, dataFile.Name())
+		defer reopened.Close()
+
+		require.Equal(t, fileSize, reopened.fileSizeBytes)
+
+		for key, expected := range values {
+			value, err := reopened.Get(hash([]byte(key)), []byte(key))
+			require.NoError(t, err)
+			require.Equal(t, expected, value)
+		}
+	})
+
+	t.Run("free neighbours are merged, if the merged size is a size class", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		// 24 bytes header + 2 bytes key + 10 bytes value take 40 bytes. Two of them take 80 bytes, three take 120 bytes
+		for _, key := range []string{"k1", "k2", "k3", "k4"} {
+			err := segment.Set(hash([]byte(key)), []byte(key), []byte("0123456789"), 0)
+			require.NoError(t, err)
+		}
+
+		for _, key := range []string{"k1", "k2", "k3"} {
+			err := segment.Delete(hash([]byte(key)), []byte(key))
+			require.NoError(t, err)
+		}
+
+		require.True(t, segment.freeSlots.Contains(segmentFileHeaderSize, 80))
+		require.True(t, segment.freeSlots.Contains(segmentFileHeaderSize+80, 40))
+		require.Equal(t, 2, segment.freeSlots.Len())
+
+		segment.Close()
+
+		reopened := reopen(t, dataFile.Name())
+		defer reopened.Close()
+
+		require.True(t, reopened.freeSlots.Contains(segmentFileHeaderSize, 80))
+		require.Equal(t, 2, reopened.freeSlots.Len())
+
+		value, err := reopened.Get(hash([]byte("k4")), []byte("k4"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("0123456789"), value)
+	})
+}
+
+func TestSegmentChecksums(t *testing.T) {
+	key := []byte("key")
+	value := []byte("value")
+
+	// flips a bit of the item's value on disk. The item is the first one in the file
+	corruptValue := func(t *testing.T, file *os.File) {
+		buffer := make([]byte, 1)
+
+		offset := int64(segmentFileHeaderSize + blob.HeaderSizeV5)
+
+		_, err := file.ReadAt(buffer, offset)
+		require.NoError(t, err)
+
+		buffer[0] ^= 1
+
+		_, err = file.WriteAt(buffer, offset)
+		require.NoError(t, err)
+	}
+
+	t.Run("corrupted item is not returned", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+		defer segment.Close()
+
+		require.Equal(t, blob.LayoutVersion5, segment.layout)
+
+		err = segment.Set(hash(key), key, value, 0)
+		require.NoError(t, err)
+
+		corruptValue(t, dataFile)
+
+		_, err = segment.Get(hash(key), key)
+		require.ErrorIs(t, err, ErrCorruptedItem)
+
+		_, err = segment.Scan(func(key, value []byte, expire int64) bool {
+			return true
+		})
+		require.ErrorIs(t, err, ErrCorruptedItem)
+	})
+
+	t.Run("corrupted item is detected on load", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		err = segment.Set(hash(key), key, value, 0)
+		require.NoError(t, err)
+
+		segment.Close()
+
+		file, err := os.OpenFile(dataFile.Name(), os.O_RDWR, 0644)
+		require.NoError(t, err)
+		defer file.Close()
+
+		corruptValue(t, file)
+
+		_, err = newSegment(file, nil, 0, 0)
+		require.ErrorIs(t, err, ErrCorruptedItem)
+	})
+
+	t.Run("corrupted item is restored from WAL on load", func(t *testing.T) {
+		dir := os.TempDir()
+
+		dataFile, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		walFile, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(walFile.Name())
+		defer walFile.Close()
+
+		segment, err := newSegment(dataFile, walFile, time.Hour, time.Hour)
+		require.NoError(t, err)
+
+		err = segment.Set(hash(key), key, value, 0)
+		require.NoError(t, err)
+
+		otherKey := []byte("other key")
+		err = segment.Set(hash(otherKey), otherKey, value, 0)
+		require.NoError(t, err)
+
+		// copies the files, as they were left by a crash before the checkpoint
+		crashedDataFile, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(crashedDataFile.Name())
+		defer crashedDataFile.Close()
+
+		crashedWALFile, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(crashedWALFile.Name())
+		defer crashedWALFile.Close()
+
+		copyFile(t, dataFile.Name(), crashedDataFile.Name())
+		copyFile(t, walFile.Name(), crashedWALFile.Name())
+
+		segment.Close()
+
+		corruptValue(t, crashedDataFile)
+
+		// the file's header reached the disk, but the item's blob didn't
+		lastKnownLSN := binary.BigEndian.AppendUint64(nil, 2)
+		_, err = crashedDataFile.WriteAt(lastKnownLSN, segmentFileLastKnownLSNOffset)
+		require.NoError(t, err)
+
+		stat, err := crashedDataFile.Stat()
+		require.NoError(t, err)
+
+		reopened, err := newSegment(crashedDataFile, crashedWALFile, time.Hour, time.Hour)
+		require.NoError(t, err)
+		defer reopened.Close()
+
+		actualValue, err := reopened.Get(hash(key), key)
+		require.NoError(t, err)
+		require.Equal(t, value, actualValue)
+
+		actualValue, err = reopened.Get(hash(otherKey), otherKey)
+		require.NoError(t, err)
+		require.Equal(t, value, actualValue)
+
+		// the restored item reuses the damaged blob
+		require.Equal(t, 0, reopened.freeSlots.Len())
+		require.Equal(t, stat.Size(), reopened.fileSizeBytes)
+	})
+
+	t.Run("corrupted item, which is not in WAL, is detected on load", func(t *testing.T) {
+		dir := os.TempDir()
+
+		dataFile, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		walFile, err := os.CreateTemp(dir, "*")
+		require.NoError(t, err)
+
+		defer os.Remove(walFile.Name())
+		defer walFile.Close()
+
+		segment, err := newSegment(dataFile, walFile, time.Hour, time.Hour)
+		require.NoError(t, err)
+
+		err = segment.Set(hash(key), key, value, 0)
+		require.NoError(t, err)
+
+		// the checkpoint truncates WAL
+		segment.Close()
+
+		file, err := os.OpenFile(dataFile.Name(), os.O_RDWR, 0644)
+		require.NoError(t, err)
+		defer file.Close()
+
+		corruptValue(t, file)
+
+		_, err = newSegment(file, walFile, time.Hour, time.Hour)
+		require.ErrorIs(t, err, ErrCorruptedItem)
+	})
+
+	t.Run("checksum is updated with expire", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		err = segment.Set(hash(key), key, value, 0)
+		require.NoError(t, err)
+
+		expire := time.Now().Add(time.Hour).UnixMilli()
+
+		err = segment.SetExpire(hash(key), key, expire)
+		require.NoError(t, err)
+
+		segment.Close()
+
+		file, err := os.OpenFile(dataFile.Name(), os.O_RDWR, 0644)
+		require.NoError(t, err)
+
+		reopened, err := newSegment(file, nil, 0, 0)
+		require.NoError(t, err)
+		defer reopened.Close()
+
+		actualExpire, err := reopened.GetExpire(hash(key), key)
+		require.NoError(t, err)
+		require.Equal(t, expire, actualExpire)
+	})
+
+	t.Run("damaged status doesn't restore deleted item", func(t *testing.T) {
+		dataFile, err := os.CreateTemp(os.TempDir(), "*")
+		require.NoError(t, err)
+
+		defer os.Remove(dataFile.Name())
+
+		segment, err := newSegment(dataFile, nil, 0, 0)
+		require.NoError(t, err)
+
+		err = segment.Set(hash(key), key, value, 0)
+		require.NoError(t, err)
+
+		// keeps the deleted item from being truncated as the file's free tail
+		otherKey := []byte("other key")
+		err = segment.Set(hash(otherKey), otherKey, value, 0)
+		require.NoError(t, err)
+
+		err = segment.Delete(hash(key), key)
+		require.NoError(t, err)
+
+		segment.Close()
+
+		file, err := os.OpenFile(dataFile.Name(), os.O_RDWR, 0644)
+		require.NoError(t, err)
+
+		_, err = file.WriteAt([]byte{blob.StatusOK}, segmentFileHeaderSize+blob.StatusOffset)
+		require.NoError(t, err)
+
+		_, err = newSegment(file, nil, 0, 0)
+		require.ErrorIs(t, err, ErrCorruptedItem)
+	})
+}
@@ -0,0 +1,46 @@
+package zapp
+
+import (
+	"fmt"
+)
+
+// rawTruncateFreeTail drops empty offsets, which are contiguous at the end of the file, from free slots
+// and truncates the file, so that their space is returned to the filesystem.
+// New items are appended at the new end of the file, so the offsets of removed blobs may point to the middle of new items.
+// That's why segment's generation is incremented, just like after compaction, if scan cursors may point to removed blobs
+func (seg *segment) rawTruncateFreeTail() {
+	if !seg.rawHasFreeTail() {
+		return
+	}
+
+	newFileSize := seg.fileSizeBytes
+	for {
+		offset, size, ok := seg.freeSlots.EndingAt(newFileSize)
+		if !ok {
+			break
+		}
+
+		seg.freeSlots.Remove(offset, size)
+
+		newFileSize = offset
+	}
+
+	err := seg.file.Truncate(newFileSize)
+	if err != nil {
+		panic(fmt.Errorf("tried to truncate segment's file to %d bytes, but got error: %w", newFileSize, err))
+	}
+
+	// truncation deallocates preallocated blocks as well
+	seg.fileSizeBytes = newFileSize
+	seg.preallocatedEnd = newFileSize
+
+	if newFileSize < seg.scannedEnd.Load() {
+		seg.rawNextGeneration()
+	}
+}
+
+// rawHasFreeTail tells if the last blob in the file is empty
+func (seg *segment) rawHasFreeTail() bool {
+	_, _, ok := seg.freeSlots.EndingAt(seg.fileSizeBytes)
+	return ok
+}
@@ -0,0 +1,21 @@
+package zapp
+
+import (
+	"os"
+)
+
+// syncDir persists the directory's entries, so that files created, renamed or removed in it survive a power loss.
+// Syncing a file doesn't persist its name in the directory
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -10,7 +10,7 @@ import (
 
 type v struct {
 	value  []byte
-	expire uint32
+	expire int64
 	lsn    uint64 // optional. is you don't use WAL, then it means nothing
 }
 
@@ -43,7 +43,7 @@ func makeSegmentOrdered(writer io.Writer, orderedData []kv) error {
 	var headerBuffer []byte
 
 	headerBuffer = append(headerBuffer, segmentFileBeginMagicNumbers...)
-	headerBuffer = append(headerBuffer, segmentFileLayoutVerion1)
+	headerBuffer = append(headerBuffer, segmentFileLayoutVersion1)
 
 	// reserved bytes
 	for i := 0; i < segmentFileLayoutReservedSize; i++ {
@@ -64,7 +64,7 @@ func makeSegmentOrdered(writer io.Writer, orderedData []kv) error {
 			Expire: item.expire,
 		}
 
-		buffer, _ := kve.Marshal()
+		buffer, _ := kve.Marshal(blob.LayoutVersion1)
 
 		_, err := writer.Write(buffer)
 		if err != nil {
@@ -84,3 +84,16 @@ func makeWAL(writer io.Writer, actions []wal.Action) error {
 	}
 	return nil
 }
+
+// makeEmptySegment writes the header of an empty segment's file with the layout
+func makeEmptySegment(writer io.Writer, layout byte) error {
+	var headerBuffer []byte
+
+	headerBuffer = append(headerBuffer, segmentFileBeginMagicNumbers...)
+	headerBuffer = append(headerBuffer, layout)
+	headerBuffer = append(headerBuffer, make([]byte, segmentFileLayoutReservedSize)...)
+	headerBuffer = binary.BigEndian.AppendUint64(headerBuffer, segmentFileDefaultLastKnownLSN)
+
+	_, err := writer.Write(headerBuffer)
+	return err
+}
@@ -1,151 +1,511 @@
 package wal
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 
 	"github.com/Kurt212/zapp/constants"
 )
 
 const (
-	lsnSize    = 8 // bytes
-	typeSize   = 1 // byte
-	expireSize = 4 // bytes
-	keylenSize = 2 // bytes
-	vallenSize = 4 // bytes
+	lsnSize          = 8 // bytes
+	typeSize         = 1 // byte
+	legacyExpireSize = 4 // bytes. Unix seconds
+	expireMilliSize  = 8 // bytes. Unix milliseconds
+	keylenSize       = 2 // bytes
+	vallenSize       = 4 // bytes
+	timeSize         = 8 // bytes. Unix milliseconds
+
+	batchPartsCountSize   = 2 // bytes
+	batchSegmentSize      = 4 // bytes
+	batchActionsCountSize = 4 // bytes
+)
+
+// Since framed records the highest bit of the record's type is set and the type is followed by
+// the payload's length and CRC32-C of the whole record:
+//
+//	LSN (8 bytes) | type with framedRecordFlag (1 byte) | payload's length (4 bytes) | CRC32-C (4 bytes) | payload
+//
+// CRC32-C covers LSN, type, length and payload. Legacy records don't have length and checksum:
+//
+//	LSN (8 bytes) | type (1 byte) | payload
+//
+// Both kinds of records may be mixed in a single file
+const (
+	framedRecordFlag = 0x80 // set in the type of framed records
+
+	recordLengthSize       = 4 // bytes
+	recordChecksumSize     = 4 // bytes
+	framedRecordHeaderSize = lsnSize + typeSize + recordLengthSize + recordChecksumSize
+)
+
+var (
+	recordChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errIncompleteRecord = errors.New("record is incomplete")
+	errChecksumMismatch = errors.New("record's checksum doesn't match")
+	errRecordTooLong    = errors.New("record is longer than the rest of the file")
 )
 
+// TornTail is the end of WAL file, which was only partially written, for example because of a power loss.
+// It's truncated, when WAL is opened
+type TornTail struct {
+	Offset  int64 // where the torn tail begins
+	Size    int64 // bytes
+	Records int   // number of records, which began in the torn tail. Zero, if the tail consists of zero bytes
+}
+
+// walContent is the result of reading WAL's records
+type walContent struct {
+	actions  []Action // actions with LSN greater than the last applied LSN
+	lastLSN  uint64   // the greatest LSN of all read actions except time marks
+	tornTail TornTail // zero size means that the whole file was read
+}
+
+// initialRead reads actions with LSN greater than lastAppliedLSN. Torn tail is treated as corruption,
+// because only the WAL file, which is being opened, can have it
 func initialRead(file io.ReadSeeker, lastAppliedLSN uint64) (_ []Action, lastSeenLSN uint64, _ error) {
-	_, err := file.Seek(0, constants.OriginWhence)
+	content, err := readContent(file, lastAppliedLSN)
 	if err != nil {
-		return nil, 0, fmt.Errorf("got error when moving wal file's cursor: %w", err)
+		return nil, 0, err
+	}
+
+	if content.tornTail.Size > 0 {
+		return nil, 0, fmt.Errorf("%w: %d bytes at offset %d are torn", ErrCorrupted, content.tornTail.Size, content.tornTail.Offset)
 	}
 
-	lastLSN := uint64(0)
+	return content.actions, content.lastLSN, nil
+}
 
-	var unappliedActions []Action
+// readContent reads actions with LSN greater than lastAppliedLSN.
+// A record, which is incomplete, or the last record with mismatching checksum, or trailing zero bytes
+// are the torn tail. A record longer than the rest of the file is torn only if no valid record follows it. Everything else, which can't be read, is corruption and ErrCorrupted is returned
+func readContent(file io.ReadSeeker, lastAppliedLSN uint64) (walContent, error) {
+	var content walContent
 
-	for {
-		lsnAndTypeBuffer := make([]byte, lsnSize+typeSize)
-		_, err := file.Read(lsnAndTypeBuffer)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, 0, err
-		}
+	size, err := file.Seek(0, constants.EndWhence)
+	if err != nil {
+		return content, fmt.Errorf("got error when moving wal file's cursor: %w", err)
+	}
 
-		lsn := binary.BigEndian.Uint64(lsnAndTypeBuffer[:lsnSize])
-		actonType := ActionType(lsnAndTypeBuffer[lsnSize])
+	_, err = file.Seek(0, constants.OriginWhence)
+	if err != nil {
+		return content, fmt.Errorf("got error when moving wal file's cursor: %w", err)
+	}
 
-		lastLSN = lsn // update global last seen LSN
+	reader := bufio.NewReader(file)
 
-		switch actonType {
-		case ActionTypeSet:
-			// can read expire + keylen + vallen and then check lsn to determine if need to skip this entry or append it to result
-			expireAndKeylenAndVallenBuffer := make([]byte, expireSize+keylenSize+vallenSize)
-			n, err := file.Read(expireAndKeylenAndVallenBuffer)
-			if err != nil {
-				return nil, 0, fmt.Errorf("got error when reading set action wal's entry payload: %w", err)
-			}
-			if n < len(expireAndKeylenAndVallenBuffer) {
-				return nil, 0, fmt.Errorf("expected %d bytes to read expire, keylen and vallen, but got %d bytes", len(expireAndKeylenAndVallenBuffer), n)
-			}
-			expire := binary.BigEndian.Uint32(expireAndKeylenAndVallenBuffer[:expireSize])
-			keylen := binary.BigEndian.Uint16(expireAndKeylenAndVallenBuffer[expireSize : expireSize+keylenSize])
-			vallen := binary.BigEndian.Uint32(expireAndKeylenAndVallenBuffer[expireSize+keylenSize:])
-
-			// if lastAppliedLSN is greater than this wal entry LSN, then it means that this entry was already appliend
-			// now need to move file cursor to next entry and skip keylen + vallen bytes
-			if lastAppliedLSN >= lsn {
-				_, err := file.Seek(int64(keylen)+int64(vallen), constants.CurrentPositionWhence)
-				if err != nil {
-					return nil, 0, fmt.Errorf("got error when moved cursor to next wal entry: %w", err)
-				}
-				// now when moved cursor go to next loop itteration
-				continue
-			}
+	var offset int64
 
-			keyPayloadAndValPayloadBuffer := make([]byte, int(keylen)+int(vallen))
-			n, err = file.Read(keyPayloadAndValPayloadBuffer)
-			if err != nil {
-				return nil, 0, fmt.Errorf("got error when reading set action wal's entry payload: %w", err)
+	for offset < size {
+		action, recordSize, err := readRecord(reader, size-offset)
+		if err != nil {
+			tornTail, ok, tailErr := readTornTail(file, offset, size, recordSize, err)
+			if tailErr != nil {
+				return content, tailErr
 			}
-			if n < len(keyPayloadAndValPayloadBuffer) {
-				return nil, 0, fmt.Errorf("expected %d bytes to read key and val, but got %d bytes", len(keyPayloadAndValPayloadBuffer), n)
+			if !ok {
+				return content, fmt.Errorf("%w: record at offset %d: %v", ErrCorrupted, offset, err)
 			}
 
-			key := keyPayloadAndValPayloadBuffer[:keylen]
-			val := keyPayloadAndValPayloadBuffer[keylen:]
+			content.tornTail = tornTail
 
-			action := Action{
-				Type:   ActionTypeSet,
-				LSN:    lsn,
-				Key:    key,
-				Value:  val,
-				Expire: expire,
-			}
+			break
+		}
 
-			unappliedActions = append(unappliedActions, action)
+		offset += recordSize
 
-		case ActionTypeDel:
-			// can read expire + keylen + vallen and then check lsn to determine if need to skip this entry or append it to result
-			keylenBuffer := make([]byte, keylenSize)
-			n, err := file.Read(keylenBuffer)
-			if err != nil {
-				return nil, 0, fmt.Errorf("got error when reading del action wal's entry payload: %w", err)
-			}
-			if n < len(keylenBuffer) {
-				return nil, 0, fmt.Errorf("expected %d bytes to read keylen, but got %d bytes", len(keylenBuffer), n)
-			}
-			keylen := binary.BigEndian.Uint16(keylenBuffer)
+		// time mark carries the LSN of the next action, which may be not written yet
+		if action.Type != ActionTypeTimeMark {
+			content.lastLSN = action.LSN
+		}
 
-			// if lastAppliedLSN is greater than this wal entry LSN, then it means that this entry was already appliend
-			// now need to move file cursor to next entry and skip keylen + vallen bytes
-			if lastAppliedLSN >= lsn {
-				_, err := file.Seek(int64(keylen), constants.CurrentPositionWhence)
-				if err != nil {
-					return nil, 0, fmt.Errorf("got error when moved cursor to next wal entry: %w", err)
-				}
-				// now when moved cursor go to next loop itteration
-				continue
-			}
+		// if lastAppliedLSN is not lower than this wal entry LSN, then it means that this entry was already applied
+		if lastAppliedLSN >= action.LSN {
+			continue
+		}
 
-			keyPayload := make([]byte, int(keylen))
-			n, err = file.Read(keyPayload)
-			if err != nil {
-				return nil, 0, fmt.Errorf("got error when reading set action wal's entry payload: %w", err)
-			}
-			if n < len(keyPayload) {
-				return nil, 0, fmt.Errorf("expected %d bytes to read key and val, but got %d bytes", len(keyPayload), n)
-			}
+		content.actions = append(content.actions, action)
+	}
+
+	return content, nil
+}
+
+// readRecord reads a single record of any kind. remaining is the number of bytes left in the file.
+// Returns the size of the record, if it's known
+func readRecord(reader io.Reader, remaining int64) (Action, int64, error) {
+	lsnAndTypeBuffer := make([]byte, lsnSize+typeSize)
+	_, err := io.ReadFull(reader, lsnAndTypeBuffer)
+	if err != nil {
+		return Action{}, 0, fmt.Errorf("%w: %v", errIncompleteRecord, err)
+	}
+
+	lsn := binary.BigEndian.Uint64(lsnAndTypeBuffer[:lsnSize])
+	typeByte := lsnAndTypeBuffer[lsnSize]
+
+	if typeByte&framedRecordFlag == 0 {
+		counter := &countingReader{reader: reader}
+
+		action, err := readActionPayload(counter, ActionType(typeByte))
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return Action{}, 0, fmt.Errorf("%w: %v", errIncompleteRecord, err)
+		}
+		if err != nil {
+			return Action{}, 0, err
+		}
+
+		action.LSN = lsn
+
+		return action, lsnSize + typeSize + counter.n, nil
+	}
+
+	lengthAndChecksumBuffer := make([]byte, recordLengthSize+recordChecksumSize)
+	_, err = io.ReadFull(reader, lengthAndChecksumBuffer)
+	if err != nil {
+		return Action{}, 0, fmt.Errorf("%w: %v", errIncompleteRecord, err)
+	}
+
+	length := binary.BigEndian.Uint32(lengthAndChecksumBuffer[:recordLengthSize])
+	checksum := binary.BigEndian.Uint32(lengthAndChecksumBuffer[recordLengthSize:])
+
+	recordSize := framedRecordHeaderSize + int64(length)
+
+	// the length is checked before allocating the payload, because it may be garbage
+	if recordSize > remaining {
+		return Action{}, 0, fmt.Errorf("%w: record's size is %d bytes, but only %d bytes are left", errRecordTooLong, recordSize, remaining)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return Action{}, 0, fmt.Errorf("%w: %v", errIncompleteRecord, err)
+	}
+
+	actualChecksum := crc32.Checksum(lsnAndTypeBuffer, recordChecksumTable)
+	actualChecksum = crc32.Update(actualChecksum, recordChecksumTable, lengthAndChecksumBuffer[:recordLengthSize])
+	actualChecksum = crc32.Update(actualChecksum, recordChecksumTable, payload)
+
+	if actualChecksum != checksum {
+		return Action{}, recordSize, errChecksumMismatch
+	}
+
+	payloadReader := bytes.NewReader(payload)
+
+	action, err := readActionPayload(payloadReader, ActionType(typeByte&^framedRecordFlag))
+	if err != nil {
+		return Action{}, recordSize, err
+	}
+
+	if payloadReader.Len() != 0 {
+		return Action{}, recordSize, fmt.Errorf("record has %d unexpected bytes after payload", payloadReader.Len())
+	}
+
+	action.LSN = lsn
+
+	return action, recordSize, nil
+}
+
+// readTornTail checks if the record at offset, which can't be read because of recordErr, begins the torn tail.
+// The torn tail goes up to the end of the file. Returns false, if it's corruption in the middle of the file
+func readTornTail(file io.ReadSeeker, offset int64, size int64, recordSize int64, recordErr error) (TornTail, bool, error) {
+	_, err := file.Seek(offset, constants.OriginWhence)
+	if err != nil {
+		return TornTail{}, false, fmt.Errorf("got error when moving wal file's cursor: %w", err)
+	}
+
+	tail, err := io.ReadAll(file)
+	if err != nil {
+		return TornTail{}, false, fmt.Errorf("got error when reading wal file's tail: %w", err)
+	}
+
+	tornTail := TornTail{
+		Offset:  offset,
+		Size:    size - offset,
+		Records: countTornRecords(tail),
+	}
+
+	switch {
+	case errors.Is(recordErr, errRecordTooLong):
+		// the length of a record in the middle of the file may be corrupted as well,
+		// then some valid records are found after it
+		return tornTail, !hasFramedRecord(tail[1:]), nil
+	case errors.Is(recordErr, errIncompleteRecord):
+		return tornTail, true, nil
+	case errors.Is(recordErr, errChecksumMismatch) && offset+recordSize == size:
+		return tornTail, true, nil
+	case bytes.Count(tail, []byte{0}) == len(tail):
+		// the file's size may be persisted before its content
+		return tornTail, true, nil
+	default:
+		return TornTail{}, false, nil
+	}
+}
+
+// hasFramedRecord tells if a complete framed record with matching checksum begins anywhere in data
+func hasFramedRecord(data []byte) bool {
+	for start := 0; len(data)-start >= framedRecordHeaderSize; start++ {
+		if data[start+lsnSize]&framedRecordFlag == 0 {
+			continue
+		}
+
+		_, _, err := readRecord(bytes.NewReader(data[start:]), int64(len(data)-start))
+		if err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// countTornRecords returns the number of records, which began in the torn tail.
+// Framed records are counted by their lengths. The rest of the tail after a legacy record is counted as one record
+func countTornRecords(tail []byte) int {
+	count := 0
+
+	for len(tail) > 0 && bytes.Count(tail, []byte{0}) != len(tail) {
+		count++
+
+		if len(tail) < framedRecordHeaderSize || tail[lsnSize]&framedRecordFlag == 0 {
+			break
+		}
+
+		recordSize := framedRecordHeaderSize + int64(binary.BigEndian.Uint32(tail[lsnSize+typeSize:]))
+		if recordSize > int64(len(tail)) {
+			break
+		}
+
+		tail = tail[recordSize:]
+	}
+
+	return count
+}
+
+// countingReader counts bytes read from the reader. It's used to find the size of legacy records
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// readActionPayload reads action's payload of actionType from the reader. The returned action doesn't have LSN
+func readActionPayload(reader io.Reader, actionType ActionType) (Action, error) {
+	switch actionType {
+	case ActionTypeSet, ActionTypeSetMilli:
+		expireSize := expireSizeOf(actionType)
+
+		expireAndKeylenAndVallenBuffer := make([]byte, expireSize+keylenSize+vallenSize)
+		_, err := io.ReadFull(reader, expireAndKeylenAndVallenBuffer)
+		if err != nil {
+			return Action{}, fmt.Errorf("got error when reading set action wal's entry payload: %w", err)
+		}
+
+		expire := readExpire(expireAndKeylenAndVallenBuffer[:expireSize], actionType)
+		keylen := binary.BigEndian.Uint16(expireAndKeylenAndVallenBuffer[expireSize : expireSize+keylenSize])
+		vallen := binary.BigEndian.Uint32(expireAndKeylenAndVallenBuffer[expireSize+keylenSize:])
+
+		keyPayloadAndValPayloadBuffer := make([]byte, int(keylen)+int(vallen))
+		_, err = io.ReadFull(reader, keyPayloadAndValPayloadBuffer)
+		if err != nil {
+			return Action{}, fmt.Errorf("got error when reading set action wal's entry payload: %w", err)
+		}
+
+		return Action{
+			Type:   actionType,
+			Key:    keyPayloadAndValPayloadBuffer[:keylen],
+			Value:  keyPayloadAndValPayloadBuffer[keylen:],
+			Expire: expire,
+		}, nil
+
+	case ActionTypeDel:
+		keylenBuffer := make([]byte, keylenSize)
+		_, err := io.ReadFull(reader, keylenBuffer)
+		if err != nil {
+			return Action{}, fmt.Errorf("got error when reading del action wal's entry payload: %w", err)
+		}
+
+		keyPayload := make([]byte, int(binary.BigEndian.Uint16(keylenBuffer)))
+		_, err = io.ReadFull(reader, keyPayload)
+		if err != nil {
+			return Action{}, fmt.Errorf("got error when reading del action wal's entry payload: %w", err)
+		}
+
+		return Action{
+			Type: ActionTypeDel,
+			Key:  keyPayload,
+		}, nil
+
+	case ActionTypeExpire, ActionTypeExpireMilli:
+		expireSize := expireSizeOf(actionType)
+
+		expireAndKeylenBuffer := make([]byte, expireSize+keylenSize)
+		_, err := io.ReadFull(reader, expireAndKeylenBuffer)
+		if err != nil {
+			return Action{}, fmt.Errorf("got error when reading expire action wal's entry payload: %w", err)
+		}
+
+		expire := readExpire(expireAndKeylenBuffer[:expireSize], actionType)
+		keylen := binary.BigEndian.Uint16(expireAndKeylenBuffer[expireSize:])
+
+		keyPayload := make([]byte, int(keylen))
+		_, err = io.ReadFull(reader, keyPayload)
+		if err != nil {
+			return Action{}, fmt.Errorf("got error when reading expire action wal's entry payload: %w", err)
+		}
+
+		return Action{
+			Type:   actionType,
+			Key:    keyPayload,
+			Expire: expire,
+		}, nil
+
+	case ActionTypeTimeMark:
+		timeBuffer := make([]byte, timeSize)
+		_, err := io.ReadFull(reader, timeBuffer)
+		if err != nil {
+			return Action{}, fmt.Errorf("got error when reading time mark wal's entry payload: %w", err)
+		}
+
+		return Action{
+			Type: ActionTypeTimeMark,
+			Time: int64(binary.BigEndian.Uint64(timeBuffer)),
+		}, nil
+
+	case ActionTypeBatch:
+		parts, err := readBatchParts(reader)
+		if err != nil {
+			return Action{}, fmt.Errorf("got error when reading batch action wal's entry payload: %w", err)
+		}
 
-			action := Action{
-				Type: ActionTypeDel,
-				LSN:  lsn,
-				Key:  keyPayload,
+		return Action{
+			Type:  ActionTypeBatch,
+			Batch: parts,
+		}, nil
+
+	default:
+		return Action{}, fmt.Errorf("unknown wal's action type %d met, when reading wal", actionType)
+	}
+}
+
+// readBatchParts reads batch's parts from the reader.
+// Batch's payload is encoded as number of parts and then each part as its segment, its LSN,
+// the number of part's actions and each action's type and payload without LSN.
+// Only set and del actions can be a part of a batch
+func readBatchParts(reader io.Reader) ([]BatchPart, error) {
+	partsCountBuffer := make([]byte, batchPartsCountSize)
+	_, err := io.ReadFull(reader, partsCountBuffer)
+	if err != nil {
+		return nil, fmt.Errorf("got error when reading batch's parts count: %w", err)
+	}
+
+	partsCount := binary.BigEndian.Uint16(partsCountBuffer)
+
+	parts := make([]BatchPart, 0, partsCount)
+
+	for i := 0; i < int(partsCount); i++ {
+		partHeaderBuffer := make([]byte, batchSegmentSize+lsnSize+batchActionsCountSize)
+		_, err := io.ReadFull(reader, partHeaderBuffer)
+		if err != nil {
+			return nil, fmt.Errorf("got error when reading batch's part header: %w", err)
+		}
+
+		part := BatchPart{
+			Segment: binary.BigEndian.Uint32(partHeaderBuffer[:batchSegmentSize]),
+			LSN:     binary.BigEndian.Uint64(partHeaderBuffer[batchSegmentSize : batchSegmentSize+lsnSize]),
+		}
+
+		actionsCount := binary.BigEndian.Uint32(partHeaderBuffer[batchSegmentSize+lsnSize:])
+
+		for j := 0; j < int(actionsCount); j++ {
+			action, err := readBatchAction(reader)
+			if err != nil {
+				return nil, err
 			}
 
-			unappliedActions = append(unappliedActions, action)
+			action.LSN = part.LSN
 
-		default:
-			return nil, 0, fmt.Errorf("unknown wal's action type %d met, when reading wal", actonType)
+			part.Actions = append(part.Actions, action)
 		}
+
+		parts = append(parts, part)
 	}
 
-	return unappliedActions, lastLSN, nil
+	return parts, nil
 }
 
+func readBatchAction(reader io.Reader) (Action, error) {
+	typeBuffer := make([]byte, typeSize)
+	_, err := io.ReadFull(reader, typeBuffer)
+	if err != nil {
+		return Action{}, fmt.Errorf("got error when reading batch's action type: %w", err)
+	}
+
+	actionType := ActionType(typeBuffer[0])
+
+	if actionType != ActionTypeSet && actionType != ActionTypeSetMilli && actionType != ActionTypeDel {
+		return Action{}, fmt.Errorf("unknown batch's action type %d met, when reading wal", actionType)
+	}
+
+	return readActionPayload(reader, actionType)
+}
+
+// AppendAction appends the action to the file as a framed record with length and checksum
 func AppendAction(file io.Writer, action Action) error {
-	var buffer []byte
+	buffer, err := appendRecord(nil, action)
+	if err != nil {
+		return err
+	}
+
+	n, err := file.Write(buffer)
+	if err != nil {
+		return fmt.Errorf("got error when trying to write to wal's file: %w", err)
+	}
+	if n != len(buffer) {
+		return fmt.Errorf("appended only %d bytes to WAL file, wanted %d bytes", n, len(buffer))
+	}
+
+	return nil
+}
+
+// appendRecord appends the action to the buffer as a framed record with length and checksum
+func appendRecord(buffer []byte, action Action) ([]byte, error) {
+	// the payload begins with action's type
+	payload, err := appendActionPayload(nil, action)
+	if err != nil {
+		return nil, err
+	}
+
+	recordStart := len(buffer)
 
 	buffer = binary.BigEndian.AppendUint64(buffer, action.LSN)
+	buffer = append(buffer, payload[0]|framedRecordFlag)
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(payload)-typeSize))
+
+	checksum := crc32.Checksum(buffer[recordStart:], recordChecksumTable)
+	checksum = crc32.Update(checksum, recordChecksumTable, payload[typeSize:])
 
+	buffer = binary.BigEndian.AppendUint32(buffer, checksum)
+	buffer = append(buffer, payload[typeSize:]...)
+
+	return buffer, nil
+}
+
+// appendActionPayload appends action's type and action's payload to the buffer
+func appendActionPayload(buffer []byte, action Action) ([]byte, error) {
 	switch action.Type {
-	case ActionTypeSet:
+	case ActionTypeSet, ActionTypeSetMilli:
 		buffer = append(buffer, byte(action.Type))
 
-		buffer = binary.BigEndian.AppendUint32(buffer, action.Expire)
+		buffer = appendExpire(buffer, action.Expire, action.Type)
 		buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(action.Key)))
 		buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(action.Value)))
 		buffer = append(buffer, action.Key...)
@@ -157,17 +517,77 @@ func AppendAction(file io.Writer, action Action) error {
 		buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(action.Key)))
 		buffer = append(buffer, action.Key...)
 
+	case ActionTypeExpire, ActionTypeExpireMilli:
+		buffer = append(buffer, byte(action.Type))
+
+		buffer = appendExpire(buffer, action.Expire, action.Type)
+		buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(action.Key)))
+		buffer = append(buffer, action.Key...)
+
+	case ActionTypeTimeMark:
+		buffer = append(buffer, byte(action.Type))
+
+		buffer = binary.BigEndian.AppendUint64(buffer, uint64(action.Time))
+
+	case ActionTypeBatch:
+		buffer = append(buffer, byte(action.Type))
+
+		buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(action.Batch)))
+
+		for _, part := range action.Batch {
+			buffer = binary.BigEndian.AppendUint32(buffer, part.Segment)
+			buffer = binary.BigEndian.AppendUint64(buffer, part.LSN)
+			buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(part.Actions)))
+
+			for _, partAction := range part.Actions {
+				if partAction.Type != ActionTypeSet && partAction.Type != ActionTypeSetMilli && partAction.Type != ActionTypeDel {
+					return nil, fmt.Errorf("trying to append to wal batch with action type %d", partAction.Type)
+				}
+
+				var err error
+				buffer, err = appendActionPayload(buffer, partAction)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
 	default:
-		return fmt.Errorf("trying to append to wal unknown action type %d", action.Type)
+		return nil, fmt.Errorf("trying to append to wal unknown action type %d", action.Type)
 	}
 
-	n, err := file.Write(buffer)
-	if err != nil {
-		return fmt.Errorf("got error when trying to write to wal's file: %w", err)
+	return buffer, nil
+}
+
+// expireSizeOf returns the size of the action's expire field. Legacy actions store unix seconds
+func expireSizeOf(actionType ActionType) int {
+	if actionType == ActionTypeSet || actionType == ActionTypeExpire {
+		return legacyExpireSize
 	}
-	if n != len(buffer) {
-		return fmt.Errorf("appended only %d bytes to WAL file, wanted %d bytes", n, len(buffer))
+
+	return expireMilliSize
+}
+
+// readExpire reads the action's expire field and always returns unix milliseconds
+func readExpire(buffer []byte, actionType ActionType) int64 {
+	if expireSizeOf(actionType) == legacyExpireSize {
+		return int64(binary.BigEndian.Uint32(buffer)) * 1000
 	}
 
-	return nil
+	return int64(binary.BigEndian.Uint64(buffer))
+}
+
+// appendExpire appends expire in unix milliseconds as the action's expire field
+func appendExpire(buffer []byte, expire int64, actionType ActionType) []byte {
+	if expireSizeOf(actionType) == legacyExpireSize {
+		seconds := expire / 1000
+		// zero means no expire time, so it must not appear from truncation
+		if expire != 0 && seconds <= 0 {
+			seconds = 1
+		}
+
+		return binary.BigEndian.AppendUint32(buffer, uint32(seconds))
+	}
+
+	return binary.BigEndian.AppendUint64(buffer, uint64(expire))
 }
@@ -3,6 +3,7 @@ package wal
 import (
 	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -40,6 +41,40 @@ func TestInitialRead(t *testing.T) {
 				LSN:    lsn,
 				Key:    key,
 				Value:  value,
+				Expire: int64(expire) * 1000, // legacy set stores seconds
+			},
+		}
+
+		assert.Equal(t, expected, result)
+	})
+
+	t.Run("action set with milliseconds expire", func(t *testing.T) {
+		inputData := []byte{}
+
+		key := []byte("test_key")
+		value := []byte("test value")
+		lsn := uint64(1)
+		expire := int64(100500123)
+
+		inputData = binary.BigEndian.AppendUint64(inputData, lsn)                // lsn
+		inputData = append(inputData, byte(ActionTypeSetMilli))                  // type
+		inputData = binary.BigEndian.AppendUint64(inputData, uint64(expire))     // expire
+		inputData = binary.BigEndian.AppendUint16(inputData, uint16(len(key)))   // keylen
+		inputData = binary.BigEndian.AppendUint32(inputData, uint32(len(value))) // vallen
+		inputData = append(inputData, key...)                                    // key payload
+		inputData = append(inputData, value...)                                  // val payload
+
+		result, lastLSN, err := initialRead(bytes.NewReader(inputData), 0)
+		assert.NoError(t, err)
+
+		assert.Equal(t, lsn, lastLSN)
+
+		expected := []Action{
+			{
+				Type:   ActionTypeSetMilli,
+				LSN:    lsn,
+				Key:    key,
+				Value:  value,
 				Expire: expire,
 			},
 		}
@@ -117,7 +152,7 @@ func TestInitialRead(t *testing.T) {
 				LSN:    1,
 				Key:    []byte("test_key"),
 				Value:  []byte("test value"),
-				Expire: expire,
+				Expire: int64(expire) * 1000,
 			},
 			{
 				Type: ActionTypeDel,
@@ -264,11 +299,11 @@ func TestAppendAction(t *testing.T) {
 		key := []byte("test_key")
 		value := []byte("test value")
 		lsn := uint64(1)
-		expire := uint32(100500)
+		expire := int64(100500123)
 
 		action := Action{
 			LSN:    lsn,
-			Type:   ActionTypeSet,
+			Type:   ActionTypeSetMilli,
 			Key:    key,
 			Value:  value,
 			Expire: expire,
@@ -283,14 +318,36 @@ func TestAppendAction(t *testing.T) {
 		expected := []byte{}
 
 		expected = binary.BigEndian.AppendUint64(expected, lsn)                // lsn
-		expected = append(expected, byte(ActionTypeSet))                       // type
-		expected = binary.BigEndian.AppendUint32(expected, expire)             // expire
+		expected = append(expected, byte(ActionTypeSetMilli))                  // type
+		expected = binary.BigEndian.AppendUint64(expected, uint64(expire))     // expire
 		expected = binary.BigEndian.AppendUint16(expected, uint16(len(key)))   // keylen
 		expected = binary.BigEndian.AppendUint32(expected, uint32(len(value))) // vallen
 		expected = append(expected, key...)                                    // key payload
 		expected = append(expected, value...)                                  // value payload
 
-		assert.Equal(t, expected, buffer.Bytes())
+		assert.Equal(t, frameRecord(expected), buffer.Bytes())
+	})
+
+	t.Run("append legacy set truncates expire to seconds", func(t *testing.T) {
+		action := Action{
+			LSN:    1,
+			Type:   ActionTypeSet,
+			Key:    []byte("test_key"),
+			Expire: 100500123,
+		}
+
+		buffer := bytes.NewBuffer(nil)
+
+		err := AppendAction(buffer, action)
+		assert.NoError(t, err)
+
+		result, _, err := initialRead(bytes.NewReader(buffer.Bytes()), 0)
+		assert.NoError(t, err)
+
+		action.Expire = 100500000
+		action.Value = []byte{}
+
+		assert.Equal(t, []Action{action}, result)
 	})
 
 	t.Run("append del", func(t *testing.T) {
@@ -316,6 +373,275 @@ func TestAppendAction(t *testing.T) {
 		expected = binary.BigEndian.AppendUint16(expected, uint16(len(key))) // keylen
 		expected = append(expected, key...)                                  // key payload
 
-		assert.Equal(t, expected, buffer.Bytes())
+		assert.Equal(t, frameRecord(expected), buffer.Bytes())
 	})
 }
+
+func TestBatchAction(t *testing.T) {
+	t.Run("append and read batch", func(t *testing.T) {
+		action := Action{
+			LSN:  5,
+			Type: ActionTypeBatch,
+			Batch: []BatchPart{
+				{
+					Segment: 1,
+					LSN:     5,
+					Actions: []Action{
+						{Type: ActionTypeSetMilli, LSN: 5, Key: []byte("key1"), Value: []byte("value1"), Expire: 100500123},
+						{Type: ActionTypeDel, LSN: 5, Key: []byte("key2")},
+					},
+				},
+				{
+					Segment: 3,
+					LSN:     10,
+					Actions: []Action{
+						{Type: ActionTypeSet, LSN: 10, Key: []byte("key3"), Value: []byte("value3")},
+					},
+				},
+			},
+		}
+
+		buffer := bytes.NewBuffer(nil)
+
+		err := AppendAction(buffer, action)
+		assert.NoError(t, err)
+
+		result, lastLSN, err := initialRead(bytes.NewReader(buffer.Bytes()), 0)
+		assert.NoError(t, err)
+
+		assert.Equal(t, uint64(5), lastLSN)
+		assert.Equal(t, []Action{action}, result)
+
+		result, lastLSN, err = initialRead(bytes.NewReader(buffer.Bytes()), 5)
+		assert.NoError(t, err)
+
+		assert.Equal(t, uint64(5), lastLSN)
+		assert.Empty(t, result)
+	})
+
+	t.Run("batch can not contain batch", func(t *testing.T) {
+		action := Action{
+			LSN:  1,
+			Type: ActionTypeBatch,
+			Batch: []BatchPart{
+				{
+					Segment: 0,
+					LSN:     1,
+					Actions: []Action{{Type: ActionTypeBatch}},
+				},
+			},
+		}
+
+		err := AppendAction(bytes.NewBuffer(nil), action)
+		assert.Error(t, err)
+	})
+}
+
+func TestExpireAction(t *testing.T) {
+	t.Run("append and read expire", func(t *testing.T) {
+		key := []byte("test_key")
+		lsn := uint64(3)
+		expire := int64(100500123)
+
+		action := Action{
+			LSN:    lsn,
+			Type:   ActionTypeExpireMilli,
+			Key:    key,
+			Expire: expire,
+		}
+
+		buffer := bytes.NewBuffer(nil)
+
+		err := AppendAction(buffer, action)
+		assert.NoError(t, err)
+
+		expected := []byte{}
+
+		expected = binary.BigEndian.AppendUint64(expected, lsn)              // lsn
+		expected = append(expected, byte(ActionTypeExpireMilli))             // type
+		expected = binary.BigEndian.AppendUint64(expected, uint64(expire))   // expire
+		expected = binary.BigEndian.AppendUint16(expected, uint16(len(key))) // keylen
+		expected = append(expected, key...)                                  // key payload
+
+		assert.Equal(t, frameRecord(expected), buffer.Bytes())
+
+		result, lastLSN, err := initialRead(bytes.NewReader(buffer.Bytes()), 0)
+		assert.NoError(t, err)
+
+		assert.Equal(t, lsn, lastLSN)
+		assert.Equal(t, []Action{action}, result)
+	})
+}
+
+func TestTimeMarkAction(t *testing.T) {
+	t.Run("append and read time mark", func(t *testing.T) {
+		key := []byte("test_key")
+		lsn := uint64(3)
+		markTime := int64(1700000000123)
+
+		mark := Action{
+			LSN:  lsn,
+			Type: ActionTypeTimeMark,
+			Time: markTime,
+		}
+
+		buffer := bytes.NewBuffer(nil)
+
+		err := AppendAction(buffer, mark)
+		assert.NoError(t, err)
+
+		expected := []byte{}
+
+		expected = binary.BigEndian.AppendUint64(expected, lsn)              // lsn
+		expected = append(expected, byte(ActionTypeTimeMark))                // type
+		expected = binary.BigEndian.AppendUint64(expected, uint64(markTime)) // time
+
+		assert.Equal(t, frameRecord(expected), buffer.Bytes())
+
+		del := Action{
+			LSN:  lsn,
+			Type: ActionTypeDel,
+			Key:  key,
+		}
+
+		err = AppendAction(buffer, del)
+		assert.NoError(t, err)
+
+		result, lastLSN, err := initialRead(bytes.NewReader(buffer.Bytes()), 0)
+		assert.NoError(t, err)
+
+		assert.Equal(t, lsn, lastLSN)
+		assert.Equal(t, []Action{mark, del}, result)
+	})
+
+	t.Run("trailing time mark doesn't change last lsn", func(t *testing.T) {
+		buffer := bytes.NewBuffer(nil)
+
+		err := AppendAction(buffer, Action{LSN: 1, Type: ActionTypeDel, Key: []byte("key")})
+		assert.NoError(t, err)
+
+		err = AppendAction(buffer, Action{LSN: 2, Type: ActionTypeTimeMark, Time: 1})
+		assert.NoError(t, err)
+
+		_, lastLSN, err := initialRead(bytes.NewReader(buffer.Bytes()), 0)
+		assert.NoError(t, err)
+
+		assert.Equal(t, uint64(1), lastLSN)
+	})
+}
+
+func TestReadContent(t *testing.T) {
+	appendActions := func(t *testing.T, actions ...Action) []byte {
+		buffer := bytes.NewBuffer(nil)
+		for _, action := range actions {
+			err := AppendAction(buffer, action)
+			assert.NoError(t, err)
+		}
+
+		return buffer.Bytes()
+	}
+
+	first := Action{LSN: 1, Type: ActionTypeSetMilli, Key: []byte("key1"), Value: []byte("value1"), Expire: 100500123}
+	second := Action{LSN: 2, Type: ActionTypeDel, Key: []byte("key2")}
+	third := Action{LSN: 3, Type: ActionTypeExpireMilli, Key: []byte("key3"), Expire: 100500123}
+
+	t.Run("legacy and framed records", func(t *testing.T) {
+		content := []byte{}
+
+		content = binary.BigEndian.AppendUint64(content, second.LSN) // lsn
+		content = append(content, byte(ActionTypeDel))               // type
+		content = binary.BigEndian.AppendUint16(content, 4)          // keylen
+		content = append(content, second.Key...)                     // key payload
+
+		content = append(appendActions(t, first), content...)
+		content = append(content, appendActions(t, third)...)
+
+		result, err := readContent(bytes.NewReader(content), 0)
+		assert.NoError(t, err)
+
+		assert.Equal(t, []Action{first, second, third}, result.actions)
+		assert.Equal(t, uint64(3), result.lastLSN)
+		assert.Zero(t, result.tornTail)
+	})
+
+	t.Run("incomplete last record is torn tail", func(t *testing.T) {
+		content := appendActions(t, first, second, third)
+		complete := len(appendActions(t, first, second))
+
+		// shorter tails consist of zero bytes of big endian LSN
+		for size := complete + lsnSize; size < len(content); size++ {
+			result, err := readContent(bytes.NewReader(content[:size]), 0)
+			assert.NoError(t, err)
+
+			assert.Equal(t, []Action{first, second}, result.actions)
+			assert.Equal(t, uint64(2), result.lastLSN)
+			assert.Equal(t, TornTail{Offset: int64(complete), Size: int64(size - complete), Records: 1}, result.tornTail)
+		}
+	})
+
+	t.Run("last record with wrong checksum is torn tail", func(t *testing.T) {
+		content := appendActions(t, first, second, third)
+		complete := len(appendActions(t, first, second))
+
+		content[len(content)-1] ^= 0xff
+
+		result, err := readContent(bytes.NewReader(content), 0)
+		assert.NoError(t, err)
+
+		assert.Equal(t, []Action{first, second}, result.actions)
+		assert.Equal(t, TornTail{Offset: int64(complete), Size: int64(len(content) - complete), Records: 1}, result.tornTail)
+	})
+
+	t.Run("trailing zeros are torn tail", func(t *testing.T) {
+		content := appendActions(t, first)
+		complete := len(content)
+
+		content = append(content, make([]byte, 100)...)
+
+		result, err := readContent(bytes.NewReader(content), 0)
+		assert.NoError(t, err)
+
+		assert.Equal(t, []Action{first}, result.actions)
+		assert.Equal(t, TornTail{Offset: int64(complete), Size: 100}, result.tornTail)
+	})
+
+	t.Run("corrupted record in the middle", func(t *testing.T) {
+		content := appendActions(t, first, second, third)
+
+		content[len(appendActions(t, first))-1] ^= 0xff
+
+		_, err := readContent(bytes.NewReader(content), 0)
+		assert.ErrorIs(t, err, ErrCorrupted)
+
+		_, _, err = initialRead(bytes.NewReader(content), 0)
+		assert.ErrorIs(t, err, ErrCorrupted)
+	})
+
+	t.Run("too long record in the middle", func(t *testing.T) {
+		content := appendActions(t, first, second, third)
+
+		// the record's length is greater than the rest of the file now
+		content[len(appendActions(t, first))+lsnSize+typeSize] ^= 0xff
+
+		_, err := readContent(bytes.NewReader(content), 0)
+		assert.ErrorIs(t, err, ErrCorrupted)
+	})
+
+	t.Run("strict read doesn't allow torn tail", func(t *testing.T) {
+		content := appendActions(t, first, second)
+
+		_, _, err := initialRead(bytes.NewReader(content[:len(content)-1]), 0)
+		assert.ErrorIs(t, err, ErrCorrupted)
+	})
+}
+
+// frameRecord converts the legacy record to the framed one
+func frameRecord(legacy []byte) []byte {
+	record := append([]byte{}, legacy[:lsnSize]...)
+	record = append(record, legacy[lsnSize]|framedRecordFlag)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(legacy)-lsnSize-typeSize))
+	record = binary.BigEndian.AppendUint32(record, crc32.Checksum(append(append([]byte{}, record...), legacy[lsnSize+typeSize:]...), recordChecksumTable))
+	record = append(record, legacy[lsnSize+typeSize:]...)
+
+	return record
+}
@@ -0,0 +1,195 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+)
+
+// Appended records are not written to WAL file right away, they are kept in memory as pending records.
+// A writer, which needs its record on disk, waits for it. The first waiter becomes the leader of the group commit:
+// it writes all pending records with a single write and a single fdatasync, then releases all waiters together.
+// Records appended during the sync are written by the next leader. So concurrent writers share one device flush,
+// instead of paying one flush each.
+//
+// With deferred sync records are written to the file right away, even during the group commit,
+// so they are in OS's page cache and survive a crash of the program. They are synced only by Sync or by waiters.
+// The leader only syncs the file then, so appends don't have to wait for it
+
+// rawEnqueue appends the action's record to pending records
+func (w *W) rawEnqueue(action Action) error {
+	pending, err := appendRecord(w.pending, action)
+	if err != nil {
+		return err
+	}
+
+	w.pending = pending
+
+	if w.deferredSync {
+		return w.rawWritePending()
+	}
+
+	return nil
+}
+
+// EnableDeferredSync makes WAL write appended records to the file right away without syncing them.
+// Records are synced only by Sync or by waiters of WaitSynced
+func (w *W) EnableDeferredSync() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.deferredSync = true
+}
+
+// rawWritePending writes pending records to the file without syncing them
+func (w *W) rawWritePending() error {
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+
+	err := write(w.file, w.pending)
+	if err != nil {
+		w.syncErr = fmt.Errorf("got error when writing records to wal's file: %w", err)
+		w.synced.Broadcast()
+
+		return w.syncErr
+	}
+
+	w.pending = nil
+
+	return nil
+}
+
+// WaitSynced blocks until all records up to lsn are written and synced to disk.
+// The waiter may become the leader, which writes and syncs pending records of all waiters
+func (w *W) WaitSynced(lsn uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.rawWaitSynced(lsn)
+}
+
+func (w *W) rawWaitSynced(lsn uint64) error {
+	for w.syncedLSN < lsn {
+		if w.syncErr != nil {
+			return w.syncErr
+		}
+
+		if w.syncing {
+			w.synced.Wait()
+			continue
+		}
+
+		w.rawLeadSync()
+	}
+
+	return nil
+}
+
+// rawLeadSync writes and syncs all pending records. The lock is released during the I/O,
+// so that other writers can append new records and wait for the next group commit
+func (w *W) rawLeadSync() {
+	// with deferred sync appends write to the file concurrently with the sync, so records are written under the lock
+	if w.deferredSync {
+		err := w.rawWritePending()
+		if err != nil {
+			return
+		}
+	}
+
+	pending := w.pending
+	lsn := w.lastLSN
+	file := w.file
+
+	w.pending = nil
+	w.syncing = true
+
+	w.lock.Unlock()
+	err := writeAndSync(file, pending)
+	w.lock.Lock()
+
+	w.syncing = false
+	w.rawFinishSync(lsn, err)
+}
+
+// SyncedLSN returns the LSN, up to which all records are synced to disk
+func (w *W) SyncedLSN() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.syncedLSN
+}
+
+// Sync writes and syncs all appended records. It's a group commit, so writers are not blocked during the sync
+func (w *W) Sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	err := w.rawWaitSynced(w.lastLSN)
+	if err != nil {
+		return err
+	}
+
+	return w.syncErr
+}
+
+// rawFlush writes and syncs all pending records without releasing the lock.
+// Must be called before any other access to the file, so that the file has all appended records
+func (w *W) rawFlush() error {
+	for w.syncing {
+		w.synced.Wait()
+	}
+
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+
+	if len(w.pending) == 0 && w.syncedLSN >= w.lastLSN {
+		return nil
+	}
+
+	err := writeAndSync(w.file, w.pending)
+
+	w.pending = nil
+	w.rawFinishSync(w.lastLSN, err)
+
+	return err
+}
+
+// rawFinishSync releases waiters of all records up to lsn or makes all waiters fail.
+// A failed write may leave a part of records in the file, so the error is never reset
+func (w *W) rawFinishSync(lsn uint64, err error) {
+	if err != nil {
+		w.syncErr = fmt.Errorf("got error when writing records to wal's file: %w", err)
+	} else if lsn > w.syncedLSN {
+		w.syncedLSN = lsn
+	}
+
+	w.synced.Broadcast()
+}
+
+// writeAndSync writes the buffer and syncs the file. The file is synced even if the buffer is empty,
+// because records may be written without syncing
+func writeAndSync(file *os.File, buffer []byte) error {
+	err := write(file, buffer)
+	if err != nil {
+		return err
+	}
+
+	return fdatasync(file)
+}
+
+func write(file *os.File, buffer []byte) error {
+	if len(buffer) == 0 {
+		return nil
+	}
+
+	n, err := file.Write(buffer)
+	if err != nil {
+		return err
+	}
+	if n != len(buffer) {
+		return fmt.Errorf("appended only %d bytes to WAL file, wanted %d bytes", n, len(buffer))
+	}
+
+	return nil
+}
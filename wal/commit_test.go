@@ -0,0 +1,134 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupCommit(t *testing.T) {
+	openWAL := func(t *testing.T) (*W, string) {
+		path := filepath.Join(t.TempDir(), "wal.bin")
+
+		file, err := os.OpenFile(path, FileFlags, 0644)
+		assert.NoError(t, err)
+
+		t.Cleanup(func() {
+			file.Close()
+		})
+
+		w, _, err := CreateWalAndReturnNotAppliedActions(file, 0)
+		assert.NoError(t, err)
+
+		return w, path
+	}
+
+	readActions := func(t *testing.T, path string) []Action {
+		file, err := os.Open(path)
+		assert.NoError(t, err)
+		defer file.Close()
+
+		actions, err := ReadActions(file, 0)
+		assert.NoError(t, err)
+
+		return actions
+	}
+
+	t.Run("records are written only when synced", func(t *testing.T) {
+		w, path := openWAL(t)
+
+		lsn, err := w.AppendSet([]byte("key"), []byte("value"), 0)
+		assert.NoError(t, err)
+
+		assert.Empty(t, readActions(t, path))
+
+		assert.NoError(t, w.WaitSynced(lsn))
+		assert.Len(t, readActions(t, path), 1)
+
+		_, err = w.AppendDel([]byte("key"))
+		assert.NoError(t, err)
+
+		assert.NoError(t, w.Sync())
+		assert.Len(t, readActions(t, path), 2)
+	})
+
+	t.Run("concurrent writers", func(t *testing.T) {
+		w, path := openWAL(t)
+
+		const writers = 100
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				lsn, err := w.AppendSet([]byte(fmt.Sprintf("key%d", i)), []byte("value"), 0)
+				assert.NoError(t, err)
+
+				assert.NoError(t, w.WaitSynced(lsn))
+			}(i)
+		}
+
+		wg.Wait()
+
+		actions := readActions(t, path)
+		assert.Len(t, actions, writers)
+
+		for i, action := range actions {
+			assert.Equal(t, uint64(i+1), action.LSN)
+		}
+	})
+
+	t.Run("deferred sync writes records right away", func(t *testing.T) {
+		w, path := openWAL(t)
+		w.EnableDeferredSync()
+
+		_, err := w.AppendSet([]byte("key"), []byte("value"), 0)
+		assert.NoError(t, err)
+
+		lsn, err := w.AppendDel([]byte("key"))
+		assert.NoError(t, err)
+
+		assert.Len(t, readActions(t, path), 2)
+
+		assert.NoError(t, w.Sync())
+		assert.NoError(t, w.WaitSynced(lsn))
+	})
+
+	t.Run("deferred sync writes records appended during the sync", func(t *testing.T) {
+		w, path := openWAL(t)
+		w.EnableDeferredSync()
+
+		// the leader of the group commit is syncing the file without the lock
+		w.lock.Lock()
+		w.syncing = true
+		w.lock.Unlock()
+
+		_, err := w.AppendSet([]byte("key"), []byte("value"), 0)
+		assert.NoError(t, err)
+
+		assert.Len(t, readActions(t, path), 1)
+
+		w.lock.Lock()
+		w.syncing = false
+		w.lock.Unlock()
+
+		assert.NoError(t, w.Sync())
+	})
+
+	t.Run("file is accessed after pending records are written", func(t *testing.T) {
+		w, _ := openWAL(t)
+
+		_, err := w.AppendSet([]byte("key"), []byte("value"), 0)
+		assert.NoError(t, err)
+
+		actions, err := w.ActionsSince(0)
+		assert.NoError(t, err)
+		assert.Len(t, actions, 1)
+	})
+}
@@ -0,0 +1,13 @@
+//go:build linux
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+// fdatasync flushes file's data and only the metadata needed to read it, such as file's size
+func fdatasync(file *os.File) error {
+	return syscall.Fdatasync(int(file.Fd()))
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package wal
+
+import "os"
+
+// fdatasync is supported only on Linux, other platforms flush the file fully
+func fdatasync(file *os.File) error {
+	return file.Sync()
+}
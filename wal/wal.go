@@ -1,14 +1,42 @@
 package wal
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// FileFlags are the flags to open WAL file with.
+// WAL file is append only. Writes to it are synced explicitly by group commits, see WaitSynced
+const FileFlags = os.O_RDWR | os.O_CREATE | os.O_APPEND
+
+// ErrCorrupted is returned, when WAL's content can not be read. A torn tail of WAL file is not corruption,
+// it's truncated, when WAL is opened
+var ErrCorrupted = errors.New("wal is corrupted")
+
 type W struct {
-	file    *os.File // represent the persistent file used to store wal data
-	lastLSN uint64   // last known LSN in this log file. Used to generate next LSN
+	file        *os.File // represent the persistent file used to store wal data
+	lastLSN     uint64   // last known LSN in this log file. Used to generate next LSN
+	releasedLSN uint64   // all actions with greater LSNs are kept in the file. History up to this LSN is released
+
+	timeMarks    bool  // if true, then time mark actions are appended, so that the history can be replayed up to some time
+	lastTimeMark int64 // unix milliseconds of the last appended time mark
+
+	tornTail TornTail // the torn tail, which was truncated, when WAL was opened
+
+	pending   []byte // records, which are appended, but not written to the file yet
+	syncedLSN uint64 // all records up to this LSN are written and synced to disk
+	syncing   bool   // if true, then the leader of the group commit is writing and syncing records
+	syncErr   error  // the error of writing or syncing records. WAL can't be used after it
+	// if true, then records are written to the file right away, but synced only by Sync or by waiters
+	deferredSync bool
+	synced       *sync.Cond // signals waiters, when the group commit is finished
 
 	lock sync.Mutex // needed to work with WAL file, to avoid LSN generation and file appending data races
 }
@@ -17,16 +45,32 @@ type Action struct {
 	Type   ActionType
 	LSN    uint64
 	Key    []byte
-	Value  []byte // optional
-	Expire uint32 // optional. 0 is default and means no expire time
+	Value  []byte      // optional
+	Expire int64       // optional. Unix milliseconds. 0 is default and means no expire time
+	Batch  []BatchPart // only for batch actions
+	Time   int64       // only for time mark actions. Unix milliseconds
+}
+
+// BatchPart is a group of batch's actions, which belong to a single segment.
+// Each segment participating in a batch appends the whole batch to its own WAL, so that the batch can be
+// recovered from any of them. The segment's own part always goes first
+type BatchPart struct {
+	Segment uint32 // index of the segment, which the part belongs to
+	LSN     uint64 // LSN of the batch's entry in the segment's WAL
+	Actions []Action
 }
 
 type ActionType byte
 
 const (
 	ActionTypeUnknown ActionType = iota
-	ActionTypeSet
+	ActionTypeSet                // legacy set with expire stored as uint32 unix seconds
 	ActionTypeDel
+	ActionTypeBatch
+	ActionTypeExpire      // legacy expire with expire stored as uint32 unix seconds
+	ActionTypeSetMilli    // set with expire stored as int64 unix milliseconds
+	ActionTypeExpireMilli // expire with expire stored as int64 unix milliseconds
+	ActionTypeTimeMark    // the wall clock time of the following actions. Doesn't change any data
 )
 
 func CreateWalAndReturnNotAppliedActions(file *os.File, lastAppliedLSN uint64) (*W, []Action, error) {
@@ -39,18 +83,214 @@ func CreateWalAndReturnNotAppliedActions(file *os.File, lastAppliedLSN uint64) (
 		lastLSN: lastAppliedLSN,
 	}
 
-	actions, lastLSNFromFile, err := initialRead(file, lastAppliedLSN)
+	w.synced = sync.NewCond(&w.lock)
+
+	content, err := readContent(file, lastAppliedLSN)
 	if err != nil {
 		return nil, nil, fmt.Errorf("got error when initial reading wal file: %w", err)
 	}
 
-	if lastLSNFromFile > 0 {
-		w.lastLSN = lastLSNFromFile
+	// the last records were written only partially, for example because of a power loss.
+	// Actions are applied only after they are appended, so these actions were never applied
+	if content.tornTail.Size > 0 {
+		err = file.Truncate(content.tornTail.Offset)
+		if err == nil {
+			err = file.Sync()
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("got error when truncating wal file's torn tail: %w", err)
+		}
+
+		w.tornTail = content.tornTail
+	}
+
+	actions := content.actions
+
+	if content.lastLSN > w.lastLSN {
+		w.lastLSN = content.lastLSN
+	}
+
+	// the file was opened without O_SYNC, so it may have records, which are not synced yet
+	err = fdatasync(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("got error when syncing wal file: %w", err)
+	}
+
+	w.syncedLSN = w.lastLSN
+
+	// empty file means that the whole history up to the last applied LSN was checkpointed
+	w.releasedLSN = lastAppliedLSN
+
+	firstLSNBuffer := make([]byte, lsnSize)
+	_, err = file.ReadAt(firstLSNBuffer, 0)
+	if err == nil && binary.BigEndian.Uint64(firstLSNBuffer) > 0 {
+		w.releasedLSN = binary.BigEndian.Uint64(firstLSNBuffer) - 1
+	} else if err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("got error when reading first wal's LSN: %w", err)
 	}
 
 	return w, actions, nil
 }
 
+// TornTail returns the torn tail of WAL file, which was truncated, when WAL was opened.
+// Zero size means that the file didn't have a torn tail
+func (w *W) TornTail() TornTail {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.tornTail
+}
+
+// AdvanceLSN makes sure that the next generated LSN will be greater than lsn.
+// Used when some action with lsn is applied to the segment, but it's missing in this WAL.
+// So the history up to lsn is not complete anymore and it's considered released
+func (w *W) AdvanceLSN(lsn uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if lsn > w.lastLSN {
+		w.lastLSN = lsn
+		w.releasedLSN = lsn
+	}
+}
+
+// EnableTimeMarks makes WAL append time marks before actions, so that the history can be replayed up to some time.
+// A time mark is appended only if the time has changed since the previous one
+func (w *W) EnableTimeMarks() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.timeMarks = true
+}
+
+// rawAppendTimeMark appends the time mark for the next action, if time marks are enabled.
+// Time mark has the LSN of the next action, but doesn't take it
+func (w *W) rawAppendTimeMark() error {
+	if !w.timeMarks {
+		return nil
+	}
+
+	now := time.Now().UnixMilli()
+	if now == w.lastTimeMark {
+		return nil
+	}
+
+	action := Action{
+		LSN:  w.lastLSN + 1,
+		Type: ActionTypeTimeMark,
+		Time: now,
+	}
+
+	err := w.rawEnqueue(action)
+	if err != nil {
+		return err
+	}
+
+	w.lastTimeMark = now
+
+	return nil
+}
+
+// ReleasedLSN returns the LSN, up to which WAL's history is released.
+// All actions with greater LSNs are kept in the file
+func (w *W) ReleasedLSN() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.releasedLSN
+}
+
+// ActionsSince reads all actions with LSN greater than lsn from the file.
+// Caller must check that lsn is not lower than ReleasedLSN, otherwise some actions are missing
+func (w *W) ActionsSince(lsn uint64) ([]Action, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	err := w.rawFlush()
+	if err != nil {
+		return nil, err
+	}
+
+	actions, _, err := initialRead(w.file, lsn)
+	if err != nil {
+		return nil, fmt.Errorf("got error when reading wal file: %w", err)
+	}
+
+	return actions, nil
+}
+
+// ReadActions reads all actions with LSN greater than lsn from the reader
+func ReadActions(reader io.ReadSeeker, lsn uint64) ([]Action, error) {
+	actions, _, err := initialRead(reader, lsn)
+	return actions, err
+}
+
+// ReleaseHistory removes all actions with LSN lower or equal to lsn from the file.
+// The file is rewritten to a temporary file, which then replaces the original one.
+// Must be called only after all actions up to lsn are persisted in the segment's file
+func (w *W) ReleaseHistory(lsn uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if lsn <= w.releasedLSN {
+		return nil
+	}
+
+	err := w.rawFlush()
+	if err != nil {
+		return err
+	}
+
+	actions, _, err := initialRead(w.file, lsn)
+	if err != nil {
+		return fmt.Errorf("got error when reading wal file: %w", err)
+	}
+
+	path := w.file.Name()
+	tmpPath := path + ".tmp"
+
+	tmpFile, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("can not create temporary wal file %s: %w", tmpPath, err)
+	}
+
+	for _, action := range actions {
+		err = AppendAction(tmpFile, action)
+		if err != nil {
+			tmpFile.Close()
+			return err
+		}
+	}
+
+	err = tmpFile.Sync()
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("can not replace wal file %s: %w", path, err)
+	}
+
+	file, err := os.OpenFile(path, FileFlags, 0644)
+	if err != nil {
+		return fmt.Errorf("can not reopen wal file %s: %w", path, err)
+	}
+
+	w.file.Close()
+
+	w.file = file
+	w.releasedLSN = lsn
+
+	return nil
+}
+
 func (w *W) LastLSN() uint64 {
 	w.lock.Lock()
 	defer w.lock.Unlock()
@@ -65,7 +305,52 @@ func (w *W) Checkpoint() error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	err := w.file.Truncate(0)
+	// the file must not be truncated during the group commit
+	err := w.rawFlush()
+	if err != nil {
+		return err
+	}
+
+	err = w.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	err = w.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	w.releasedLSN = w.lastLSN
+
+	return nil
+}
+
+// ArchiveAndCheckpoint moves all entries of the file to a new file in archiveDir and then truncates the file,
+// the same as Checkpoint does. The archive file is named by the prefix and the LSN range of its entries,
+// see ArchiveFileName. Empty file is not archived
+func (w *W) ArchiveAndCheckpoint(archiveDir string, prefix string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	err := w.rawFlush()
+	if err != nil {
+		return err
+	}
+
+	stat, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() > 0 {
+		err = w.rawArchive(archiveDir, prefix, stat.Size())
+		if err != nil {
+			return fmt.Errorf("can not archive wal file: %w", err)
+		}
+	}
+
+	err = w.file.Truncate(0)
 	if err != nil {
 		return err
 	}
@@ -75,26 +360,103 @@ func (w *W) Checkpoint() error {
 		return err
 	}
 
+	w.releasedLSN = w.lastLSN
+
 	return nil
 }
 
-func (w *W) AppendSet(key []byte, value []byte, expire uint32) (uint64, error) {
+func (w *W) rawArchive(archiveDir string, prefix string, size int64) error {
+	firstLSNBuffer := make([]byte, lsnSize)
+	_, err := w.file.ReadAt(firstLSNBuffer, 0)
+	if err != nil {
+		return err
+	}
+
+	_, lastLSN, err := initialRead(w.file, w.lastLSN)
+	if err != nil {
+		return err
+	}
+
+	archivePath := fmt.Sprintf("%s/%s", archiveDir, ArchiveFileName(prefix, binary.BigEndian.Uint64(firstLSNBuffer), lastLSN))
+	tmpPath := archivePath + ".tmp"
+
+	archiveFile, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(archiveFile, io.NewSectionReader(w.file, 0, size))
+	if err != nil {
+		archiveFile.Close()
+		return err
+	}
+
+	err = archiveFile.Sync()
+	if err != nil {
+		archiveFile.Close()
+		return err
+	}
+
+	err = archiveFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, archivePath)
+}
+
+// ArchiveFileName returns the name of the archive file with entries from firstLSN to lastLSN inclusive.
+// LSNs are padded with zeros, so that archive files are sorted by their LSNs
+func ArchiveFileName(prefix string, firstLSN uint64, lastLSN uint64) string {
+	return fmt.Sprintf("%s%020d_%020d.wal", prefix, firstLSN, lastLSN)
+}
+
+// ParseArchiveFileName returns the LSN range of the archive file's entries. Returns false if the name doesn't match
+func ParseArchiveFileName(prefix string, name string) (firstLSN uint64, lastLSN uint64, ok bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".wal") {
+		return 0, 0, false
+	}
+
+	lsns := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".wal"), "_")
+	if len(lsns) != 2 {
+		return 0, 0, false
+	}
+
+	firstLSN, err := strconv.ParseUint(lsns[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	lastLSN, err = strconv.ParseUint(lsns[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return firstLSN, lastLSN, true
+}
+
+func (w *W) AppendSet(key []byte, value []byte, expire int64) (uint64, error) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
+	err := w.rawAppendTimeMark()
+	if err != nil {
+		return 0, err
+	}
+
 	w.lastLSN++
 
 	lsn := w.lastLSN
 
 	action := Action{
 		LSN:    lsn,
-		Type:   ActionTypeSet,
+		Type:   ActionTypeSetMilli,
 		Key:    key,
 		Value:  value,
 		Expire: expire,
 	}
 
-	err := AppendAction(w.file, action)
+	err = w.rawEnqueue(action)
 	if err != nil {
 		return 0, err
 	}
@@ -106,6 +468,11 @@ func (w *W) AppendDel(key []byte) (uint64, error) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
+	err := w.rawAppendTimeMark()
+	if err != nil {
+		return 0, err
+	}
+
 	w.lastLSN++
 
 	lsn := w.lastLSN
@@ -116,10 +483,71 @@ func (w *W) AppendDel(key []byte) (uint64, error) {
 		Key:  key,
 	}
 
-	err := AppendAction(w.file, action)
+	err = w.rawEnqueue(action)
 	if err != nil {
 		return 0, err
 	}
 
 	return lsn, nil
 }
+
+func (w *W) AppendExpire(key []byte, expire int64) (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	err := w.rawAppendTimeMark()
+	if err != nil {
+		return 0, err
+	}
+
+	w.lastLSN++
+
+	lsn := w.lastLSN
+
+	action := Action{
+		LSN:    lsn,
+		Type:   ActionTypeExpireMilli,
+		Key:    key,
+		Expire: expire,
+	}
+
+	err = w.rawEnqueue(action)
+	if err != nil {
+		return 0, err
+	}
+
+	return lsn, nil
+}
+
+// AppendBatch appends the batch's parts as a single entry.
+// The first part must belong to the segment of this WAL and its LSN must be the next LSN of this WAL
+func (w *W) AppendBatch(parts []BatchPart) (uint64, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	lsn := w.lastLSN + 1
+
+	if len(parts) == 0 || parts[0].LSN != lsn {
+		return 0, fmt.Errorf("batch's first part must have the next wal's LSN %d", lsn)
+	}
+
+	err := w.rawAppendTimeMark()
+	if err != nil {
+		return 0, err
+	}
+
+	action := Action{
+		LSN:   lsn,
+		Type:  ActionTypeBatch,
+		Batch: parts,
+	}
+
+	err = w.rawEnqueue(action)
+	if err != nil {
+		return 0, err
+	}
+
+	w.lastLSN = lsn
+
+	return lsn, nil
+}
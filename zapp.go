@@ -1,17 +1,44 @@
 package zapp
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"sync"
 	"time"
+
+	"github.com/Kurt212/zapp/blob"
+	"github.com/Kurt212/zapp/wal"
+)
+
+const (
+	scanCursorOffsetBits     = 40 // lower bits of scan cursor store file's offset
+	scanCursorOffsetMask     = 1<<scanCursorOffsetBits - 1
+	scanCursorGenerationBits = 12 // next bits store segment's generation
+	scanCursorGenerationMask = 1<<scanCursorGenerationBits - 1
+	scanCursorSegmentBits    = 12 // higher bits store segment's index
+	scanCursorSegmentShift   = scanCursorOffsetBits + scanCursorGenerationBits
+	maxSegmentsNum           = 1 << scanCursorSegmentBits // every segment's index must fit scan cursor
+	scanCursorDefaultCount   = 10
 )
 
+// NoExpiration is returned by TTL for keys without expiration time
+const NoExpiration time.Duration = -1
+
 type DB struct {
 	segments []*segment
 }
 
+// Item is a single key-value pair returned by scans.
+// Zero ExpireAt means that the item has no expiration time
+type Item struct {
+	Key      []byte
+	Value    []byte
+	ExpireAt time.Time
+}
+
 func New(params Params) (*DB, error) {
 	if err := validateParams(params); err != nil {
 		return nil, err
@@ -30,10 +57,29 @@ func New(params Params) (*DB, error) {
 		}
 	}
 
+	m, err := checkManifest(params)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range m.dirs(params.dataPath) {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("can not create %s dir: %w", dir, err)
+		}
+	}
+
+	if params.walArchivePath != "" {
+		err = os.MkdirAll(params.walArchivePath, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("can not create %s dir: %w", params.walArchivePath, err)
+		}
+	}
+
 	// then open existing/create N segment files
 	var segments []*segment
 	for i := 0; i < params.segmentsNum; i++ {
-		segPath := fmt.Sprintf("%s/%d_data.bin", params.dataPath, i)
+		segPath := dataFilePath(m.segmentPath(params.dataPath, i), i)
 
 		// open for read and write
 		// create file from scratch if it did not exist
@@ -44,12 +90,12 @@ func New(params Params) (*DB, error) {
 
 		var walFile *os.File // nil by default. nil => do not use wal logic
 		if params.useWAL {
-			walPath := fmt.Sprintf("%s/%d_wal.bin", params.dataPath, i)
+			walPath := walFilePath(m.walPath(params.dataPath, i), i)
 			// wal should be readable and writable
 			// if wal file doesn't exist, then it will be created
 			// wal file is append only
-			// writes to wal file should be synchronous! This is extremely important.
-			walFile, err = os.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_SYNC, 0644)
+			// writes to wal file are synced explicitly, see wal.W.WaitSynced
+			walFile, err = os.OpenFile(walPath, wal.FileFlags, 0644)
 			if err != nil {
 				return nil, fmt.Errorf("can not open wal file %s: %w", walPath, err)
 			}
@@ -67,7 +113,27 @@ func New(params Params) (*DB, error) {
 			expiredPeriod = generateNewPeriodWithRandomDelta(params.removeExpiredPeriod, params.removeExpiredDeltaMax)
 		}
 
-		seg, err := newSegment(file, walFile, expiredPeriod, syncPeriod)
+		var options []segmentOption
+		if params.incrementalBackup {
+			options = append(options, withRetainedWALHistory())
+		}
+		if params.walArchivePath != "" {
+			options = append(options, withWALArchive(params.walArchivePath, i))
+		}
+		if params.compactionThreshold > 0 {
+			options = append(options, withAutoCompaction(params.compactionCheckPeriod, params.compactionThreshold))
+		}
+		if params.punchHoleMinSize > 0 {
+			options = append(options, withPunchHoles(params.punchHoleMinSize))
+		}
+		if params.preallocateChunkSize > 0 {
+			options = append(options, withPreallocation(params.preallocateChunkSize))
+		}
+		if params.walSyncInterval > 0 {
+			options = append(options, withWALSyncInterval(params.walSyncInterval))
+		}
+
+		seg, err := newSegment(file, walFile, expiredPeriod, syncPeriod, options...)
 		if err != nil {
 			return nil, fmt.Errorf("can not create segment %s: %w", segPath, err)
 		}
@@ -79,21 +145,30 @@ func New(params Params) (*DB, error) {
 		segments: segments,
 	}
 
+	err = db.recoverBatches()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return db, nil
 }
 
+// Set sets the key's value. Positive ttl sets key's time to live with millisecond precision,
+// otherwise the key has no expiration time
 func (db *DB) Set(key string, data []byte, ttl time.Duration) error {
+	return db.SetWithExpireAt(key, data, ttlToTime(ttl))
+}
+
+// SetWithExpireAt sets the key's value, which expires at expireAt with millisecond precision.
+// Zero expireAt means no expiration time. Time in the past makes the key expired right away
+func (db *DB) SetWithExpireAt(key string, data []byte, expireAt time.Time) error {
 	byteKey := []byte(key)
 
 	h := hash(byteKey)
 	segment := db.getSegmentForKey(h)
 
-	now := time.Now()
-
-	expireTime := uint32(0)
-	if ttl.Milliseconds() > 0 {
-		expireTime = uint32(now.Add(ttl).Unix())
-	}
+	expireTime := timeToExpire(expireAt)
 
 	err := segment.Set(h, byteKey, data, expireTime)
 	if err != nil {
@@ -103,6 +178,74 @@ func (db *DB) Set(key string, data []byte, ttl time.Duration) error {
 	return nil
 }
 
+// SetIfAbsent sets the key only if it doesn't exist or is expired. Returns true if the key was set
+func (db *DB) SetIfAbsent(key string, data []byte, ttl time.Duration) (bool, error) {
+	return db.setIf(key, data, ttl, func(current blob.KVE, exists bool) bool {
+		return !exists
+	})
+}
+
+// SetIfExists sets the key only if it already exists and is not expired. Returns true if the key was set
+func (db *DB) SetIfExists(key string, data []byte, ttl time.Duration) (bool, error) {
+	return db.setIf(key, data, ttl, func(current blob.KVE, exists bool) bool {
+		return exists
+	})
+}
+
+// CompareAndSwap sets the key to newData only if its current value is equal to oldData.
+// A not existing key never matches. Returns true if the key was set
+func (db *DB) CompareAndSwap(key string, oldData []byte, newData []byte, ttl time.Duration) (bool, error) {
+	return db.setIf(key, newData, ttl, func(current blob.KVE, exists bool) bool {
+		return exists && bytes.Equal(current.Value, oldData)
+	})
+}
+
+// GetVersioned returns key's value and its version.
+// Each set of a key gives it a new version, which is greater than any previous version in the same segment.
+// Changing only the key's expiration time doesn't change its version.
+// Returns ErrVersionsNotSupported for segments created with the first file layout, which doesn't store versions
+func (db *DB) GetVersioned(key string) ([]byte, uint64, error) {
+	byteKey := []byte(key)
+
+	h := hash(byteKey)
+	segment := db.getSegmentForKey(h)
+
+	return segment.GetVersioned(h, byteKey)
+}
+
+// SetIfVersion sets the key only if its current version is equal to expectedVersion.
+// Zero expectedVersion means that the key must not exist. Returns true if the key was set.
+// Returns ErrVersionsNotSupported for segments created with the first file layout, which doesn't store versions
+func (db *DB) SetIfVersion(key string, data []byte, ttl time.Duration, expectedVersion uint64) (bool, error) {
+	byteKey := []byte(key)
+
+	h := hash(byteKey)
+	segment := db.getSegmentForKey(h)
+
+	if !segment.HasVersions() {
+		return false, ErrVersionsNotSupported
+	}
+
+	return db.setIf(key, data, ttl, func(current blob.KVE, exists bool) bool {
+		if !exists {
+			return expectedVersion == 0
+		}
+
+		return current.Version == expectedVersion
+	})
+}
+
+func (db *DB) setIf(key string, data []byte, ttl time.Duration, condition setCondition) (bool, error) {
+	byteKey := []byte(key)
+
+	h := hash(byteKey)
+	segment := db.getSegmentForKey(h)
+
+	expireTime := ttlToExpire(ttl)
+
+	return segment.SetIf(h, byteKey, data, expireTime, condition)
+}
+
 func (db *DB) Get(key string) ([]byte, error) {
 	byteKey := []byte(key)
 
@@ -131,17 +274,196 @@ func (db *DB) Delete(key string) error {
 	return nil
 }
 
+// TTL returns the remaining time to live of the key with millisecond precision.
+// Returns NoExpiration if the key exists, but has no expiration time
+func (db *DB) TTL(key string) (time.Duration, error) {
+	byteKey := []byte(key)
+
+	h := hash(byteKey)
+	segment := db.getSegmentForKey(h)
+
+	expire, err := segment.GetExpire(h, byteKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if expire == 0 {
+		return NoExpiration, nil
+	}
+
+	ttl := time.Until(expireToTime(expire)).Truncate(time.Millisecond)
+	// the key is still alive, but it's about to expire
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return ttl, nil
+}
+
+// Expire sets the key's time to live without rewriting its value. Non-positive ttl expires the key immediately
+func (db *DB) Expire(key string, ttl time.Duration) error {
+	return db.ExpireAt(key, time.Now().Add(ttl))
+}
+
+// ExpireAt sets the key's expiration time without rewriting its value.
+// Zero expireAt removes the key's expiration time. Time in the past expires the key immediately
+func (db *DB) ExpireAt(key string, expireAt time.Time) error {
+	byteKey := []byte(key)
+
+	h := hash(byteKey)
+	segment := db.getSegmentForKey(h)
+
+	return segment.SetExpire(h, byteKey, timeToExpire(expireAt))
+}
+
+// Persist removes the key's expiration time without rewriting its value
+func (db *DB) Persist(key string) error {
+	return db.ExpireAt(key, time.Time{})
+}
+
+// Scan calls fn for every live and not expired item stored in the DB.
+// Zero expireAt means that the item has no expiration time.
+// Segments are scanned one by one. Each segment is scanned under its read lock, so the items of one segment
+// are seen as a consistent snapshot, but writes to other segments may happen while scanning.
+// Writes to the segment being scanned wait until its scan is finished.
+// The order of items is not specified. If fn returns false, then scanning stops.
+// fn must not call other DB's methods, otherwise it may deadlock.
+func (db *DB) Scan(fn func(key, value []byte, expireAt time.Time) bool) error {
+	segmentFn := func(key, value []byte, expire int64) bool {
+		return fn(key, value, expireToTime(expire))
+	}
+
+	for _, segment := range db.segments {
+		proceed, err := segment.Scan(segmentFn)
+		if err != nil {
+			return err
+		}
+
+		if !proceed {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// ScanCursor returns the next page of at most count items starting from the cursor and the cursor for the next call.
+// Start a new scan with zero cursor. The returned zero cursor means that the scan is finished.
+// Non-positive count means the default page size of 10 items.
+// The cursor encodes the segment's index, the offset inside the segment's file and the segment's generation.
+// If the segment is compacted or its file is truncated below the cursor's offset during the scan,
+// then its offsets are not valid anymore and the segment is scanned from the beginning.
+// ErrInvalidCursor is returned for cursors, which were not returned by the segment's current generation,
+// and if the segment's file is too large for the cursor's offset.
+// Each call holds a segment's read lock only while collecting its page, so writers are not stalled by long scans.
+// Every key, which exists during the whole scan, is returned at least once.
+// Keys, which are set or deleted during the scan, may be returned or not. Some keys may be returned more than once.
+func (db *DB) ScanCursor(cursor uint64, count int) (_ []Item, nextCursor uint64, _ error) {
+	if count <= 0 {
+		count = scanCursorDefaultCount
+	}
+
+	segmentIdx := int(cursor >> scanCursorSegmentShift)
+	generation := uint16(cursor >> scanCursorOffsetBits & scanCursorGenerationMask)
+	offset := int64(cursor & scanCursorOffsetMask)
+
+	if segmentIdx >= len(db.segments) {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	var items []Item
+
+	for segmentIdx < len(db.segments) {
+		page, nextOffset, nextGeneration, err := db.segments[segmentIdx].ScanPage(offset, generation, count-len(items))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		items = append(items, page...)
+
+		// the segment is finished, move to the next one
+		if nextOffset == 0 {
+			segmentIdx++
+			offset = 0
+
+			if len(items) >= count {
+				break
+			}
+
+			continue
+		}
+
+		// the page is full
+		offset = nextOffset
+		generation = nextGeneration
+		break
+	}
+
+	if segmentIdx >= len(db.segments) {
+		return items, 0, nil
+	}
+
+	// the offset must not overflow into the generation's bits
+	if offset > scanCursorOffsetMask {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	nextCursor = uint64(segmentIdx)<<scanCursorSegmentShift | uint64(generation)<<scanCursorOffsetBits | uint64(offset)
+
+	return items, nextCursor, nil
+}
+
+// Compact rewrites each segment's file densely, so that space of deleted and expired items is returned to the filesystem.
+// Segments are compacted one by one. A segment is locked for reads and writes while its file is rewritten
+func (db *DB) Compact() error {
+	for idx, segment := range db.segments {
+		err := segment.Compact()
+		if err != nil {
+			return fmt.Errorf("can not compact segment %d: %w", idx, err)
+		}
+	}
+
+	return nil
+}
+
+// WALTornTails returns torn tails of segments' WAL files by segments' indexes.
+// A torn tail is the end of WAL file, which was only partially written, for example because of a power loss.
+// Its records were never applied, so it's truncated, when the DB is opened. Segments without torn tails are omitted
+func (db *DB) WALTornTails() map[int]wal.TornTail {
+	tornTails := make(map[int]wal.TornTail)
+	for idx, segment := range db.segments {
+		tornTail := segment.WALTornTail()
+		if tornTail.Size > 0 {
+			tornTails[idx] = tornTail
+		}
+	}
+
+	return tornTails
+}
+
 func (db *DB) Close() {
+	err := db.close()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// close closes all segments and returns errors of closing their files
+func (db *DB) close() error {
+	errs := make([]error, len(db.segments))
+
 	wg := sync.WaitGroup{}
-	for _, s := range db.segments {
+	for i, s := range db.segments {
 		wg.Add(1)
-		go func(s *segment) {
+		go func(i int, s *segment) {
 			defer wg.Done()
-			s.Close()
-		}(s)
+			errs[i] = s.close()
+		}(i, s)
 	}
 
 	wg.Wait()
+
+	return errors.Join(errs...)
 }
 
 func (db *DB) getSegmentForKey(hash uint32) *segment {
@@ -152,10 +474,67 @@ func (db *DB) getSegmentForKey(hash uint32) *segment {
 	return segment
 }
 
+// dataFilePath returns the path of segment's data file inside the directory
+func dataFilePath(dataPath string, segmentIdx int) string {
+	return fmt.Sprintf("%s/%d_data.bin", dataPath, segmentIdx)
+}
+
+// walArchivePrefix returns the prefix of segment's WAL archive files names
+func walArchivePrefix(segmentIdx int) string {
+	return fmt.Sprintf("%d_", segmentIdx)
+}
+
+// walFilePath returns the path of segment's WAL file inside the directory
+func walFilePath(dataPath string, segmentIdx int) string {
+	return fmt.Sprintf("%s/%d_wal.bin", dataPath, segmentIdx)
+}
+
 func getSegmentIndex(hash uint32, segmentsCount int) int {
 	return int(hash % uint32(segmentsCount))
 }
 
+// ttlToTime converts ttl to expiration time. Non-positive ttl means no expiration time, which is zero time
+func ttlToTime(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(ttl)
+}
+
+// ttlToExpire converts ttl to expire timestamp in unix milliseconds. Zero expire timestamp means no expiration time
+func ttlToExpire(ttl time.Duration) int64 {
+	return timeToExpire(ttlToTime(ttl))
+}
+
+// timeToExpire converts time to expire timestamp in unix milliseconds. Zero time means no expiration time.
+// The time is rounded up, so that positive ttl shorter than a millisecond doesn't expire the key right away
+func timeToExpire(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	expire := t.UnixMilli()
+	if t.After(time.UnixMilli(expire)) {
+		expire++
+	}
+
+	// zero timestamp means no expiration time, so the smallest possible time is used instead
+	if expire <= 0 {
+		return 1
+	}
+
+	return expire
+}
+
+func expireToTime(expire int64) time.Time {
+	if expire == 0 {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(expire)
+}
+
 func generateNewPeriodWithRandomDelta(period time.Duration, maxDelta time.Duration) time.Duration {
 	delta := time.Duration(rand.Int63n(int64(maxDelta)))
 	return period + delta
@@ -0,0 +1,1968 @@
+package zapp
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Kurt212/zapp/wal"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDB(t *testing.T, builderFn func(pb *ParamsBuilder)) (*DB, string) {
+	dir, err := os.MkdirTemp(os.TempDir(), "zapp-*")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	pb := NewParamsBuilder(dir).
+		SegmentsNum(4).
+		SyncPeriod(0).
+		RemoveExpiredPeriod(0)
+
+	if builderFn != nil {
+		builderFn(pb)
+	}
+
+	db, err := New(pb.Params())
+	require.NoError(t, err)
+
+	return db, dir
+}
+
+func copyFile(t *testing.T, from string, to string) {
+	content, err := os.ReadFile(from)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(to, content, 0644))
+}
+
+func TestScan(t *testing.T) {
+	t.Run("scan all live items", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		expected := make(map[string]string)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			value := fmt.Sprintf("value-%d", i)
+
+			err := db.Set(key, []byte(value), 0)
+			require.NoError(t, err)
+
+			expected[key] = value
+		}
+
+		// deleted and expired items must not be visible
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("key-%d", i)
+
+			err := db.Delete(key)
+			require.NoError(t, err)
+
+			delete(expected, key)
+		}
+
+		err := db.Set("expired", []byte("value"), time.Millisecond)
+		require.NoError(t, err)
+
+		time.Sleep(time.Second)
+
+		err = db.Set("with-ttl", []byte("value"), time.Hour)
+		require.NoError(t, err)
+
+		expected["with-ttl"] = "value"
+
+		result := make(map[string]string)
+		err = db.Scan(func(key, value []byte, expireAt time.Time) bool {
+			if string(key) == "with-ttl" {
+				require.False(t, expireAt.IsZero())
+			} else {
+				require.True(t, expireAt.IsZero())
+			}
+
+			result[string(key)] = string(value)
+			return true
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, expected, result)
+	})
+
+	t.Run("stop scan early", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key-%d", i), []byte("value"), 0)
+			require.NoError(t, err)
+		}
+
+		visited := 0
+		err := db.Scan(func(key, value []byte, expireAt time.Time) bool {
+			visited++
+			return visited < 10
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, 10, visited)
+	})
+}
+
+func TestScanCursor(t *testing.T) {
+	t.Run("scan all items by pages", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		expected := make(map[string]string)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			value := fmt.Sprintf("value-%d", i)
+
+			err := db.Set(key, []byte(value), 0)
+			require.NoError(t, err)
+
+			expected[key] = value
+		}
+
+		result := make(map[string]string)
+
+		cursor := uint64(0)
+		for {
+			items, nextCursor, err := db.ScanCursor(cursor, 7)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(items), 7)
+
+			for _, item := range items {
+				_, seen := result[string(item.Key)]
+				require.False(t, seen)
+
+				result[string(item.Key)] = string(item.Value)
+			}
+
+			if nextCursor == 0 {
+				break
+			}
+
+			cursor = nextCursor
+		}
+
+		require.Equal(t, expected, result)
+	})
+
+	t.Run("keys existing during the whole scan are returned", func(t *testing.T) {
+		db, _ := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.SegmentsNum(1)
+		})
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key-%d", i), []byte("value"), 0)
+			require.NoError(t, err)
+		}
+
+		// free some slots at the beginning of the file, so that updated keys could move there
+		for i := 0; i < 10; i++ {
+			err := db.Delete(fmt.Sprintf("key-%d", i))
+			require.NoError(t, err)
+		}
+
+		result := make(map[string]struct{})
+
+		cursor := uint64(0)
+		for page := 0; ; page++ {
+			items, nextCursor, err := db.ScanCursor(cursor, 5)
+			require.NoError(t, err)
+
+			for _, item := range items {
+				result[string(item.Key)] = struct{}{}
+			}
+
+			// rewrite not yet visited keys with the value of the same size
+			err = db.Set(fmt.Sprintf("key-%d", 99-page), []byte("VALUE"), 0)
+			require.NoError(t, err)
+
+			if nextCursor == 0 {
+				break
+			}
+
+			cursor = nextCursor
+		}
+
+		for i := 10; i < 100; i++ {
+			require.Contains(t, result, fmt.Sprintf("key-%d", i))
+		}
+	})
+
+	t.Run("invalid cursor", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		_, _, err := db.ScanCursor(uint64(100)<<scanCursorSegmentShift, 10)
+		require.ErrorIs(t, err, ErrInvalidCursor)
+
+		// the offset was never handed out in the current generation
+		_, _, err = db.ScanCursor(1<<20, 10)
+		require.ErrorIs(t, err, ErrInvalidCursor)
+	})
+
+	t.Run("cursor of wrapped generation", func(t *testing.T) {
+		db, _ := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.SegmentsNum(1)
+		})
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key-%d", i), []byte("value"), 0)
+			require.NoError(t, err)
+		}
+
+		_, cursor, err := db.ScanCursor(0, 10)
+		require.NoError(t, err)
+		require.NotZero(t, cursor)
+
+		segment := db.segments[0]
+
+		segment.mtx.Lock()
+		for i := 0; i < 1<<scanCursorGenerationBits; i++ {
+			segment.rawNextGeneration()
+		}
+		segment.mtx.Unlock()
+
+		_, _, err = db.ScanCursor(cursor, 10)
+		require.ErrorIs(t, err, ErrInvalidCursor)
+	})
+
+	t.Run("segments' indexes must fit cursor", func(t *testing.T) {
+		_, err := New(NewParamsBuilder(t.TempDir()).SegmentsNum(maxSegmentsNum + 1).Params())
+		require.ErrorIs(t, err, ErrInvalidSegmentsNum)
+	})
+}
+
+func TestWriteBatch(t *testing.T) {
+	t.Run("commit puts and deletes", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		err := db.Set("deleted", []byte("value"), 0)
+		require.NoError(t, err)
+
+		batch := db.NewWriteBatch()
+		for i := 0; i < 20; i++ {
+			batch.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i)), 0)
+		}
+		batch.Put("key-0", []byte("value-0 new"), 0)
+		batch.Delete("deleted")
+		batch.Delete("not existing")
+
+		require.Equal(t, 23, batch.Len())
+
+		err = batch.Commit()
+		require.NoError(t, err)
+
+		value, err := db.Get("key-0")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value-0 new"), value)
+
+		for i := 1; i < 20; i++ {
+			value, err := db.Get(fmt.Sprintf("key-%d", i))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), value)
+		}
+
+		_, err = db.Get("deleted")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		err = batch.Commit()
+		require.ErrorIs(t, err, ErrBatchCommitted)
+	})
+
+	t.Run("batch is durable", func(t *testing.T) {
+		db, dir := newTestDB(t, nil)
+
+		batch := db.NewWriteBatch()
+		for i := 0; i < 20; i++ {
+			batch.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i)), 0)
+		}
+
+		err := batch.Commit()
+		require.NoError(t, err)
+
+		db.Close()
+
+		db, err = New(NewParamsBuilder(dir).SegmentsNum(4).SyncPeriod(0).RemoveExpiredPeriod(0).Params())
+		require.NoError(t, err)
+		defer db.Close()
+
+		for i := 0; i < 20; i++ {
+			value, err := db.Get(fmt.Sprintf("key-%d", i))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), value)
+		}
+	})
+
+	t.Run("recover batch from another segment's wal", func(t *testing.T) {
+		dir, err := os.MkdirTemp(os.TempDir(), "zapp-*")
+		require.NoError(t, err)
+
+		defer os.RemoveAll(dir)
+
+		// find keys belonging to different segments
+		keys := make(map[int]string)
+		for i := 0; len(keys) < 2; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			keys[getSegmentIndex(hash([]byte(key)), 2)] = key
+		}
+
+		// the program stopped after appending the batch to the first segment's WAL
+		walFile, err := os.Create(fmt.Sprintf("%s/0_wal.bin", dir))
+		require.NoError(t, err)
+
+		err = makeWAL(walFile, []wal.Action{
+			{
+				Type: wal.ActionTypeBatch,
+				LSN:  1,
+				Batch: []wal.BatchPart{
+					{
+						Segment: 0,
+						LSN:     1,
+						Actions: []wal.Action{
+							{Type: wal.ActionTypeSet, Key: []byte(keys[0]), Value: []byte("value0")},
+						},
+					},
+					{
+						Segment: 1,
+						LSN:     1,
+						Actions: []wal.Action{
+							{Type: wal.ActionTypeSet, Key: []byte(keys[1]), Value: []byte("value1")},
+						},
+					},
+				},
+			},
+		})
+		require.NoError(t, err)
+		require.NoError(t, walFile.Close())
+
+		// the second segment's WAL file exists, but doesn't have the batch
+		require.NoError(t, os.WriteFile(fmt.Sprintf("%s/1_wal.bin", dir), nil, 0644))
+
+		params := NewParamsBuilder(dir).SegmentsNum(2).SyncPeriod(0).RemoveExpiredPeriod(0).Params()
+
+		db, err := New(params)
+		require.NoError(t, err)
+
+		value, err := db.Get(keys[0])
+		require.NoError(t, err)
+		require.Equal(t, []byte("value0"), value)
+
+		value, err = db.Get(keys[1])
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), value)
+
+		require.Equal(t, uint64(1), db.segments[1].lastKnownLSN)
+		require.Equal(t, uint64(1), db.segments[1].wal.LastLSN())
+
+		db.Close()
+
+		// after recovery the first segment's WAL is truncated
+		walBuffer, err := os.ReadFile(fmt.Sprintf("%s/0_wal.bin", dir))
+		require.NoError(t, err)
+		require.Empty(t, walBuffer)
+
+		db, err = New(params)
+		require.NoError(t, err)
+		defer db.Close()
+
+		value, err = db.Get(keys[1])
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), value)
+	})
+}
+
+func TestConditionalSet(t *testing.T) {
+	t.Run("set if absent", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		ok, err := db.SetIfAbsent("key", []byte("value1"), 0)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		ok, err = db.SetIfAbsent("key", []byte("value2"), 0)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		value, err := db.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), value)
+	})
+
+	t.Run("set if exists", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		ok, err := db.SetIfExists("key", []byte("value1"), 0)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		_, err = db.Get("key")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		err = db.Set("key", []byte("value1"), 0)
+		require.NoError(t, err)
+
+		ok, err = db.SetIfExists("key", []byte("value2"), 0)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		value, err := db.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value2"), value)
+	})
+
+	t.Run("compare and swap", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		ok, err := db.CompareAndSwap("key", nil, []byte("value1"), 0)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		err = db.Set("key", []byte("value1"), 0)
+		require.NoError(t, err)
+
+		ok, err = db.CompareAndSwap("key", []byte("other"), []byte("value2"), 0)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		ok, err = db.CompareAndSwap("key", []byte("value1"), []byte("value2"), 0)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		value, err := db.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value2"), value)
+	})
+
+	t.Run("only one concurrent claim succeeds", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		var claimed atomic.Int32
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				ok, err := db.SetIfAbsent("job", []byte(fmt.Sprintf("worker-%d", i)), 0)
+				require.NoError(t, err)
+
+				if ok {
+					claimed.Add(1)
+				}
+			}(i)
+		}
+
+		wg.Wait()
+
+		require.Equal(t, int32(1), claimed.Load())
+	})
+}
+
+func TestVersions(t *testing.T) {
+	t.Run("set if version", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		ok, err := db.SetIfVersion("key", []byte("value1"), 0, 0)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		value, version1, err := db.GetVersioned("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), value)
+		require.NotZero(t, version1)
+
+		ok, err = db.SetIfVersion("key", []byte("value2"), 0, 0)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		ok, err = db.SetIfVersion("key", []byte("value2"), 0, version1)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		value, version2, err := db.GetVersioned("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value2"), value)
+		require.Greater(t, version2, version1)
+
+		// stale version doesn't match anymore
+		ok, err = db.SetIfVersion("key", []byte("value3"), 0, version1)
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("versions are kept after reopening", func(t *testing.T) {
+		for _, useWAL := range []bool{true, false} {
+			db, dir := newTestDB(t, func(pb *ParamsBuilder) {
+				pb.UseWAL(useWAL)
+			})
+
+			err := db.Set("key", []byte("value"), 0)
+			require.NoError(t, err)
+
+			err = db.Set("other", []byte("value"), 0)
+			require.NoError(t, err)
+
+			_, version, err := db.GetVersioned("key")
+			require.NoError(t, err)
+
+			_, deletedVersion, err := db.GetVersioned("other")
+			require.NoError(t, err)
+
+			// deleted item's version must not be reused
+			err = db.Delete("other")
+			require.NoError(t, err)
+
+			db.Close()
+
+			params := NewParamsBuilder(dir).SegmentsNum(4).SyncPeriod(0).RemoveExpiredPeriod(0).UseWAL(useWAL).Params()
+
+			db, err = New(params)
+			require.NoError(t, err)
+
+			_, reopenedVersion, err := db.GetVersioned("key")
+			require.NoError(t, err)
+			require.Equal(t, version, reopenedVersion)
+
+			err = db.Set("other", []byte("value"), 0)
+			require.NoError(t, err)
+
+			_, otherVersion, err := db.GetVersioned("other")
+			require.NoError(t, err)
+
+			require.Greater(t, otherVersion, deletedVersion)
+
+			db.Close()
+		}
+	})
+}
+
+func TestTTL(t *testing.T) {
+	t.Run("change ttl without rewriting value", func(t *testing.T) {
+		db, dir := newTestDB(t, nil)
+
+		err := db.Set("key", []byte("value"), 0)
+		require.NoError(t, err)
+
+		ttl, err := db.TTL("key")
+		require.NoError(t, err)
+		require.Equal(t, NoExpiration, ttl)
+
+		_, version, err := db.GetVersioned("key")
+		require.NoError(t, err)
+
+		err = db.Expire("key", time.Hour)
+		require.NoError(t, err)
+
+		ttl, err = db.TTL("key")
+		require.NoError(t, err)
+		require.Greater(t, ttl, 59*time.Minute)
+		require.LessOrEqual(t, ttl, time.Hour)
+
+		value, newVersion, err := db.GetVersioned("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+		require.Equal(t, version, newVersion)
+
+		db.Close()
+
+		// expire time is durable
+		db, err = New(NewParamsBuilder(dir).SegmentsNum(4).SyncPeriod(0).RemoveExpiredPeriod(0).Params())
+		require.NoError(t, err)
+		defer db.Close()
+
+		ttl, err = db.TTL("key")
+		require.NoError(t, err)
+		require.Greater(t, ttl, 59*time.Minute)
+
+		err = db.Persist("key")
+		require.NoError(t, err)
+
+		ttl, err = db.TTL("key")
+		require.NoError(t, err)
+		require.Equal(t, NoExpiration, ttl)
+	})
+
+	t.Run("lost expire change is recovered from WAL", func(t *testing.T) {
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) { pb.SegmentsNum(1) })
+
+		require.NoError(t, db.Set("key", []byte("value"), 50*time.Millisecond))
+		db.segments[0].fsync()
+
+		// the data file as it was synced before the crash, it doesn't have the expire change
+		crashedDir := t.TempDir()
+		copyFile(t, dataFilePath(dir, 0), dataFilePath(crashedDir, 0))
+		copyFile(t, filepath.Join(dir, manifestFileName), filepath.Join(crashedDir, manifestFileName))
+
+		require.NoError(t, db.Persist("key"))
+
+		copyFile(t, walFilePath(dir, 0), walFilePath(crashedDir, 0))
+
+		db.Close()
+
+		// the item is expired on disk, when the DB is opened
+		time.Sleep(60 * time.Millisecond)
+
+		db, err := New(NewParamsBuilder(crashedDir).SegmentsNum(1).SyncPeriod(0).Params())
+		require.NoError(t, err)
+		defer db.Close()
+
+		value, err := db.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+
+		ttl, err := db.TTL("key")
+		require.NoError(t, err)
+		require.Equal(t, NoExpiration, ttl)
+	})
+
+	t.Run("expire in the past", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		err := db.Set("key", []byte("value"), 0)
+		require.NoError(t, err)
+
+		err = db.ExpireAt("key", time.Now().Add(-time.Hour))
+		require.NoError(t, err)
+
+		_, err = db.Get("key")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		_, err = db.TTL("key")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("not existing key", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		_, err := db.TTL("key")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		err = db.Expire("key", time.Hour)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		err = db.Persist("key")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("sub-second ttl", func(t *testing.T) {
+		db, _ := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.UseWAL(true)
+		})
+		defer db.Close()
+
+		err := db.Set("key", []byte("value"), 50*time.Millisecond)
+		require.NoError(t, err)
+
+		ttl, err := db.TTL("key")
+		require.NoError(t, err)
+		require.Greater(t, ttl, time.Duration(0))
+		require.LessOrEqual(t, ttl, 50*time.Millisecond)
+
+		_, err = db.Get("key")
+		require.NoError(t, err)
+
+		time.Sleep(60 * time.Millisecond)
+
+		_, err = db.Get("key")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("set with expire at", func(t *testing.T) {
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.UseWAL(true)
+		})
+
+		expireAt := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli() + 123)
+
+		err := db.SetWithExpireAt("key", []byte("value"), expireAt)
+		require.NoError(t, err)
+
+		err = db.SetWithExpireAt("persistent", []byte("value"), time.Time{})
+		require.NoError(t, err)
+
+		db.Close()
+
+		db, err = New(NewParamsBuilder(dir).SegmentsNum(4).UseWAL(true).SyncPeriod(0).RemoveExpiredPeriod(0).Params())
+		require.NoError(t, err)
+		defer db.Close()
+
+		var items []Item
+		err = db.Scan(func(key, value []byte, expire time.Time) bool {
+			items = append(items, Item{Key: key, ExpireAt: expire})
+			return true
+		})
+		require.NoError(t, err)
+		require.Len(t, items, 2)
+
+		for _, item := range items {
+			if string(item.Key) == "key" {
+				require.True(t, expireAt.Equal(item.ExpireAt))
+			} else {
+				require.True(t, item.ExpireAt.IsZero())
+			}
+		}
+	})
+}
+
+func TestBackup(t *testing.T) {
+	t.Run("backup and restore", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)), 0)
+			require.NoError(t, err)
+		}
+
+		err := db.Delete("key0")
+		require.NoError(t, err)
+
+		_, version, err := db.GetVersioned("key1")
+		require.NoError(t, err)
+
+		archive := bytes.NewBuffer(nil)
+
+		lsns, err := db.Backup(archive)
+		require.NoError(t, err)
+		require.Len(t, lsns, 4)
+
+		// changes after the backup are not in the archive
+		err = db.Set("key100", []byte("value100"), 0)
+		require.NoError(t, err)
+
+		restoreDir, err := os.MkdirTemp(os.TempDir(), "zapp-*")
+		require.NoError(t, err)
+		defer os.RemoveAll(restoreDir)
+
+		err = Restore(bytes.NewReader(archive.Bytes()), restoreDir)
+		require.NoError(t, err)
+
+		restored, err := New(NewParamsBuilder(restoreDir).SegmentsNum(4).SyncPeriod(0).RemoveExpiredPeriod(0).Params())
+		require.NoError(t, err)
+		defer restored.Close()
+
+		count := 0
+		err = restored.Scan(func(key, value []byte, expireAt time.Time) bool {
+			count++
+			return true
+		})
+		require.NoError(t, err)
+		require.Equal(t, 99, count)
+
+		_, err = restored.Get("key0")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		_, err = restored.Get("key100")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		value, restoredVersion, err := restored.GetVersioned("key1")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), value)
+		require.Equal(t, version, restoredVersion)
+
+		// new versions continue after the restored ones
+		err = restored.Set("key1", []byte("new value"), 0)
+		require.NoError(t, err)
+
+		_, newVersion, err := restored.GetVersioned("key1")
+		require.NoError(t, err)
+		require.Greater(t, newVersion, version)
+	})
+
+	t.Run("corrupted archive", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		err := db.Set("key", []byte("value"), 0)
+		require.NoError(t, err)
+
+		archive := bytes.NewBuffer(nil)
+
+		_, err = db.Backup(archive)
+		require.NoError(t, err)
+
+		data := archive.Bytes()
+		data[len(data)/2] ^= 0xFF
+
+		restoreDir, err := os.MkdirTemp(os.TempDir(), "zapp-*")
+		require.NoError(t, err)
+		defer os.RemoveAll(restoreDir)
+
+		err = Restore(bytes.NewReader(data), restoreDir)
+		require.ErrorIs(t, err, ErrCorruptedBackup)
+
+		entries, err := os.ReadDir(restoreDir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+
+		err = Restore(bytes.NewReader(data[:len(data)-10]), restoreDir)
+		require.ErrorIs(t, err, ErrCorruptedBackup)
+	})
+
+	t.Run("restore to not empty directory", func(t *testing.T) {
+		_, dir := newTestDB(t, nil)
+
+		err := Restore(bytes.NewReader(nil), dir)
+		require.ErrorIs(t, err, ErrDirNotEmpty)
+	})
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	dump := func(t *testing.T, db *DB) map[string]string {
+		result := map[string]string{}
+
+		err := db.Scan(func(key, value []byte, expireAt time.Time) bool {
+			result[string(key)] = string(value)
+			return true
+		})
+		require.NoError(t, err)
+
+		return result
+	}
+
+	fsync := func(db *DB) {
+		for _, segment := range db.segments {
+			segment.fsync()
+		}
+	}
+
+	t.Run("restore base and incremental backups", func(t *testing.T) {
+		db, _ := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.IncrementalBackup(true)
+		})
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key%d", i), []byte("base"), 0)
+			require.NoError(t, err)
+		}
+
+		base := bytes.NewBuffer(nil)
+
+		lsns, err := db.Backup(base)
+		require.NoError(t, err)
+
+		for i := 0; i < 100; i += 2 {
+			err := db.Set(fmt.Sprintf("key%d", i), []byte("first"), 0)
+			require.NoError(t, err)
+		}
+
+		err = db.Delete("key1")
+		require.NoError(t, err)
+
+		// checkpoints don't release WAL's history
+		fsync(db)
+
+		first := bytes.NewBuffer(nil)
+
+		firstLSNs, err := db.BackupSince(lsns, first)
+		require.NoError(t, err)
+
+		batch := db.NewWriteBatch()
+		for i := 0; i < 100; i += 3 {
+			batch.Put(fmt.Sprintf("key%d", i), []byte("second"), 0)
+		}
+		batch.Delete("key2")
+		require.NoError(t, batch.Commit())
+
+		second := bytes.NewBuffer(nil)
+
+		_, err = db.BackupSince(firstLSNs, second)
+		require.NoError(t, err)
+
+		restoreDir, err := os.MkdirTemp(os.TempDir(), "zapp-*")
+		require.NoError(t, err)
+		defer os.RemoveAll(restoreDir)
+
+		// incremental backups must go one after another
+		err = Restore(bytes.NewReader(base.Bytes()), restoreDir, bytes.NewReader(second.Bytes()))
+		require.ErrorIs(t, err, ErrBackupChainBroken)
+
+		err = Restore(
+			bytes.NewReader(base.Bytes()),
+			restoreDir,
+			bytes.NewReader(first.Bytes()),
+			bytes.NewReader(second.Bytes()),
+		)
+		require.NoError(t, err)
+
+		restored, err := New(NewParamsBuilder(restoreDir).SegmentsNum(4).SyncPeriod(0).RemoveExpiredPeriod(0).Params())
+		require.NoError(t, err)
+		defer restored.Close()
+
+		require.Equal(t, dump(t, db), dump(t, restored))
+	})
+
+	t.Run("released history", func(t *testing.T) {
+		db, _ := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.IncrementalBackup(true)
+		})
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key%d", i), []byte("value"), 0)
+			require.NoError(t, err)
+		}
+
+		lsns, err := db.Backup(bytes.NewBuffer(nil))
+		require.NoError(t, err)
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key%d", i), []byte("new value"), 0)
+			require.NoError(t, err)
+		}
+
+		newLSNs, err := db.Backup(bytes.NewBuffer(nil))
+		require.NoError(t, err)
+
+		err = db.ReleaseWALHistory(newLSNs)
+		require.NoError(t, err)
+
+		_, err = db.BackupSince(lsns, bytes.NewBuffer(nil))
+		require.ErrorIs(t, err, ErrWALHistoryReleased)
+
+		_, err = db.BackupSince(newLSNs, bytes.NewBuffer(nil))
+		require.NoError(t, err)
+	})
+
+	t.Run("history is truncated without incremental backup param", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		lsns, err := db.Backup(bytes.NewBuffer(nil))
+		require.NoError(t, err)
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key%d", i), []byte("value"), 0)
+			require.NoError(t, err)
+		}
+
+		fsync(db)
+
+		_, err = db.BackupSince(lsns, bytes.NewBuffer(nil))
+		require.ErrorIs(t, err, ErrWALHistoryReleased)
+	})
+
+	t.Run("incremental backup requires wal", func(t *testing.T) {
+		_, err := New(NewParamsBuilder(os.TempDir()).UseWAL(false).IncrementalBackup(true).Params())
+		require.ErrorIs(t, err, ErrIncrementalBackupWithoutWAL)
+	})
+}
+
+func TestRecoverToPoint(t *testing.T) {
+	dump := func(t *testing.T, db *DB) map[string]string {
+		result := map[string]string{}
+
+		err := db.Scan(func(key, value []byte, expireAt time.Time) bool {
+			result[string(key)] = string(value)
+			return true
+		})
+		require.NoError(t, err)
+
+		return result
+	}
+
+	fsync := func(db *DB) {
+		for _, segment := range db.segments {
+			segment.fsync()
+		}
+	}
+
+	recoverDB := func(t *testing.T, backup []byte, archiveDir string, target RecoveryTarget) map[string]string {
+		recoverDir, err := os.MkdirTemp(os.TempDir(), "zapp-*")
+		require.NoError(t, err)
+		defer os.RemoveAll(recoverDir)
+
+		err = RecoverToPoint(bytes.NewReader(backup), archiveDir, recoverDir, target)
+		require.NoError(t, err)
+
+		recovered, err := New(NewParamsBuilder(recoverDir).SegmentsNum(4).SyncPeriod(0).RemoveExpiredPeriod(0).Params())
+		require.NoError(t, err)
+		defer recovered.Close()
+
+		return dump(t, recovered)
+	}
+
+	t.Run("recover state before mass delete", func(t *testing.T) {
+		archiveDir, err := os.MkdirTemp(os.TempDir(), "zapp-*")
+		require.NoError(t, err)
+		defer os.RemoveAll(archiveDir)
+
+		db, _ := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.WALArchivePath(archiveDir)
+		})
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key%d", i), []byte("base"), 0)
+			require.NoError(t, err)
+		}
+
+		backup := bytes.NewBuffer(nil)
+
+		_, err = db.Backup(backup)
+		require.NoError(t, err)
+
+		for i := 0; i < 100; i += 2 {
+			err := db.Set(fmt.Sprintf("key%d", i), []byte("updated"), 0)
+			require.NoError(t, err)
+		}
+
+		// checkpoints move WAL's entries to the archive
+		fsync(db)
+
+		batch := db.NewWriteBatch()
+		for i := 0; i < 100; i += 5 {
+			batch.Put(fmt.Sprintf("key%d", i), []byte("batch"), 0)
+		}
+		require.NoError(t, batch.Commit())
+
+		fsync(db)
+
+		beforeDelete := dump(t, db)
+
+		time.Sleep(5 * time.Millisecond)
+		pointInTime := time.Now()
+		time.Sleep(5 * time.Millisecond)
+
+		for i := 0; i < 100; i++ {
+			err := db.Delete(fmt.Sprintf("key%d", i))
+			require.NoError(t, err)
+		}
+
+		fsync(db)
+
+		require.Empty(t, dump(t, db))
+
+		require.Equal(t, beforeDelete, recoverDB(t, backup.Bytes(), archiveDir, RecoveryTarget{Time: pointInTime}))
+
+		// without target all archived actions are replayed
+		require.Empty(t, recoverDB(t, backup.Bytes(), archiveDir, RecoveryTarget{}))
+	})
+
+	t.Run("recover up to lsn", func(t *testing.T) {
+		archiveDir, err := os.MkdirTemp(os.TempDir(), "zapp-*")
+		require.NoError(t, err)
+		defer os.RemoveAll(archiveDir)
+
+		db, _ := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.WALArchivePath(archiveDir).SegmentsNum(1)
+		})
+		defer db.Close()
+
+		backup := bytes.NewBuffer(nil)
+
+		lsns, err := db.Backup(backup)
+		require.NoError(t, err)
+
+		err = db.Set("key", []byte("first"), 0)
+		require.NoError(t, err)
+
+		err = db.Set("key", []byte("second"), 0)
+		require.NoError(t, err)
+
+		fsync(db)
+
+		recoverDir, err := os.MkdirTemp(os.TempDir(), "zapp-*")
+		require.NoError(t, err)
+		defer os.RemoveAll(recoverDir)
+
+		err = RecoverToPoint(bytes.NewReader(backup.Bytes()), archiveDir, recoverDir, RecoveryTarget{
+			LSNs: map[int]uint64{0: lsns[0] + 1},
+		})
+		require.NoError(t, err)
+
+		recovered, err := New(NewParamsBuilder(recoverDir).SegmentsNum(1).SyncPeriod(0).RemoveExpiredPeriod(0).Params())
+		require.NoError(t, err)
+		defer recovered.Close()
+
+		value, err := recovered.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("first"), value)
+	})
+
+	t.Run("archive must continue the backup", func(t *testing.T) {
+		archiveDir, err := os.MkdirTemp(os.TempDir(), "zapp-*")
+		require.NoError(t, err)
+		defer os.RemoveAll(archiveDir)
+
+		db, _ := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.WALArchivePath(archiveDir)
+		})
+		defer db.Close()
+
+		backup := bytes.NewBuffer(nil)
+
+		_, err = db.Backup(backup)
+		require.NoError(t, err)
+
+		for round := 0; round < 2; round++ {
+			for i := 0; i < 100; i++ {
+				err := db.Set(fmt.Sprintf("key%d", i), []byte("value"), 0)
+				require.NoError(t, err)
+			}
+
+			fsync(db)
+		}
+
+		entries, err := os.ReadDir(archiveDir)
+		require.NoError(t, err)
+		require.NotEmpty(t, entries)
+
+		// losing the first archive file leaves a gap
+		require.NoError(t, os.Remove(filepath.Join(archiveDir, entries[0].Name())))
+
+		recoverDir, err := os.MkdirTemp(os.TempDir(), "zapp-*")
+		require.NoError(t, err)
+		defer os.RemoveAll(recoverDir)
+
+		err = RecoverToPoint(bytes.NewReader(backup.Bytes()), archiveDir, recoverDir, RecoveryTarget{})
+		require.ErrorIs(t, err, ErrBackupChainBroken)
+	})
+
+	t.Run("wal archive requires wal", func(t *testing.T) {
+		_, err := New(NewParamsBuilder(os.TempDir()).UseWAL(false).WALArchivePath(os.TempDir()).Params())
+		require.ErrorIs(t, err, ErrInvalidWALArchive)
+	})
+}
+
+func TestCompact(t *testing.T) {
+	t.Run("scan cursor survives compaction", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		for i := 0; i < 200; i++ {
+			err := db.Set(fmt.Sprintf("key-%d", i), []byte("value"), 0)
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 100; i++ {
+			err := db.Delete(fmt.Sprintf("key-%d", i))
+			require.NoError(t, err)
+		}
+
+		result := map[string]bool{}
+
+		items, cursor, err := db.ScanCursor(0, 10)
+		require.NoError(t, err)
+
+		for _, item := range items {
+			result[string(item.Key)] = true
+		}
+
+		// items are moved to lower offsets, so the cursor's offset is not valid anymore
+		err = db.Compact()
+		require.NoError(t, err)
+
+		for cursor != 0 {
+			items, cursor, err = db.ScanCursor(cursor, 10)
+			require.NoError(t, err)
+
+			for _, item := range items {
+				result[string(item.Key)] = true
+			}
+		}
+
+		require.Len(t, result, 100)
+		for i := 100; i < 200; i++ {
+			require.Contains(t, result, fmt.Sprintf("key-%d", i))
+		}
+	})
+
+	t.Run("automatic compaction", func(t *testing.T) {
+		db, _ := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.SegmentsNum(1).CompactionThreshold(0.5).CompactionCheckPeriod(time.Millisecond)
+		})
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key-%d", i), []byte("value"), 0)
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 90; i++ {
+			err := db.Delete(fmt.Sprintf("key-%d", i))
+			require.NoError(t, err)
+		}
+
+		// compaction may run between deletes, then the rest of deletes leave less free space, than the threshold
+		require.Eventually(t, func() bool {
+			fragmentation, err := db.segments[0].Fragmentation()
+			require.NoError(t, err)
+
+			return fragmentation < 0.5
+		}, 10*time.Second, time.Millisecond)
+
+		for i := 90; i < 100; i++ {
+			value, err := db.Get(fmt.Sprintf("key-%d", i))
+			require.NoError(t, err)
+			require.Equal(t, []byte("value"), value)
+		}
+	})
+
+	t.Run("invalid compaction threshold", func(t *testing.T) {
+		_, err := New(NewParamsBuilder(os.TempDir()).CompactionThreshold(1).Params())
+		require.ErrorIs(t, err, ErrInvalidCompactionThreshold)
+	})
+}
+
+func TestReshard(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		from   int
+		to     int
+		useWAL bool
+	}{
+		{name: "more segments with WAL", from: 4, to: 16, useWAL: true},
+		{name: "fewer segments without WAL", from: 4, to: 2, useWAL: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db, dir := newTestDB(t, func(pb *ParamsBuilder) {
+				pb.SegmentsNum(tc.from).UseWAL(tc.useWAL)
+			})
+
+			for i := 0; i < 200; i++ {
+				err := db.Set(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i)), 0)
+				require.NoError(t, err)
+			}
+
+			err := db.Set("ttl", []byte("value"), time.Hour)
+			require.NoError(t, err)
+
+			err = db.Set("expired", []byte("value"), time.Millisecond)
+			require.NoError(t, err)
+
+			_, oldVersion, err := db.GetVersioned("key-0")
+			require.NoError(t, err)
+
+			db.Close()
+
+			time.Sleep(2 * time.Millisecond)
+
+			err = Reshard(dir, tc.from, tc.to)
+			require.NoError(t, err)
+
+			require.NoFileExists(t, dataFilePath(dir, tc.to))
+			require.NoDirExists(t, filepath.Join(dir, reshardDirName))
+
+			db, err = New(NewParamsBuilder(dir).
+				SegmentsNum(tc.to).
+				UseWAL(tc.useWAL).
+				SyncPeriod(0).
+				RemoveExpiredPeriod(0).
+				Params())
+			require.NoError(t, err)
+			defer db.Close()
+
+			for i := 0; i < 200; i++ {
+				value, err := db.Get(fmt.Sprintf("key-%d", i))
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), value)
+			}
+
+			ttl, err := db.TTL("ttl")
+			require.NoError(t, err)
+			require.Greater(t, ttl, 59*time.Minute)
+
+			_, err = db.Get("expired")
+			require.ErrorIs(t, err, ErrNotFound)
+
+			// old versions never match resharded items
+			_, newVersion, err := db.GetVersioned("key-0")
+			require.NoError(t, err)
+			require.Greater(t, newVersion, oldVersion)
+
+			ok, err := db.SetIfVersion("key-0", []byte("new"), 0, oldVersion)
+			require.NoError(t, err)
+			require.False(t, ok)
+		})
+	}
+
+	t.Run("wrong number of segments", func(t *testing.T) {
+		db, dir := newTestDB(t, nil)
+		db.Close()
+
+		err := Reshard(dir, 2, 8)
+		require.ErrorIs(t, err, ErrSegmentsNumMismatch)
+
+		err = Reshard(dir, 8, 2)
+		require.ErrorIs(t, err, ErrSegmentsNumMismatch)
+	})
+
+	t.Run("interrupted replacing is finished by New", func(t *testing.T) {
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.UseWAL(true)
+		})
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i)), 0)
+			require.NoError(t, err)
+		}
+
+		db.Close()
+
+		oldManifest, newManifest, err := prepareReshard(dir, 4, 2)
+		require.NoError(t, err)
+
+		// crash after the marker is written and the first file is moved
+		oldManifest.Reshard = &newManifest
+
+		err = writeManifest(dir, oldManifest)
+		require.NoError(t, err)
+
+		err = os.Rename(dataFilePath(filepath.Join(dir, reshardDirName), 0), dataFilePath(dir, 0))
+		require.NoError(t, err)
+
+		db, err = New(NewParamsBuilder(dir).
+			SegmentsNum(2).
+			UseWAL(true).
+			SyncPeriod(0).
+			RemoveExpiredPeriod(0).
+			Params())
+		require.NoError(t, err)
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			value, err := db.Get(fmt.Sprintf("key-%d", i))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), value)
+		}
+
+		require.NoFileExists(t, dataFilePath(dir, 2))
+		require.NoFileExists(t, walFilePath(dir, 3))
+		require.NoDirExists(t, filepath.Join(dir, reshardDirName))
+
+		m, err := readManifest(dir)
+		require.NoError(t, err)
+		require.Nil(t, m.Reshard)
+		require.Equal(t, 2, m.SegmentsNum)
+	})
+}
+
+func TestManifest(t *testing.T) {
+	openDB := func(dir string, segmentsNum int, useWAL bool) (*DB, error) {
+		return New(NewParamsBuilder(dir).
+			SegmentsNum(segmentsNum).
+			UseWAL(useWAL).
+			SyncPeriod(0).
+			RemoveExpiredPeriod(0).
+			Params())
+	}
+
+	t.Run("manifest is written on creation", func(t *testing.T) {
+		db, dir := newTestDB(t, nil)
+		db.Close()
+
+		m, err := readManifest(dir)
+		require.NoError(t, err)
+		require.Equal(t, newManifest(NewParamsBuilder(dir).SegmentsNum(4).Params()), m)
+	})
+
+	t.Run("another number of segments", func(t *testing.T) {
+		db, dir := newTestDB(t, nil)
+		db.Close()
+
+		_, err := openDB(dir, 8, true)
+		require.ErrorIs(t, err, ErrSegmentsNumMismatch)
+
+		_, err = openDB(dir, 2, true)
+		require.ErrorIs(t, err, ErrSegmentsNumMismatch)
+	})
+
+	t.Run("directory without manifest", func(t *testing.T) {
+		db, dir := newTestDB(t, nil)
+		db.Close()
+
+		// the directory was created before manifests were introduced
+		require.NoError(t, os.Remove(filepath.Join(dir, manifestFileName)))
+
+		_, err := openDB(dir, 2, true)
+		require.ErrorIs(t, err, ErrSegmentsNumMismatch)
+
+		_, err = openDB(dir, 8, true)
+		require.ErrorIs(t, err, ErrSegmentsNumMismatch)
+		require.NoFileExists(t, filepath.Join(dir, manifestFileName))
+
+		db, err = openDB(dir, 4, true)
+		require.NoError(t, err)
+		db.Close()
+
+		require.FileExists(t, filepath.Join(dir, manifestFileName))
+	})
+
+	t.Run("WAL files with disabled WAL", func(t *testing.T) {
+		db, dir := newTestDB(t, nil)
+		db.Close()
+
+		// closing applies all WAL's actions, so WAL files are not needed anymore
+		db, err := openDB(dir, 4, false)
+		require.NoError(t, err)
+		db.Close()
+
+		m, err := readManifest(dir)
+		require.NoError(t, err)
+		require.False(t, m.UseWAL)
+	})
+
+	t.Run("not applied WAL actions with disabled WAL", func(t *testing.T) {
+		db, dir := newTestDB(t, nil)
+
+		// the data files as they were before the crash, they don't have the set
+		crashedDir := t.TempDir()
+		for i := 0; i < 4; i++ {
+			copyFile(t, dataFilePath(dir, i), dataFilePath(crashedDir, i))
+		}
+		copyFile(t, filepath.Join(dir, manifestFileName), filepath.Join(crashedDir, manifestFileName))
+
+		require.NoError(t, db.Set("key", []byte("value"), 0))
+
+		for i := 0; i < 4; i++ {
+			copyFile(t, walFilePath(dir, i), walFilePath(crashedDir, i))
+		}
+
+		db.Close()
+
+		_, err := openDB(crashedDir, 4, false)
+		require.ErrorIs(t, err, ErrWALRequired)
+
+		// WAL's actions are applied and the directory can be opened without WAL
+		db, err = openDB(crashedDir, 4, true)
+		require.NoError(t, err)
+		db.Close()
+
+		db, err = openDB(crashedDir, 4, false)
+		require.NoError(t, err)
+		defer db.Close()
+
+		value, err := db.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+	})
+
+	t.Run("unknown hash function", func(t *testing.T) {
+		db, dir := newTestDB(t, nil)
+		db.Close()
+
+		m, err := readManifest(dir)
+		require.NoError(t, err)
+
+		m.HashFunction = "xxhash"
+		require.NoError(t, writeManifest(dir, m))
+
+		_, err = openDB(dir, 4, true)
+		require.ErrorIs(t, err, ErrHashFunctionMismatch)
+	})
+}
+
+func TestDataPaths(t *testing.T) {
+	t.Run("segments are spread over data paths", func(t *testing.T) {
+		root := t.TempDir()
+		dataPaths := []string{filepath.Join(root, "drive0"), filepath.Join(root, "drive1")}
+		walPath := filepath.Join(root, "wal")
+
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.DataPaths(dataPaths).WALPath(walPath)
+		})
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key-%d", i), []byte("value"), 0)
+			require.NoError(t, err)
+		}
+
+		db.Close()
+
+		for i := 0; i < 4; i++ {
+			require.FileExists(t, dataFilePath(dataPaths[i%2], i))
+			require.NoFileExists(t, dataFilePath(dataPaths[(i+1)%2], i))
+			require.NoFileExists(t, dataFilePath(dir, i))
+			require.FileExists(t, walFilePath(walPath, i))
+		}
+
+		// the placement is taken from the manifest
+		db, err := New(NewParamsBuilder(dir).SegmentsNum(4).SyncPeriod(0).RemoveExpiredPeriod(0).Params())
+		require.NoError(t, err)
+
+		for i := 0; i < 100; i++ {
+			value, err := db.Get(fmt.Sprintf("key-%d", i))
+			require.NoError(t, err)
+			require.Equal(t, []byte("value"), value)
+		}
+
+		db.Close()
+
+		_, err = New(NewParamsBuilder(dir).SegmentsNum(4).DataPaths(dataPaths[:1]).Params())
+		require.ErrorIs(t, err, ErrPlacementMismatch)
+
+		_, err = New(NewParamsBuilder(dir).SegmentsNum(4).WALPath(dir).Params())
+		require.ErrorIs(t, err, ErrPlacementMismatch)
+	})
+
+	t.Run("weighted placement", func(t *testing.T) {
+		placement := placeSegments(8, []string{"a", "b"}, []int{3, 1})
+		require.Equal(t, []string{"a", "a", "b", "a", "a", "a", "b", "a"}, placement)
+
+		paths, weights := placementWeights(placement)
+		require.Equal(t, []string{"a", "b"}, paths)
+		require.Equal(t, []int{6, 2}, weights)
+	})
+
+	t.Run("reshard keeps placement", func(t *testing.T) {
+		root := t.TempDir()
+		dataPaths := []string{filepath.Join(root, "drive0"), filepath.Join(root, "drive1")}
+
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.DataPaths(dataPaths)
+		})
+
+		for i := 0; i < 100; i++ {
+			err := db.Set(fmt.Sprintf("key-%d", i), []byte("value"), 0)
+			require.NoError(t, err)
+		}
+
+		db.Close()
+
+		err := Reshard(dir, 4, 6)
+		require.NoError(t, err)
+
+		for i := 0; i < 6; i++ {
+			require.FileExists(t, dataFilePath(dataPaths[i%2], i))
+			require.NoFileExists(t, dataFilePath(dataPaths[(i+1)%2], i))
+		}
+
+		db, err = New(NewParamsBuilder(dir).SegmentsNum(6).SyncPeriod(0).RemoveExpiredPeriod(0).Params())
+		require.NoError(t, err)
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			value, err := db.Get(fmt.Sprintf("key-%d", i))
+			require.NoError(t, err)
+			require.Equal(t, []byte("value"), value)
+		}
+	})
+
+	t.Run("invalid weights", func(t *testing.T) {
+		_, err := New(NewParamsBuilder(os.TempDir()).DataPaths([]string{"a", "b"}).DataPathWeights([]int{1}).Params())
+		require.ErrorIs(t, err, ErrInvalidDataPathWeights)
+	})
+}
+
+func TestWALTornTail(t *testing.T) {
+	appendActions := func(t *testing.T, actions ...wal.Action) []byte {
+		buffer := bytes.NewBuffer(nil)
+		for _, action := range actions {
+			require.NoError(t, wal.AppendAction(buffer, action))
+		}
+
+		return buffer.Bytes()
+	}
+
+	writeWAL := func(t *testing.T, dir string, content []byte) {
+		require.NoError(t, os.WriteFile(walFilePath(dir, 0), content, 0644))
+	}
+
+	openDB := func(dir string) (*DB, error) {
+		return New(NewParamsBuilder(dir).
+			SegmentsNum(1).
+			SyncPeriod(0).
+			RemoveExpiredPeriod(0).
+			Params())
+	}
+
+	first := wal.Action{LSN: 1000, Type: wal.ActionTypeSetMilli, Key: []byte("key1"), Value: []byte("value1")}
+	second := wal.Action{LSN: 1001, Type: wal.ActionTypeSetMilli, Key: []byte("key2"), Value: []byte("value2")}
+
+	t.Run("torn tail is truncated", func(t *testing.T) {
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) { pb.SegmentsNum(1) })
+		db.Close()
+
+		complete := appendActions(t, first)
+		content := appendActions(t, first, second)
+		content = content[:len(content)-3]
+
+		writeWAL(t, dir, content)
+
+		db, err := openDB(dir)
+		require.NoError(t, err)
+
+		require.Equal(t, map[int]wal.TornTail{
+			0: {Offset: int64(len(complete)), Size: int64(len(content) - len(complete)), Records: 1},
+		}, db.WALTornTails())
+
+		value, err := db.Get("key1")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), value)
+
+		_, err = db.Get("key2")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		require.NoError(t, db.Set("key3", []byte("value3"), 0))
+
+		db.Close()
+
+		db, err = openDB(dir)
+		require.NoError(t, err)
+		defer db.Close()
+
+		require.Empty(t, db.WALTornTails())
+
+		value, err = db.Get("key3")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value3"), value)
+	})
+
+	t.Run("corruption in the middle", func(t *testing.T) {
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) { pb.SegmentsNum(1) })
+		db.Close()
+
+		content := appendActions(t, first, second)
+		content[len(appendActions(t, first))-1] ^= 0xff
+
+		writeWAL(t, dir, content)
+
+		_, err := openDB(dir)
+		require.ErrorIs(t, err, ErrCorruptedWAL)
+	})
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	t.Run("writes are in WAL file, when they return", func(t *testing.T) {
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) { pb.SegmentsNum(1) })
+		defer db.Close()
+
+		const writers = 50
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				require.NoError(t, db.Set(fmt.Sprintf("key%d", i), []byte("value"), 0))
+			}(i)
+		}
+
+		wg.Wait()
+
+		batch := db.NewWriteBatch()
+		batch.Put("batch key", []byte("value"), 0)
+		require.NoError(t, batch.Commit())
+
+		require.NoError(t, db.Delete("key0"))
+
+		file, err := os.Open(walFilePath(dir, 0))
+		require.NoError(t, err)
+		defer file.Close()
+
+		actions, err := wal.ReadActions(file, 0)
+		require.NoError(t, err)
+		require.Len(t, actions, writers+2)
+	})
+}
+
+func TestWALSyncInterval(t *testing.T) {
+	t.Run("invalid params", func(t *testing.T) {
+		dir := t.TempDir()
+
+		_, err := New(NewParamsBuilder(dir).UseWAL(false).WALSyncInterval(time.Second).Params())
+		require.ErrorIs(t, err, ErrInvalidWALSyncInterval)
+
+		_, err = New(NewParamsBuilder(dir).WALSyncInterval(-time.Second).Params())
+		require.ErrorIs(t, err, ErrInvalidWALSyncInterval)
+	})
+
+	t.Run("data file is changed only after WAL sync", func(t *testing.T) {
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.SegmentsNum(1).WALSyncInterval(time.Hour)
+		})
+		defer db.Close()
+
+		require.NoError(t, db.Set("key", []byte("not synced value"), 0))
+
+		data, err := os.ReadFile(dataFilePath(dir, 0))
+		require.NoError(t, err)
+		require.NotContains(t, string(data), "not synced value")
+
+		// scanning syncs WAL and applies the write
+		err = db.Scan(func(key, value []byte, expireAt time.Time) bool { return true })
+		require.NoError(t, err)
+
+		data, err = os.ReadFile(dataFilePath(dir, 0))
+		require.NoError(t, err)
+		require.Contains(t, string(data), "not synced value")
+	})
+
+	t.Run("pending writes are read without WAL sync", func(t *testing.T) {
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.SegmentsNum(1).WALSyncInterval(time.Hour)
+		})
+		defer db.Close()
+
+		require.NoError(t, db.Set("key", []byte("value"), 0))
+		require.NoError(t, db.Expire("key", time.Hour))
+
+		value, version, err := db.GetVersioned("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+
+		ttl, err := db.TTL("key")
+		require.NoError(t, err)
+		require.Greater(t, ttl, 59*time.Minute)
+
+		// conditional writes see pending writes as well
+		ok, err := db.SetIfVersion("key", []byte("new value"), 0, version)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		value, err = db.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("new value"), value)
+
+		require.NoError(t, db.Delete("key"))
+
+		_, err = db.Get("key")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		err = db.Delete("key")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		require.Zero(t, db.segments[0].wal.SyncedLSN())
+
+		data, err := os.ReadFile(dataFilePath(dir, 0))
+		require.NoError(t, err)
+		require.NotContains(t, string(data), "value")
+	})
+
+	t.Run("expire change of pending item is not lost by collecting expired items", func(t *testing.T) {
+		db, _ := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.SegmentsNum(1).WALSyncInterval(time.Hour)
+		})
+		defer db.Close()
+
+		require.NoError(t, db.Set("key", []byte("value"), 300*time.Millisecond))
+		require.NoError(t, db.Persist("key"))
+
+		time.Sleep(400 * time.Millisecond)
+
+		db.segments[0].collectExpiredItems()
+
+		value, err := db.Get("key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), value)
+
+		ttl, err := db.TTL("key")
+		require.NoError(t, err)
+		require.Equal(t, NoExpiration, ttl)
+	})
+
+	t.Run("writes are in WAL file without sync", func(t *testing.T) {
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) {
+			pb.SegmentsNum(1).WALSyncInterval(time.Millisecond)
+		})
+
+		require.NoError(t, db.Set("key1", []byte("value1"), 0))
+		require.NoError(t, db.Set("key2", []byte("value2"), 0))
+		require.NoError(t, db.Delete("key1"))
+
+		file, err := os.Open(walFilePath(dir, 0))
+		require.NoError(t, err)
+		defer file.Close()
+
+		actions, err := wal.ReadActions(file, 0)
+		require.NoError(t, err)
+		require.Len(t, actions, 3)
+
+		// background process syncs WAL
+		time.Sleep(10 * time.Millisecond)
+
+		db.Close()
+
+		db, err = New(NewParamsBuilder(dir).SegmentsNum(1).WALSyncInterval(time.Millisecond).Params())
+		require.NoError(t, err)
+		defer db.Close()
+
+		_, err = db.Get("key1")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		value, err := db.Get("key2")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value2"), value)
+	})
+}
+
+func TestSyncModes(t *testing.T) {
+	readWAL := func(t *testing.T, dir string) []wal.Action {
+		file, err := os.Open(walFilePath(dir, 0))
+		require.NoError(t, err)
+		defer file.Close()
+
+		actions, err := wal.ReadActions(file, 0)
+		require.NoError(t, err)
+
+		return actions
+	}
+
+	t.Run("invalid sync mode", func(t *testing.T) {
+		db, _ := newTestDB(t, nil)
+		defer db.Close()
+
+		err := db.SetWithOptions("key", []byte("value"), SetOptions{Sync: SyncAlways + 1})
+		require.ErrorIs(t, err, ErrInvalidSyncMode)
+
+		err = db.DeleteWithOptions("key", DeleteOptions{Sync: -1})
+		require.ErrorIs(t, err, ErrInvalidSyncMode)
+	})
+
+	t.Run("unlogged writes are not in WAL", func(t *testing.T) {
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) { pb.SegmentsNum(1) })
+
+		require.NoError(t, db.SetWithOptions("key1", []byte("value1"), SetOptions{Sync: SyncNone}))
+		require.NoError(t, db.SetWithOptions("key2", []byte("value2"), SetOptions{Sync: SyncWAL}))
+		require.NoError(t, db.SetWithOptions("key3", []byte("value3"), SetOptions{Sync: SyncAlways, TTL: time.Hour}))
+		require.NoError(t, db.DeleteWithOptions("key2", DeleteOptions{Sync: SyncNone}))
+
+		actions := readWAL(t, dir)
+		require.Len(t, actions, 2)
+		require.Equal(t, []byte("key2"), actions[0].Key)
+		require.Equal(t, []byte("key3"), actions[1].Key)
+
+		db.Close()
+
+		db, err := New(NewParamsBuilder(dir).SegmentsNum(1).Params())
+		require.NoError(t, err)
+		defer db.Close()
+
+		value, err := db.Get("key1")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), value)
+
+		_, err = db.Get("key2")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		ttl, err := db.TTL("key3")
+		require.NoError(t, err)
+		require.Greater(t, ttl, time.Minute)
+	})
+
+	t.Run("unlogged writes get new versions", func(t *testing.T) {
+		db, _ := newTestDB(t, func(pb *ParamsBuilder) { pb.SegmentsNum(1) })
+		defer db.Close()
+
+		require.NoError(t, db.Set("key", []byte("value1"), 0))
+		_, logged, err := db.GetVersioned("key")
+		require.NoError(t, err)
+
+		require.NoError(t, db.SetWithOptions("key", []byte("value2"), SetOptions{Sync: SyncNone}))
+		_, unlogged, err := db.GetVersioned("key")
+		require.NoError(t, err)
+		require.Greater(t, unlogged, logged)
+
+		require.NoError(t, db.Set("key", []byte("value3"), 0))
+		_, next, err := db.GetVersioned("key")
+		require.NoError(t, err)
+		require.Greater(t, next, unlogged)
+	})
+
+	t.Run("unlogged writes release WAL history", func(t *testing.T) {
+		db, _ := newTestDB(t, func(pb *ParamsBuilder) { pb.SegmentsNum(1) })
+		defer db.Close()
+
+		require.NoError(t, db.Set("key1", []byte("value1"), 0))
+		lsn := db.segments[0].wal.LastLSN()
+
+		require.NoError(t, db.SetWithOptions("key2", []byte("value2"), SetOptions{Sync: SyncNone}))
+
+		require.Greater(t, db.segments[0].wal.ReleasedLSN(), lsn)
+	})
+
+	t.Run("unlogged writes with WAL history", func(t *testing.T) {
+		for name, configure := range map[string]func(pb *ParamsBuilder){
+			"incremental backup": func(pb *ParamsBuilder) { pb.SegmentsNum(1).IncrementalBackup(true) },
+			"WAL archive":        func(pb *ParamsBuilder) { pb.SegmentsNum(1).WALArchivePath(t.TempDir()) },
+		} {
+			t.Run(name, func(t *testing.T) {
+				db, _ := newTestDB(t, configure)
+				defer db.Close()
+
+				require.NoError(t, db.Set("key1", []byte("value1"), 0))
+
+				err := db.SetWithOptions("key2", []byte("value2"), SetOptions{Sync: SyncNone})
+				require.ErrorIs(t, err, ErrSyncNoneWithWALHistory)
+
+				err = db.DeleteWithOptions("key1", DeleteOptions{Sync: SyncNone})
+				require.ErrorIs(t, err, ErrSyncNoneWithWALHistory)
+
+				_, err = db.Get("key2")
+				require.ErrorIs(t, err, ErrNotFound)
+
+				_, err = db.Get("key1")
+				require.NoError(t, err)
+			})
+		}
+	})
+
+	t.Run("recovery of mixed writes", func(t *testing.T) {
+		db, dir := newTestDB(t, func(pb *ParamsBuilder) { pb.SegmentsNum(1) })
+
+		require.NoError(t, db.Set("key0", []byte("value0"), 0))
+		db.segments[0].fsync()
+
+		// the data file as it was synced before the crash
+		crashedDir := t.TempDir()
+		copyFile(t, dataFilePath(dir, 0), dataFilePath(crashedDir, 0))
+		copyFile(t, filepath.Join(dir, manifestFileName), filepath.Join(crashedDir, manifestFileName))
+
+		require.NoError(t, db.Set("key1", []byte("value1"), 0))
+		require.NoError(t, db.SetWithOptions("key2", []byte("value2"), SetOptions{Sync: SyncNone}))
+		require.NoError(t, db.SetWithOptions("key0", []byte("new value0"), SetOptions{Sync: SyncNone}))
+		require.NoError(t, db.Set("key3", []byte("value3"), 0))
+
+		copyFile(t, walFilePath(dir, 0), walFilePath(crashedDir, 0))
+
+		db.Close()
+
+		db, err := New(NewParamsBuilder(crashedDir).SegmentsNum(1).SyncPeriod(0).Params())
+		require.NoError(t, err)
+		defer db.Close()
+
+		// logged writes are recovered, unlogged writes since the last sync are lost
+		for key, expected := range map[string]string{"key0": "value0", "key1": "value1", "key3": "value3"} {
+			value, err := db.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, []byte(expected), value)
+		}
+
+		_, err = db.Get("key2")
+		require.ErrorIs(t, err, ErrNotFound)
+
+		// versions given after recovery don't repeat versions of recovered items
+		_, version, err := db.GetVersioned("key3")
+		require.NoError(t, err)
+
+		require.NoError(t, db.Set("key4", []byte("value4"), 0))
+		_, next, err := db.GetVersioned("key4")
+		require.NoError(t, err)
+		require.Greater(t, next, version)
+	})
+}